@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+// AdminAPI serves the /admin endpoints, every request must carry one of the
+// configured tokens as a bearer token and is attributed to its admin
+type AdminAPI struct {
+	// admin names keyed by token
+	tokens map[string]string
+
+	simState *sim.SimulationState
+	hub      *Hub
+	bans     *BanList
+}
+
+// adminError is returned by admin handlers to answer with a status code
+type adminError struct {
+	status  int
+	message string
+}
+
+func (err *adminError) Error() string {
+	return err.message
+}
+
+type adminHandler func(admin string, r *http.Request) (interface{}, error)
+
+// parseAdminTokens reads a comma separated list of name:token pairs
+func parseAdminTokens(value string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+
+		name, token, ok := strings.Cut(pair, ":")
+		if !ok || len(name) == 0 || len(token) == 0 {
+			return nil, fmt.Errorf("admin token %q is not in the form name:token", name)
+		}
+
+		if _, exists := tokens[token]; exists {
+			return nil, fmt.Errorf("admin token for %v is already used", name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+func newAdminAPI(tokens map[string]string, simState *sim.SimulationState, hub *Hub, bans *BanList) *AdminAPI {
+	return &AdminAPI{tokens: tokens, simState: simState, hub: hub, bans: bans}
+}
+
+// register adds the admin endpoints to mux, nothing is served when no
+// tokens are configured
+func (api *AdminAPI) register(mux *http.ServeMux) {
+	if len(api.tokens) == 0 {
+		return
+	}
+
+	mux.HandleFunc("/admin/kick", api.handle(http.MethodPost, api.kick))
+	mux.HandleFunc("/admin/mute", api.handle(http.MethodPost, api.mute))
+	mux.HandleFunc("/admin/unmute", api.handle(http.MethodPost, api.unmute))
+	mux.HandleFunc("/admin/remove-bodies", api.handle(http.MethodPost, api.removeBodies))
+	mux.HandleFunc("/admin/ban", api.handle(http.MethodPost, api.ban))
+	mux.HandleFunc("/admin/unban", api.handle(http.MethodPost, api.unban))
+	mux.HandleFunc("/admin/bans", api.handle(http.MethodGet, api.listBans))
+	mux.HandleFunc("/admin/fields", api.handle(http.MethodGet, api.listFields))
+	mux.HandleFunc("/admin/set-field", api.handle(http.MethodPost, api.setField))
+	mux.HandleFunc("/admin/remove-field", api.handle(http.MethodPost, api.removeField))
+}
+
+// authorize returns the admin a request's bearer token belongs to
+func (api *AdminAPI) authorize(r *http.Request) (string, bool) {
+	return matchAdminToken(api.tokens, r)
+}
+
+// matchAdminToken returns the admin of tokens a request's bearer token
+// belongs to
+func matchAdminToken(tokens map[string]string, r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	// compare against every token so the time taken does not leak a match
+	admin := ""
+	for candidate, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			admin = name
+		}
+	}
+	return admin, len(admin) > 0
+}
+
+// handle checks the method and token of a request and writes the handler's
+// result or error as JSON
+func (api *AdminAPI) handle(method string, handler adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method must be " + method})
+			return
+		}
+
+		admin, ok := api.authorize(r)
+		if !ok {
+			slog.Warn("Unauthorized admin request", "path", r.URL.Path, "remote", api.hub.proxies.remoteAddr(r))
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or unknown admin token"})
+			return
+		}
+
+		result, err := handler(admin, r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var adminErr *adminError
+			if errors.As(err, &adminErr) {
+				status = adminErr.status
+			} else {
+				slog.Error("Error handling admin request", "path", r.URL.Path, "admin", admin, "err", err)
+			}
+
+			writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("Error writing admin response", "err", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseAdminTokens(t *testing.T) {
+	tokens, err := parseAdminTokens("alice:secret, bob:hunter2,")
+	if err != nil {
+		t.Fatalf("Error parsing admin tokens %v", err)
+	}
+
+	if len(tokens) != 2 || tokens["secret"] != "alice" || tokens["hunter2"] != "bob" {
+		t.Errorf("Admin tokens are %v, expected alice and bob", tokens)
+	}
+
+	for _, value := range []string{"alice", "alice:", ":secret", "alice:secret,bob:secret"} {
+		if _, err := parseAdminTokens(value); err == nil {
+			t.Errorf("parseAdminTokens(%q) error is nil, expected an error", value)
+		}
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	api := newAdminAPI(map[string]string{"secret": "alice"}, nil, newHub(make(chan *Snapshot), make(chan *ClientMessage)), nil)
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	tests := []struct {
+		method, header string
+		status         int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "Bearer wrong", http.StatusUnauthorized},
+		{http.MethodGet, "secret", http.StatusUnauthorized},
+		{http.MethodPost, "Bearer secret", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/admin/bans", strings.NewReader(""))
+		request.Header.Set("Authorization", test.header)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%v with %q status is %v, expected %v", test.method, test.header, recorder.Code, test.status)
+		}
+	}
+
+	if admin, ok := api.authorize(&http.Request{Header: http.Header{"Authorization": {"Bearer secret"}}}); !ok || admin != "alice" {
+		t.Errorf("authorize is %v, %v, expected %v, %v", admin, ok, "alice", true)
+	}
+
+	// without tokens the admin API is not served at all
+	disabled := http.NewServeMux()
+	newAdminAPI(nil, nil, nil, nil).register(disabled)
+	recorder := httptest.NewRecorder()
+	disabled.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/bans", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Disabled admin API status is %v, expected %v", recorder.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The audit log is off unless AUDIT_LOG names a file, rotated files are never
+// deleted so it is left to servers with storage to keep them
+const DefaultAuditLog = ""
+const DefaultAuditMaxBytes = int64(64 << 20)
+const DefaultAuditRotateDaily = true
+
+// Events queued for the writer before new events are dropped, recording
+// never blocks the goroutine the event happened on
+const auditQueueSize = 4096
+
+// How long the log keeps writing to the current file after a failed rotation
+// before trying again
+const auditRotateRetry = time.Minute
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time    time.Time              `json:"time"`
+	Event   string                 `json:"event"`
+	Conn    uint64                 `json:"conn,omitempty"`
+	Remote  string                 `json:"remote,omitempty"`
+	Session string                 `json:"session,omitempty"`
+	Admin   string                 `json:"admin,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditConfig controls where the audit log is written and when it rotates
+type AuditConfig struct {
+	// Path of the current log, rotated files are named after it with the
+	// time they were rotated, empty for no log
+	Path string
+
+	// MaxBytes rotates the log before it grows past this size, 0 for never
+	MaxBytes int64
+
+	// Daily rotates the log on the first event of a new UTC day
+	Daily bool
+}
+
+// AuditLog appends events as JSON lines from a single writer goroutine, a
+// nil AuditLog records nothing
+type AuditLog struct {
+	config  AuditConfig
+	events  chan AuditEvent
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	// closed is set by Close under mu so producers still running at
+	// shutdown never send on the closed events channel
+	mu     sync.RWMutex
+	closed bool
+
+	// only used by the writer goroutine
+	file        *os.File
+	writer      *bufio.Writer
+	size        int64
+	day         string
+	rotateAfter time.Time
+	errorLog    *rateLimiter
+}
+
+// OpenAuditLog opens or creates the log at config.Path and starts its writer
+func OpenAuditLog(config AuditConfig) (*AuditLog, error) {
+	audit := &AuditLog{
+		config:   config,
+		events:   make(chan AuditEvent, auditQueueSize),
+		done:     make(chan struct{}),
+		errorLog: newRateLimiter(hotLogInterval, hotLogBurst),
+	}
+
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+
+	go audit.run()
+	return audit, nil
+}
+
+// Record queues an event, dropping it when the writer has fallen behind or
+// the log has been closed
+func (audit *AuditLog) Record(event AuditEvent) {
+	if audit == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	audit.mu.RLock()
+	defer audit.mu.RUnlock()
+	if audit.closed {
+		return
+	}
+
+	select {
+	case audit.events <- event:
+	default:
+		audit.dropped.Add(1)
+	}
+}
+
+// record queues an event about a client, args are key value pairs in the
+// same form as slog attributes
+func (audit *AuditLog) record(event string, client *Client, args ...any) {
+	if audit == nil {
+		return
+	}
+
+	entry := AuditEvent{Event: event, Details: auditDetails(args)}
+	if client != nil {
+		entry.Conn = client.id
+		entry.Remote = client.remote
+		entry.Session = client.session
+	}
+	audit.Record(entry)
+}
+
+func auditDetails(args []any) map[string]interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+
+	details := make(map[string]interface{}, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		details[fmt.Sprint(args[i])] = args[i+1]
+	}
+	return details
+}
+
+// Close writes every queued event and closes the file, events recorded
+// afterwards are dropped
+func (audit *AuditLog) Close() {
+	if audit == nil {
+		return
+	}
+
+	audit.mu.Lock()
+	if !audit.closed {
+		audit.closed = true
+		close(audit.events)
+	}
+	audit.mu.Unlock()
+	<-audit.done
+}
+
+func (audit *AuditLog) open() error {
+	file, info, err := openAuditFile(audit.config.Path)
+	if err != nil {
+		return err
+	}
+
+	audit.file = file
+	audit.writer = bufio.NewWriter(file)
+	audit.size = info.Size()
+	audit.day = info.ModTime().UTC().Format(time.DateOnly)
+	return nil
+}
+
+func openAuditFile(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// rotatedPath names a rotated log after the current one and the time it was
+// rotated, audit.jsonl becomes audit-2006-01-02T15-04-05.000.jsonl with a
+// counter added when several rotations happen within a millisecond
+func (audit *AuditLog) rotatedPath(now time.Time) string {
+	ext := filepath.Ext(audit.config.Path)
+	base := strings.TrimSuffix(audit.config.Path, ext) + "-" + now.UTC().Format("2006-01-02T15-04-05.000")
+	path := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = fmt.Sprintf("%v-%v%v", base, i, ext)
+	}
+}
+
+// rotate moves the current log aside and starts a new one. The current file
+// stays open until the new one is, so a failed rotation keeps writing to it.
+func (audit *AuditLog) rotate(now time.Time) error {
+	if err := audit.writer.Flush(); err != nil {
+		return err
+	}
+
+	rotated := audit.rotatedPath(now)
+	if err := os.Rename(audit.config.Path, rotated); err != nil {
+		return err
+	}
+
+	file, info, err := openAuditFile(audit.config.Path)
+	if err != nil {
+		// the open file moved with the rename, put it back where it was
+		if renameErr := os.Rename(rotated, audit.config.Path); renameErr != nil {
+			return errors.Join(err, renameErr)
+		}
+		return err
+	}
+
+	if err := audit.file.Close(); err != nil {
+		audit.errorLog.log(slog.Default(), slog.LevelError, "Error closing rotated audit log", "path", rotated, "err", err)
+	}
+
+	audit.file = file
+	audit.writer.Reset(file)
+	audit.size = info.Size()
+	audit.day = info.ModTime().UTC().Format(time.DateOnly)
+	return nil
+}
+
+// shouldRotate reports whether the log must rotate before writing size bytes
+func (audit *AuditLog) shouldRotate(size int, now time.Time) bool {
+	if audit.size == 0 || now.Before(audit.rotateAfter) {
+		return false
+	}
+
+	if audit.config.MaxBytes > 0 && audit.size+int64(size) > audit.config.MaxBytes {
+		return true
+	}
+	return audit.config.Daily && now.UTC().Format(time.DateOnly) != audit.day
+}
+
+func (audit *AuditLog) write(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		audit.errorLog.log(slog.Default(), slog.LevelError, "Error encoding audit event", "event", event.Event, "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if audit.shouldRotate(len(line), event.Time) {
+		if err := audit.rotate(event.Time); err != nil {
+			audit.rotateAfter = event.Time.Add(auditRotateRetry)
+			audit.errorLog.log(slog.Default(), slog.LevelError, "Error rotating audit log, writing to the current file", "path", audit.config.Path, "retry", auditRotateRetry, "err", err)
+		}
+	}
+
+	if _, err := audit.writer.Write(line); err != nil {
+		audit.errorLog.log(slog.Default(), slog.LevelError, "Error writing audit log", "path", audit.config.Path, "err", err)
+		return
+	}
+	audit.size += int64(len(line))
+	audit.day = event.Time.UTC().Format(time.DateOnly)
+}
+
+func (audit *AuditLog) run() {
+	defer close(audit.done)
+	defer func() { audit.file.Close() }()
+
+	for event := range audit.events {
+		if dropped := audit.dropped.Swap(0); dropped > 0 {
+			audit.write(AuditEvent{Time: event.Time, Event: "audit_dropped", Details: map[string]interface{}{"events": dropped}})
+		}
+		audit.write(event)
+
+		// batch writes while events are queued, flush once the queue is empty
+		if len(audit.events) == 0 {
+			if err := audit.writer.Flush(); err != nil {
+				audit.errorLog.log(slog.Default(), slog.LevelError, "Error writing audit log", "path", audit.config.Path, "err", err)
+			}
+		}
+	}
+
+	if err := audit.writer.Flush(); err != nil {
+		slog.Error("Error writing audit log", "path", audit.config.Path, "err", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/gorilla/websocket"
+)
+
+func readAuditEvents(t *testing.T, path string) []AuditEvent {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+	defer file.Close()
+
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Error unmarshalling audit line %q %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(AuditConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	client := newClient(nil, nil, "10.0.0.1:4000")
+	client.session = "abc"
+	audit.record("connect", client, "spectator", false)
+	audit.Record(AuditEvent{Event: "admin_kick", Admin: "alice"})
+	audit.Close()
+
+	events := readAuditEvents(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Audit log has %v events, expected %v", len(events), 2)
+	}
+
+	connect := events[0]
+	if connect.Event != "connect" || connect.Conn != client.id || connect.Remote != "10.0.0.1:4000" || connect.Session != "abc" || connect.Details["spectator"] != false {
+		t.Errorf("Connect event is %v, expected the client's connection", connect)
+	}
+
+	if events[1].Admin != "alice" || events[1].Time.IsZero() {
+		t.Errorf("Admin event is %v, expected alice with a time", events[1])
+	}
+}
+
+func TestAuditLogRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := OpenAuditLog(AuditConfig{Path: path, MaxBytes: 300})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		audit.Record(AuditEvent{Event: "chat", Conn: uint64(i + 1), Details: map[string]interface{}{"text": "hello there"}})
+	}
+	audit.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "audit*.jsonl"))
+	if len(files) < 3 {
+		t.Fatalf("Audit log rotated into %v files, expected at least %v", len(files), 3)
+	}
+
+	total := 0
+	for _, file := range files {
+		info, _ := os.Stat(file)
+		if info.Size() > 300 {
+			t.Errorf("Audit file %v is %v bytes, expected at most %v", file, info.Size(), 300)
+		}
+		total += len(readAuditEvents(t, file))
+	}
+
+	if total != 10 {
+		t.Errorf("Audit files hold %v events, expected %v", total, 10)
+	}
+}
+
+func TestAuditLogRotateDaily(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := OpenAuditLog(AuditConfig{Path: path, Daily: true})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	now := time.Now()
+	audit.Record(AuditEvent{Time: now, Event: "connect"})
+	audit.Record(AuditEvent{Time: now.Add(time.Minute), Event: "chat"})
+	audit.Record(AuditEvent{Time: now.Add(24 * time.Hour), Event: "disconnect"})
+	audit.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "audit*.jsonl"))
+	if len(files) != 2 {
+		t.Fatalf("Audit log rotated into %v files, expected %v", len(files), 2)
+	}
+
+	if events := readAuditEvents(t, path); len(events) != 1 || events[0].Event != "disconnect" {
+		t.Errorf("Current audit file has %v, expected only the next day's event", events)
+	}
+}
+
+func TestAuditLogNeverBlocks(t *testing.T) {
+	// no writer is running so the queue fills up
+	audit := &AuditLog{events: make(chan AuditEvent, 1)}
+	audit.Record(AuditEvent{Event: "connect"})
+	audit.Record(AuditEvent{Event: "chat"})
+
+	if dropped := audit.dropped.Load(); dropped != 1 {
+		t.Errorf("Audit log dropped %v events, expected %v", dropped, 1)
+	}
+
+	var disabled *AuditLog
+	disabled.record("connect", nil)
+	disabled.Close()
+}
+
+func TestAuditLogRecordAfterClose(t *testing.T) {
+	audit, err := OpenAuditLog(AuditConfig{Path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	audit.Close()
+	audit.Record(AuditEvent{Event: "disconnect"})
+	audit.Close()
+}
+
+func TestAuditLogRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := OpenAuditLog(AuditConfig{Path: path, Daily: true})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	now := time.Now()
+	audit.Record(AuditEvent{Time: now, Event: "connect"})
+
+	// the open file can only be reached through the link so rotating fails
+	kept := filepath.Join(dir, "kept.log")
+	if err := os.Link(path, kept); err != nil {
+		t.Fatalf("Error linking audit log %v", err)
+	}
+	os.Remove(path)
+
+	audit.Record(AuditEvent{Time: now.Add(24 * time.Hour), Event: "chat"})
+	audit.Record(AuditEvent{Time: now.Add(24*time.Hour + time.Second), Event: "disconnect"})
+	audit.Close()
+
+	if events := readAuditEvents(t, kept); len(events) != 3 || events[2].Event != "disconnect" {
+		t.Errorf("Audit file after a failed rotation has %v, expected every event", events)
+	}
+}
+
+func TestAuditPlayerActions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(AuditConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Error opening audit log %v", err)
+	}
+
+	state := sim.CreateEmptySimulationState(4, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.audit = audit
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.BinaryMessage, data: packBody(t, sim.BodyData{P: mgl32.Vec2{1, 0}, R: 1})}})
+	go handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.BinaryMessage, data: packBody(t, sim.BodyData{P: mgl32.Vec2{1000, 0}, R: 1})}})
+	nextReply(t, client, MessageTypeError)
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"chat","text":"hi"}`)}})
+	hub.unregister <- client
+	hub.register <- newClient(hub, nil, "sync")
+	audit.Close()
+
+	events := readAuditEvents(t, path)
+	expected := []string{"spawn", "rejected", "chat", "disconnect"}
+	if len(events) != len(expected) {
+		t.Fatalf("Audit events are %v, expected %v", events, expected)
+	}
+
+	for i, event := range events {
+		if event.Event != expected[i] || event.Conn != client.id {
+			t.Errorf("Audit event %v is %v for %v, expected %v for %v", i, event.Event, event.Conn, expected[i], client.id)
+		}
+	}
+
+	if events[0].Details["body"] != float64(state.Bodies[0].I) {
+		t.Errorf("Spawn event body is %v, expected %v", events[0].Details["body"], state.Bodies[0].I)
+	}
+
+	if events[1].Details["code"] != "out_of_area" {
+		t.Errorf("Rejected event code is %v, expected %v", events[1].Details["code"], "out_of_area")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+const DefaultClientBytesPerSecond = int64(0)
+
+// MinClientBytesPerSecond is the smallest bandwidth budget, it always fits a
+// partial frame of at least one body so no client is starved of frames.
+// Legacy clients are sent whole frames on credit instead, see budgetFrame.
+const MinClientBytesPerSecond = int64(1024)
+
+// validBandwidth reports whether a bandwidth budget may be used, 0 is the
+// server default
+func validBandwidth(bytesPerSecond int64) bool {
+	return bytesPerSecond == 0 || bytesPerSecond >= MinClientBytesPerSecond
+}
+
+// Burst allowance of the bandwidth budget, in seconds of the client's rate
+const bandwidthBurst = 0.5
+
+// Weights used to rank bodies when a frame has to be cut down to fit a
+// client's bandwidth budget
+const (
+	prioritySizeWeight      = 1.0
+	priorityProximityWeight = 4.0
+	priorityStaleWeight     = 2.0
+
+	// ticks of staleness that count as one unit of priority
+	priorityStaleTicks = 60.0
+)
+
+// bandwidthBudget is a per client token bucket of bytes, along with the last
+// tick each body was sent so skipped bodies rise in priority over time. It is
+// only used from the hub goroutine.
+type bandwidthBudget struct {
+	tokens float64
+	last   time.Time
+
+	// tick of the last complete frame and of bodies sent in partial frames since
+	fullAt uint64
+	sentAt map[uint16]uint64
+}
+
+func newBandwidthBudget() *bandwidthBudget {
+	return &bandwidthBudget{sentAt: make(map[uint16]uint64)}
+}
+
+// refill adds the bytes earned since the last refill at rate bytes per second
+func (budget *bandwidthBudget) refill(now time.Time, rate int64) {
+	capacity := float64(rate) * bandwidthBurst
+	if budget.last.IsZero() {
+		budget.tokens = capacity
+	} else {
+		budget.tokens = math.Min(capacity, budget.tokens+float64(rate)*now.Sub(budget.last).Seconds())
+	}
+	budget.last = now
+}
+
+// lastSent returns the tick a body was last sent to the client
+func (budget *bandwidthBudget) lastSent(id uint16) uint64 {
+	if sent, ok := budget.sentAt[id]; ok && sent > budget.fullAt {
+		return sent
+	}
+	return budget.fullAt
+}
+
+// sentFull records that every body was sent at tick
+func (budget *bandwidthBudget) sentFull(tick uint64, size int) {
+	budget.tokens -= float64(size)
+	budget.fullAt = tick
+	for id := range budget.sentAt {
+		delete(budget.sentAt, id)
+	}
+}
+
+// prune forgets bodies that are no longer in the simulation
+func (budget *bandwidthBudget) prune(snapshot *Snapshot) {
+	live := make(map[uint16]bool, len(snapshot.Bodies))
+	for i := range snapshot.Bodies {
+		live[snapshot.Bodies[i].I] = true
+	}
+
+	for id := range budget.sentAt {
+		if !live[id] {
+			delete(budget.sentAt, id)
+		}
+	}
+}
+
+// effectiveRate combines the rate a client asked for with the server limit,
+// 0 means unlimited
+func effectiveRate(requested int64, limit int64) int64 {
+	if requested > 0 && (limit <= 0 || requested < limit) {
+		return requested
+	}
+	return limit
+}
+
+// bodyPriority ranks a body for a client, larger bodies, bodies close to
+// the centre of the viewport and bodies not sent for a while come first
+func bodyPriority(body *sim.BodyData, view *Viewport, staleTicks uint64) float64 {
+	priority := prioritySizeWeight * float64(body.R)
+	if view != nil {
+		diagonal := math.Hypot(float64(view.W), float64(view.H))
+		distance := math.Hypot(float64(body.P.X()-view.X), float64(body.P.Y()-view.Y))
+		priority += priorityProximityWeight / (1 + distance/math.Max(diagonal, 1))
+	}
+	priority += priorityStaleWeight * float64(staleTicks) / priorityStaleTicks
+	return priority
+}
+
+// budgetFrame returns the frame to send a client within its bandwidth budget,
+// the shared frame when it fits, a frame of the highest priority bodies that
+// fit when it does not, or nil when not even one body fits. Formats without
+// partial frames are sent the whole frame whenever the budget is not in debt,
+// and then skip frames until it recovers, so they are never starved.
+func budgetFrame(cache *frameCache, view *Viewport, format frameFormat, budget *bandwidthBudget, rate int64, now time.Time) ([]byte, error) {
+	frame, err := cache.frameFor(view, format)
+	if err != nil || rate <= 0 {
+		return frame, err
+	}
+
+	budget.refill(now, rate)
+	snapshot := cache.snapshot
+	if float64(len(frame)) <= budget.tokens {
+		budget.sentFull(snapshot.Tick, len(frame))
+		return frame, nil
+	}
+
+	// clients that drop bodies missing from a frame can not be sent part of
+	// it, the budget goes into debt instead and recovers at the client's rate
+	if !format.partialFrames() {
+		if budget.tokens <= 0 {
+			return nil, nil
+		}
+		budget.sentFull(snapshot.Tick, len(frame))
+		return frame, nil
+	}
+
+	key := cache.config.key(view)
+	candidates := make([]int, 0, len(snapshot.Bodies))
+	priorities := make([]float64, len(snapshot.Bodies))
+	for i := range snapshot.Bodies {
+		body := &snapshot.Bodies[i]
+		if snapshot.packed[i] == nil || !cache.config.includes(key, body) {
+			continue
+		}
+
+		stale := uint64(0)
+		if sent := budget.lastSent(body.I); sent < snapshot.Tick {
+			stale = snapshot.Tick - sent
+		}
+
+		candidates = append(candidates, i)
+		priorities[i] = bodyPriority(body, view, stale)
+	}
+
+	slots := format.slots(int(budget.tokens), frame, len(candidates))
+	if slots <= 0 {
+		return nil, nil
+	}
+
+	if slots > len(candidates) {
+		slots = len(candidates)
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return priorities[candidates[a]] > priorities[candidates[b]]
+	})
+
+	if len(budget.sentAt) > 2*len(snapshot.Bodies)+16 {
+		budget.prune(snapshot)
+	}
+
+	selected := make(map[uint16]bool, slots)
+	for _, i := range candidates[:slots] {
+		selected[snapshot.Bodies[i].I] = true
+		budget.sentAt[snapshot.Bodies[i].I] = snapshot.Tick
+	}
+
+	frame, err = encodeFrame(snapshot, cache.audience, key.flags()|FrameFlagPartial, format, func(body *sim.BodyData) bool {
+		return selected[body.I]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	budget.tokens -= float64(len(frame))
+	return frame, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func createBandwidthSnapshot(tick uint64) *Snapshot {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 1, 10, 1000, 1)
+	state.Bodies = append(state.Bodies,
+		sim.BodyData{I: 0, P: mgl32.Vec2{40, 0}, R: 0.5},
+		sim.BodyData{I: 1, P: mgl32.Vec2{1, 0}, R: 0.5},
+		sim.BodyData{I: 2, P: mgl32.Vec2{-40, 0}, R: 2},
+		sim.BodyData{I: 3, P: mgl32.Vec2{0, 40}, R: 0.5},
+	)
+	state.RecordTick(tick, time.Now())
+	return takeSnapshot(state)
+}
+
+func TestBandwidthFullFrame(t *testing.T) {
+	cache := newFrameCache(createBandwidthSnapshot(1), Audience{Players: 1}, DefaultAOIConfig())
+	budget := newBandwidthBudget()
+
+	// half a second of 1000 bytes per second fits the 122 byte frame
+	frame, err := budgetFrame(cache, nil, formatBinary, budget, 1000, time.Now())
+	if err != nil {
+		t.Fatalf("Error building budget frame %v", err)
+	}
+
+	if ids := readFrameIDs(t, frame); len(ids) != 4 {
+		t.Errorf("Budget frame has %v bodies, expected %v", len(ids), 4)
+	}
+
+	if frame[1]&FrameFlagPartial != 0 {
+		t.Errorf("Full budget frame flags are %v, expected no partial flag", frame[1])
+	}
+
+	if budget.tokens != float64(500-len(frame)) {
+		t.Errorf("Budget tokens are %v, expected %v", budget.tokens, 500-len(frame))
+	}
+}
+
+func TestBandwidthPriority(t *testing.T) {
+	budget := newBandwidthBudget()
+	view := &Viewport{X: 0, Y: 0, W: 200, H: 200, Zoom: 1}
+	now := time.Now()
+
+	// room for the header and two bodies per frame
+	rate := int64((FrameHeaderBytes + 2*sim.BodyPacketBytes) * 2)
+	counts := make(map[uint16]int)
+
+	for tick := uint64(1); tick <= 8; tick++ {
+		cache := newFrameCache(createBandwidthSnapshot(tick*10), Audience{Players: 1}, DefaultAOIConfig())
+		budget.tokens = 0
+		frame, err := budgetFrame(cache, view, formatBinary, budget, rate, now.Add(time.Duration(tick)*time.Second))
+		if err != nil {
+			t.Fatalf("Error building budget frame %v", err)
+		}
+
+		if frame[1]&FrameFlagPartial == 0 {
+			t.Fatalf("Budget frame flags are %v, expected the partial flag", frame[1])
+		}
+
+		ids := readFrameIDs(t, frame)
+		if len(ids) != 2 {
+			t.Fatalf("Budget frame has %v bodies, expected %v", len(ids), 2)
+		}
+
+		if tick == 1 && (ids[0] != 1 || ids[1] != 2) {
+			t.Errorf("First budget frame has bodies %v, expected the near and large bodies %v", ids, []uint16{1, 2})
+		}
+
+		for _, id := range ids {
+			counts[id]++
+		}
+	}
+
+	// low priority bodies are sent less often but never starve
+	for id := uint16(0); id < 4; id++ {
+		if counts[id] == 0 {
+			t.Errorf("Body %v was never sent", id)
+		}
+	}
+
+	if counts[1] <= counts[0] {
+		t.Errorf("Near body was sent %v times, expected more than the far body's %v", counts[1], counts[0])
+	}
+}
+
+func TestBandwidthSkipsFrame(t *testing.T) {
+	cache := newFrameCache(createBandwidthSnapshot(1), Audience{Players: 1}, DefaultAOIConfig())
+	budget := newBandwidthBudget()
+
+	frame, err := budgetFrame(cache, nil, formatBinary, budget, FrameHeaderBytes, time.Now())
+	if err != nil {
+		t.Fatalf("Error building budget frame %v", err)
+	}
+
+	if frame != nil {
+		t.Errorf("Budget frame is %v bytes, expected nil", len(frame))
+	}
+}
+
+func TestBandwidthLegacyFrame(t *testing.T) {
+	cache := newFrameCache(createBandwidthSnapshot(1), Audience{Players: 1}, DefaultAOIConfig())
+	budget := newBandwidthBudget()
+	now := time.Now()
+
+	// legacy clients drop bodies missing from a frame so they are sent the
+	// whole frame on credit rather than part of it
+	rate := int64((LegacyFrameHeaderBytes + 2*sim.BodyPacketBytes) * 2)
+	frame, err := budgetFrame(cache, nil, formatLegacy, budget, rate, now)
+	if err != nil {
+		t.Fatalf("Error building budget frame %v", err)
+	}
+
+	if len(frame) != LegacyFrameHeaderBytes+4*sim.BodyPacketBytes || budget.tokens >= 0 {
+		t.Errorf("Legacy budget frame is %v bytes leaving %v tokens, expected the whole frame and debt", len(frame), budget.tokens)
+	}
+
+	// the debt is paid off before the next frame
+	if frame, _ = budgetFrame(cache, nil, formatLegacy, budget, rate, now.Add(100*time.Millisecond)); frame != nil {
+		t.Errorf("Legacy budget frame in debt is %v bytes, expected nil", len(frame))
+	}
+}
+
+func TestBandwidthLegacyNotStarved(t *testing.T) {
+	// a full frame is larger than the whole burst of the client's rate
+	cache := newFrameCache(createBandwidthSnapshot(1), Audience{Players: 1}, DefaultAOIConfig())
+	full, _ := cache.frameFor(nil, formatLegacy)
+	rate := int64(len(full))
+
+	budget := newBandwidthBudget()
+	now := time.Now()
+	sent := 0
+	for i := 0; i < 100; i++ {
+		cache := newFrameCache(createBandwidthSnapshot(uint64(i)), Audience{Players: 1}, DefaultAOIConfig())
+		now = now.Add(100 * time.Millisecond)
+		frame, err := budgetFrame(cache, nil, formatLegacy, budget, rate, now)
+		if err != nil {
+			t.Fatalf("Error building budget frame %v", err)
+		}
+		if frame != nil {
+			sent++
+		}
+	}
+
+	// ten seconds at a frame's worth of bytes per second
+	if sent < 9 || sent > 11 {
+		t.Errorf("Sent %v legacy frames in ten seconds, expected about %v", sent, 10)
+	}
+}
+
+func TestBandwidthMinimum(t *testing.T) {
+	if validBandwidth(MinClientBytesPerSecond-1) || !validBandwidth(0) || !validBandwidth(MinClientBytesPerSecond) {
+		t.Errorf("Bandwidth %v is valid, expected only 0 and at least %v", MinClientBytesPerSecond-1, MinClientBytesPerSecond)
+	}
+
+	// the smallest budget always fits a frame after the burst is spent
+	for _, format := range []frameFormat{formatBinary, formatJSON, formatLegacy} {
+		budget := newBandwidthBudget()
+		now := time.Now()
+		for i := 0; i < 10; i++ {
+			cache := newFrameCache(createBandwidthSnapshot(uint64(i)), Audience{Players: 1}, DefaultAOIConfig())
+			now = now.Add(time.Second)
+			frame, err := budgetFrame(cache, nil, format, budget, MinClientBytesPerSecond, now)
+			if err != nil {
+				t.Fatalf("Error building budget frame %v", err)
+			}
+
+			if frame == nil {
+				t.Fatalf("Budget frame %v at the minimum bandwidth is nil, expected a frame", i)
+			}
+		}
+	}
+}
+
+func TestEffectiveRate(t *testing.T) {
+	tests := []struct {
+		requested, limit, expected int64
+	}{
+		{0, 0, 0},
+		{0, 1000, 1000},
+		{500, 1000, 500},
+		{5000, 1000, 1000},
+		{500, 0, 500},
+	}
+
+	for _, test := range tests {
+		if rate := effectiveRate(test.requested, test.limit); rate != test.expected {
+			t.Errorf("effectiveRate(%v, %v) is %v, expected %v", test.requested, test.limit, rate, test.expected)
+		}
+	}
+}
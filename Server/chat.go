@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const DefaultChatMaxLength = int64(200)
+const DefaultChatHistory = int64(20)
+
+// MaxChatHistory keeps the history sent to new joiners well within their
+// send queue so the messages that follow it still fit
+const MaxChatHistory = sendBufferSize / 2
+
+const (
+	// Interval and burst of chat messages allowed per player.
+	chatInterval = 10 * time.Second
+	chatBurst    = 5
+)
+
+// ChatConfig controls the chat relayed by the hub
+type ChatConfig struct {
+	// MaxLength is the longest chat message in characters
+	MaxLength int
+
+	// HistorySize is the number of recent messages sent to new joiners
+	HistorySize int
+
+	// Filter cleans or rejects messages before they are relayed, nil for none
+	Filter ChatFilter
+}
+
+func DefaultChatConfig() ChatConfig {
+	return ChatConfig{
+		MaxLength:   int(DefaultChatMaxLength),
+		HistorySize: int(DefaultChatHistory),
+	}
+}
+
+// ChatFilter is a moderation hook run on every chat message, it returns the
+// text to relay or false to drop the message
+type ChatFilter interface {
+	Filter(text string) (string, bool)
+}
+
+// WordListFilter masks blocked words with asterisks, matching whole words
+// without regard to case
+type WordListFilter struct {
+	words map[string]bool
+}
+
+func NewWordListFilter(words []string) *WordListFilter {
+	filter := &WordListFilter{words: make(map[string]bool, len(words))}
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); len(word) > 0 {
+			filter.words[word] = true
+		}
+	}
+	return filter
+}
+
+// LoadWordListFilter reads a word list with one word per line, lines starting
+// with # are ignored
+func LoadWordListFilter(path string) (*WordListFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return NewWordListFilter(words), scanner.Err()
+}
+
+func (filter *WordListFilter) Filter(text string) (string, bool) {
+	var builder strings.Builder
+	builder.Grow(len(text))
+
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for len(text) > 0 {
+		end := strings.IndexFunc(text, func(r rune) bool { return !isWord(r) })
+		if end == 0 {
+			r, size := utf8.DecodeRuneInString(text)
+			builder.WriteRune(r)
+			text = text[size:]
+			continue
+		}
+
+		if end < 0 {
+			end = len(text)
+		}
+
+		word := text[:end]
+		if filter.words[strings.ToLower(word)] {
+			builder.WriteString(strings.Repeat("*", utf8.RuneCountInString(word)))
+		} else {
+			builder.WriteString(word)
+		}
+		text = text[end:]
+	}
+
+	return builder.String(), true
+}
+
+// clean strips control characters from a chat message and checks it against
+// the config, returning an error code and reason when it can not be relayed
+func (config ChatConfig) clean(text string) (string, string, string) {
+	text = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+
+	if len(text) == 0 {
+		return "", "chat_empty", "chat message is empty"
+	}
+
+	if utf8.RuneCountInString(text) > config.MaxLength {
+		return "", "chat_too_long", "chat message is longer than the maximum length"
+	}
+
+	if config.Filter != nil {
+		filtered, ok := config.Filter.Filter(text)
+		if !ok {
+			return "", "chat_rejected", "chat message was rejected by the filter"
+		}
+		text = filtered
+	}
+
+	return text, "", ""
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+func TestWordListFilter(t *testing.T) {
+	filter := NewWordListFilter([]string{"darn", " Heck "})
+
+	tests := []struct {
+		text, expected string
+	}{
+		{"hello there", "hello there"},
+		{"darn it", "**** it"},
+		{"HECK, what the heck!", "****, what the ****!"},
+		{"darned", "darned"},
+		{"héck darn", "héck ****"},
+	}
+
+	for _, test := range tests {
+		if text, ok := filter.Filter(test.text); !ok || text != test.expected {
+			t.Errorf("Filter(%q) is %q, %v, expected %q, %v", test.text, text, ok, test.expected, true)
+		}
+	}
+}
+
+func TestLoadWordListFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("# blocked words\ndarn\n\nheck\n"), 0644); err != nil {
+		t.Fatalf("Error writing word list %v", err)
+	}
+
+	filter, err := LoadWordListFilter(path)
+	if err != nil {
+		t.Fatalf("Error loading word list %v", err)
+	}
+
+	if len(filter.words) != 2 {
+		t.Errorf("Word list has %v words, expected %v", len(filter.words), 2)
+	}
+}
+
+// rejectFilter drops every message containing "spam"
+type rejectFilter struct{}
+
+func (rejectFilter) Filter(text string) (string, bool) {
+	return text, !strings.Contains(text, "spam")
+}
+
+func TestChatClean(t *testing.T) {
+	config := ChatConfig{MaxLength: 5, Filter: rejectFilter{}}
+
+	tests := []struct {
+		text, expected, code string
+	}{
+		{"  hi\n ", "hi", ""},
+		{"h\x00i", "hi", ""},
+		{"   ", "", "chat_empty"},
+		{"toolong", "", "chat_too_long"},
+		{"héllo", "héllo", ""},
+		{"spam", "", "chat_rejected"},
+	}
+
+	for _, test := range tests {
+		text, code, _ := config.clean(test.text)
+		if text != test.expected || code != test.code {
+			t.Errorf("clean(%q) is %q, %q, expected %q, %q", test.text, text, code, test.expected, test.code)
+		}
+	}
+}
+
+func readChat(t *testing.T, client *Client) ChatMessage {
+	chat := ChatMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeChat).data, &chat); err != nil {
+		t.Fatalf("Error unmarshalling chat message %v", err)
+	}
+	return chat
+}
+
+func TestHubChat(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.chatConfig.HistorySize = 2
+	hub.chatConfig.Filter = NewWordListFilter([]string{"darn"})
+	go hub.run()
+
+	first := newClient(hub, nil, "first")
+	hub.register <- first
+	if chat := readChat(t, first); !chat.System || chat.Text != fmt.Sprintf("player %v joined", first.id) {
+		t.Errorf("Join message is %v, expected a system message for player %v", chat, first.id)
+	}
+
+	handleControlMessage(state, hub, &ClientMessage{client: first, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"chat","text":"darn hello"}`)}})
+	if chat := readChat(t, first); chat.System || chat.From != first.id || chat.Text != "**** hello" {
+		t.Errorf("Chat message is %v, expected %q from %v", chat, "**** hello", first.id)
+	}
+
+	// new joiners receive the last two messages before their own join
+	second := newClient(hub, nil, "second")
+	hub.register <- second
+	history := []ChatMessage{readChat(t, second), readChat(t, second), readChat(t, second)}
+	if !history[0].System || history[1].Text != "**** hello" || history[2].Text != fmt.Sprintf("player %v joined", second.id) {
+		t.Errorf("Chat history is %v, expected the first join, the chat message and the second join", history)
+	}
+
+	spectator := newClient(hub, nil, "spectator")
+	spectator.spectator = true
+	hub.register <- spectator
+	hub.unregister <- second
+	if chat := readChat(t, first); !strings.HasSuffix(chat.Text, "joined") {
+		t.Errorf("Chat message is %v, expected the second join", chat)
+	}
+
+	// spectators come and go silently
+	if chat := readChat(t, first); chat.Text != fmt.Sprintf("player %v left", second.id) {
+		t.Errorf("Chat message is %v, expected the second player leaving", chat)
+	}
+}
+
+func TestHubHistoryLongerThanSendQueue(t *testing.T) {
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.chatConfig.HistorySize = sendBufferSize + 10
+	go hub.run()
+
+	for i := 0; i < hub.chatConfig.HistorySize; i++ {
+		hub.chat <- systemChat(fmt.Sprintf("message %v", i))
+	}
+
+	// joiners that can not take the history are dropped without a join message
+	spectator := newClient(hub, nil, "spectator")
+	spectator.spectator = true
+	hub.register <- spectator
+	player := newClient(hub, nil, "player")
+	hub.register <- player
+
+	if clients := hub.findClients(func(client *Client) bool { return true }); len(clients) != 0 {
+		t.Errorf("Hub has %v clients after dropping both joiners, expected none", len(clients))
+	}
+
+	for _, client := range []*Client{spectator, player} {
+		if reason := client.closeReason.Load(); reason == nil || reason.code != websocket.CloseTryAgainLater {
+			t.Errorf("Close of a client with a full queue is %v, expected code %v", reason, websocket.CloseTryAgainLater)
+		}
+	}
+}
+
+func TestChatLimits(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	message := &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"chat","text":"hello"}`)}}
+	for i := 0; i < chatBurst; i++ {
+		handleControlMessage(state, hub, message)
+	}
+
+	go handleControlMessage(state, hub, message)
+	reply := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &reply); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if reply.Code != "chat_rate_limited" {
+		t.Errorf("Reply code is %v, expected %v", reply.Code, "chat_rate_limited")
+	}
+
+	long := newClient(hub, nil, "long")
+	hub.register <- long
+	go handleControlMessage(state, hub, &ClientMessage{client: long, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"chat","text":"` + strings.Repeat("a", hub.chatConfig.MaxLength+1) + `"}`)}})
+	if err := json.Unmarshal(nextReply(t, long, MessageTypeError).data, &reply); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if reply.Code != "chat_too_long" {
+		t.Errorf("Reply code is %v, expected %v", reply.Code, "chat_too_long")
+	}
+}
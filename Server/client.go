@@ -6,9 +6,15 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -25,11 +31,40 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1024
+
+	// Interval and burst used to rate limit hot path log lines per client.
+	hotLogInterval = 10 * time.Second
+	hotLogBurst    = 5
+
+	// Longest close reason that fits in a control frame after the close code.
+	maxCloseText = 123
+
+	// Maximum number of queued control messages per client, a client that
+	// falls this far behind is disconnected since they are never dropped.
+	sendBufferSize = 256
 )
 
+// lastClientID is incremented for every accepted connection.
+var lastClientID uint64
+
+// sendTiers maps a client's requested send rate to the number of broadcast
+// frames per frame actually sent to it.
+var sendTiers = map[string]int32{
+	"high":   1,
+	"medium": 2,
+	"low":    4,
+}
+
+// sendTierOrder lists the send tiers from fastest to slowest, slow clients
+// are moved down it before being disconnected.
+var sendTierOrder = []string{"high", "medium", "low"}
+
+const defaultSendTier = "high"
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{SubprotocolBinary, SubprotocolJSON},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -42,8 +77,259 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Buffered channel of outbound control messages, these are never dropped.
+	send chan Message
+
+	// Latest frame waiting to be written, the hub replaces it with a newer
+	// frame instead of queueing frames behind a slow connection.
+	frame chan Message
+
+	// Close code and reason written by writePump once the hub closes send.
+	closeReason atomic.Pointer[closeReason]
+
+	// Frames replaced before they were written, decayed by frames that were
+	// not. Only used from the hub goroutine.
+	behind int
+
+	// Connection ID and remote address, attached to every log line through logger.
+	id     uint64
+	remote string
+	logger *slog.Logger
+
+	// Session the client identifies itself with across reconnects, empty when
+	// it did not send one. Used to enforce bans and mutes and to own bodies.
+	session string
+
+	// Name of the admin whose token the client connected with, empty for
+	// players. Admins have their own body quota.
+	admin string
+
+	// Spectators receive frames and may send control messages but can not
+	// change the simulation, they are counted apart from players.
+	spectator bool
+
+	// Encoding of the frames sent to the client, chosen by the negotiated
+	// subprotocol when the client connects. Clients without one get legacy
+	// frames and no text messages.
+	format frameFormat
+
+	// Send only every nth broadcast frame to this client, see sendTiers.
+	sendEvery atomic.Int32
+
+	// Area of the world the client is looking at, nil for every body.
+	viewport atomic.Pointer[Viewport]
+
+	// Bandwidth the client asked for in bytes per second, 0 for the server
+	// default, and the budget spent against it by the hub.
+	bytesPerSecond atomic.Int64
+	budget         *bandwidthBudget
+
+	// Rate limiters for log lines written on every frame or message.
+	dropLog   *rateLimiter
+	rejectLog *rateLimiter
+
+	// Rate limiters for chat, tool, grab and preview messages, only used from
+	// handleFrameIO.
+	chatLimit    *rateLimiter
+	toolLimit    *rateLimiter
+	grabLimit    *rateLimiter
+	previewLimit *rateLimiter
+
+	// Trajectory previews running for the client.
+	previews atomic.Int32
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, remote string) *Client {
+	id := atomic.AddUint64(&lastClientID, 1)
+	client := &Client{
+		hub:          hub,
+		conn:         conn,
+		send:         make(chan Message, sendBufferSize),
+		frame:        make(chan Message, 1),
+		id:           id,
+		remote:       remote,
+		logger:       slog.Default().With("conn", id, "remote", remote),
+		dropLog:      newRateLimiter(hotLogInterval, hotLogBurst),
+		rejectLog:    newRateLimiter(hotLogInterval, hotLogBurst),
+		chatLimit:    newRateLimiter(chatInterval, chatBurst),
+		toolLimit:    newRateLimiter(toolInterval, toolBurst),
+		grabLimit:    newRateLimiter(grabInterval, grabBurst),
+		previewLimit: newRateLimiter(previewInterval, previewBurst),
+		budget:       newBandwidthBudget(),
+	}
+	client.setSendTier(defaultSendTier)
+	return client
+}
+
+// setViewport filters the client's frames to the area it is looking at,
+// returning false for an invalid viewport.
+func (c *Client) setViewport(view Viewport) bool {
+	if view.W == 0 && view.H == 0 {
+		c.viewport.Store(nil)
+		return true
+	}
+
+	for _, value := range []float32{view.X, view.Y, view.W, view.H, view.Zoom} {
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return false
+		}
+	}
+
+	if view.W <= 0 || view.H <= 0 || view.Zoom < 0 {
+		return false
+	}
+
+	c.viewport.Store(&view)
+	return true
+}
+
+// setSendTier changes the send rate of the client, returning false for an
+// unknown tier.
+func (c *Client) setSendTier(tier string) bool {
+	every, ok := sendTiers[tier]
+	if !ok {
+		return false
+	}
+
+	c.sendEvery.Store(every)
+	c.logger.Debug("Client send tier changed", "tier", tier)
+	return true
+}
+
+// downgrade moves the client to the next slower send tier, returning false
+// when it is already on the slowest one.
+func (c *Client) downgrade() (string, bool) {
+	every := c.sendEvery.Load()
+	for _, tier := range sendTierOrder {
+		if sendTiers[tier] > every {
+			c.sendEvery.Store(sendTiers[tier])
+			return tier, true
+		}
+	}
+	return "", false
+}
+
+// closeReason is the close frame sent to a client disconnected by the server.
+type closeReason struct {
+	code int
+	text string
+}
+
+// closeWith sets the close frame and closes the send channel, it must only be
+// called by the hub goroutine once the client is removed.
+func (c *Client) closeWith(code int, text string) {
+	c.closeReason.Store(&closeReason{code: code, text: text})
+	close(c.send)
+}
+
+// writeClose writes the close frame chosen by the hub, if any.
+func (c *Client) writeClose() {
+	data := []byte{}
+	if reason := c.closeReason.Load(); reason != nil {
+		data = websocket.FormatCloseMessage(reason.code, truncateCloseText(reason.text))
+	}
+	c.conn.WriteMessage(websocket.CloseMessage, data)
+}
+
+// write sends a single message, compressing it when it is large enough
+func (c *Client) write(message Message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.EnableWriteCompression(c.hub.compression.compress(len(message.data)))
+	return c.conn.WriteMessage(message.kind, message.data)
+}
+
+// truncateCloseText shortens a close reason to fit in a control frame without
+// splitting a character.
+func truncateCloseText(text string) string {
+	if len(text) <= maxCloseText {
+		return text
+	}
+
+	end := maxCloseText
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end]
+}
+
+// muted reports whether the client's chat messages are refused at now, mutes
+// are kept by session and address so they outlast the connection.
+func (c *Client) muted(now time.Time) bool {
+	_, muted := c.hub.mutes.Check(remoteHost(c.remote), c.session, now)
+	return muted
+}
+
+// TrustedProxies are the load balancers allowed to tell the server the
+// address of a peer through X-Forwarded-For
+type TrustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR
+// ranges, an empty value trusts no proxy
+func parseTrustedProxies(value string) (TrustedProxies, error) {
+	proxies := TrustedProxies{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trusts reports whether addr, with or without a port, is a trusted proxy
+func (proxies TrustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(remoteHost(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the peer. X-Forwarded-For is only read
+// when the connection comes from a trusted proxy, and then from the right
+// since every entry left of the ones our proxies appended is up to the client.
+func (proxies TrustedProxies) remoteAddr(r *http.Request) string {
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 || !proxies.trusts(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+
+	entries := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if len(entry) == 0 {
+			break
+		}
+		if i == 0 || !proxies.trusts(entry) {
+			return entry
+		}
+	}
+	return r.RemoteAddr
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -60,16 +346,16 @@ func (c *Client) readPump() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.conn.ReadMessage()
+		kind, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v\n", err)
+				c.logger.Warn("Unexpected websocket close", "err", err)
 			}
 			break
 		}
 
 		if len(message) > 0 {
-			c.hub.incoming <- message
+			c.hub.incoming <- &ClientMessage{client: c, Message: Message{kind: kind, data: message}, at: serverTime()}
 		}
 	}
 }
@@ -88,28 +374,18 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.writeClose()
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
-
-			// fmt.Printf("Write message %v\n", message)
-			w.Write(message)
-
-			// dequeue/drop any other messages that would normally be sent
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				fmt.Printf("Dropping message: %v\n", <-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+		case message := <-c.frame:
+			if err := c.write(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -121,14 +397,88 @@ func (c *Client) writePump() {
 	}
 }
 
+// Connection modes selected with the mode query parameter of /ws.
+const (
+	modePlay     = "play"
+	modeSpectate = "spectate"
+)
+
+// isSpectateRequest reports whether a /ws request asks to spectate, and
+// false for an unknown mode.
+func isSpectateRequest(r *http.Request) (spectate bool, ok bool) {
+	switch r.URL.Query().Get("mode") {
+	case "", modePlay:
+		return false, true
+	case modeSpectate:
+		return true, true
+	}
+	return false, false
+}
+
+// atCapacity reports whether a new player or spectator must be turned away,
+// spectators have their own cap and never take a player's place.
+func atCapacity(audience Audience, spectate bool, maxClients int, maxSpectators int) bool {
+	if spectate {
+		return audience.Spectators >= maxSpectators
+	}
+	return audience.Players >= maxClients
+}
+
+// validSession reports whether a session sent by a client is usable, at most
+// 64 letters, digits, dashes or underscores.
+func validSession(session string) bool {
+	if len(session) > 64 {
+		return false
+	}
+
+	for _, r := range session {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	spectate, ok := isSpectateRequest(r)
+	if !ok {
+		http.Error(w, "unknown mode", http.StatusBadRequest)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		http.Error(w, "invalid session", http.StatusBadRequest)
+		return
+	}
+
+	remote := hub.proxies.remoteAddr(r)
+	upgrader := upgrader
+	upgrader.EnableCompression = hub.compression.Enabled
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		slog.Warn("Error upgrading connection", "remote", remote, "err", err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := newClient(hub, conn, remote)
+	client.spectator = spectate
+	client.session = session
+	client.admin, _ = matchAdminToken(hub.adminTokens, r)
+	client.format = subprotocolFormat(conn.Subprotocol())
+	hub.compression.apply(conn, client.logger)
+	if tier := r.URL.Query().Get("rate"); len(tier) > 0 && !client.setSendTier(tier) {
+		client.logger.Debug("Ignoring unknown send tier", "tier", tier)
+	}
+	if bandwidth, err := strconv.ParseInt(r.URL.Query().Get("bandwidth"), 10, 64); err == nil && bandwidth > 0 {
+		if validBandwidth(bandwidth) {
+			client.bytesPerSecond.Store(bandwidth)
+		} else {
+			client.logger.Debug("Ignoring bandwidth below the minimum", "bandwidth", bandwidth, "min", MinClientBytesPerSecond)
+		}
+	}
+	client.logger.Info("Client connected", "subprotocol", conn.Subprotocol(), "spectator", spectate, "admin", client.admin)
+	hub.audit.record("connect", client, "spectator", spectate, "subprotocol", conn.Subprotocol(), "admin", client.admin)
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/gorilla/websocket"
+)
+
+// createGalaxySnapshot builds a snapshot of count bodies orbiting the origin,
+// close to what a busy server sends
+func createGalaxySnapshot(count int) *Snapshot {
+	random := rand.New(rand.NewSource(1))
+	state := sim.CreateEmptySimulationState(count, 5, 3.75, 4, 10, 100, 1.15)
+	for i := 0; i < count; i++ {
+		angle := random.Float64() * 2 * math.Pi
+		distance := 5 + random.Float64()*90
+		speed := math.Sqrt(50 / distance)
+		body := sim.BodyData{
+			I: uint16(i),
+			P: mgl32.Vec2{float32(math.Cos(angle) * distance), float32(math.Sin(angle) * distance)},
+			V: mgl32.Vec2{float32(-math.Sin(angle) * speed), float32(math.Cos(angle) * speed)},
+			R: 0.25 + random.Float32()*2,
+			T: uint8(random.Intn(4)),
+		}
+		body.CleanBodyData(state.MassScale)
+		state.Bodies = append(state.Bodies, body)
+	}
+	return takeSnapshot(state)
+}
+
+// countingConn counts the bytes read from the network
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (conn countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.read.Add(int64(n))
+	return n, err
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	config := CompressionConfig{Enabled: true, Level: flate.BestSpeed, Threshold: 100}
+	if config.compress(99) || !config.compress(100) {
+		t.Errorf("compress(99), compress(100) are %v, %v, expected %v, %v", config.compress(99), config.compress(100), false, true)
+	}
+
+	config.Enabled = false
+	if config.compress(1000) {
+		t.Errorf("compress when disabled is %v, expected %v", true, false)
+	}
+
+	config.Level = 10
+	if config.validLevel() {
+		t.Errorf("validLevel(10) is %v, expected %v", true, false)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	hub.compression = CompressionConfig{Enabled: true, Level: flate.BestSpeed, Threshold: 512}
+	hub.chatConfig.HistorySize = 0
+	go hub.run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	snapshot := createGalaxySnapshot(512)
+	frame, err := newFrameCache(snapshot, Audience{Players: 1}, hub.aoi).frameFor(nil, formatBinary)
+	if err != nil {
+		t.Fatalf("Error encoding frame %v", err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		read := new(atomic.Int64)
+		dialer := websocket.Dialer{
+			Subprotocols:      []string{SubprotocolBinary},
+			EnableCompression: compress,
+			NetDial: func(network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				return countingConn{Conn: conn, read: read}, err
+			},
+		}
+
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Error dialing test server %v", err)
+		}
+
+		for hub.clientCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		readJoin(t, conn)
+		handshake := read.Load()
+		broadcast <- snapshot
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading frame %v", err)
+		}
+
+		if !bytes.Equal(data, frame) {
+			t.Errorf("Frame with compression %v does not match the encoded frame", compress)
+		}
+
+		wire := read.Load() - handshake
+		if compress && wire >= int64(len(frame)) {
+			t.Errorf("Compressed frame used %v bytes on the wire, expected fewer than %v", wire, len(frame))
+		}
+
+		if !compress && wire < int64(len(frame)) {
+			t.Errorf("Uncompressed frame used %v bytes on the wire, expected at least %v", wire, len(frame))
+		}
+
+		conn.Close()
+		for hub.clientCount() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// BenchmarkFrameCompression reports the compression ratio and CPU cost of
+// deflating 512 body frames, the same algorithm permessage-deflate uses
+func BenchmarkFrameCompression(b *testing.B) {
+	snapshot := createGalaxySnapshot(512)
+	formats := map[string]frameFormat{"binary": formatBinary, "json": formatJSON}
+
+	for name, format := range formats {
+		frame, err := newFrameCache(snapshot, Audience{Players: 1}, DefaultAOIConfig()).frameFor(nil, format)
+		if err != nil {
+			b.Fatalf("Error encoding frame %v", err)
+		}
+
+		for _, level := range []int{flate.HuffmanOnly, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+			b.Run(fmt.Sprintf("%v/level=%v", name, level), func(b *testing.B) {
+				buffer := new(bytes.Buffer)
+				writer, _ := flate.NewWriter(buffer, level)
+				b.SetBytes(int64(len(frame)))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					buffer.Reset()
+					writer.Reset(buffer)
+					writer.Write(frame)
+					writer.Flush()
+				}
+
+				b.ReportMetric(float64(len(frame)), "raw-bytes")
+				b.ReportMetric(float64(buffer.Len()), "wire-bytes")
+				b.ReportMetric(float64(len(frame))/float64(buffer.Len()), "ratio")
+			})
+		}
+	}
+}
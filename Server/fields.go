@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+// FieldRemoveRequest names the force field to remove
+type FieldRemoveRequest struct {
+	ID string `json:"id"`
+}
+
+// publishFields sends the current force fields to every client without
+// waiting for the hub, replacing fields it has not picked up yet. The caller
+// must hold the simulation lock, which keeps publishers in order.
+func publishFields(simState *sim.SimulationState, hub *Hub) {
+	select {
+	case <-hub.fields:
+	default:
+	}
+	hub.fields <- sim.ForceFieldConfigs(simState)
+}
+
+func (api *AdminAPI) listFields(admin string, r *http.Request) (interface{}, error) {
+	api.simState.Mu.Lock()
+	defer api.simState.Mu.Unlock()
+	return map[string][]sim.FieldConfig{"fields": sim.ForceFieldConfigs(api.simState)}, nil
+}
+
+// setField adds a force field or replaces the one with the same id
+func (api *AdminAPI) setField(admin string, r *http.Request) (interface{}, error) {
+	config := sim.FieldConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		return nil, &adminError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	field, err := sim.NewForceField(config)
+	if err != nil {
+		return nil, &adminError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	api.simState.Mu.Lock()
+	sim.SetForceField(api.simState, field)
+	publishFields(api.simState, api.hub)
+	api.simState.Mu.Unlock()
+
+	api.recordAction(admin, "set_field", "id", config.ID, "type", config.Type, "strength", config.Strength)
+	return map[string]sim.FieldConfig{"field": field.Config()}, nil
+}
+
+func (api *AdminAPI) removeField(admin string, r *http.Request) (interface{}, error) {
+	request := FieldRemoveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, &adminError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	api.simState.Mu.Lock()
+	removed := sim.RemoveForceField(api.simState, request.ID)
+	if removed {
+		publishFields(api.simState, api.hub)
+	}
+	api.simState.Mu.Unlock()
+
+	if !removed {
+		return nil, &adminError{status: http.StatusNotFound, message: fmt.Sprintf("field %q does not exist", request.ID)}
+	}
+
+	api.recordAction(admin, "remove_field", "id", request.ID)
+	return map[string]bool{"removed": true}, nil
+}
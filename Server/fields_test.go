@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+func TestAdminFields(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	bans, _ := LoadBanList(filepath.Join(t.TempDir(), "bans.json"))
+	mux := http.NewServeMux()
+	newAdminAPI(map[string]string{"secret": "alice"}, state, hub, bans).register(mux)
+
+	client := newClient(hub, nil, "10.0.0.1:4000")
+	hub.register <- client
+
+	status, _ := adminRequest(t, mux, "/admin/set-field", `{"id":"storm","type":"vortex","center":[5,5],"radius":20,"strength":2}`)
+	if status != http.StatusOK || len(state.Fields) != 1 {
+		t.Fatalf("Set field status is %v with %v fields, expected %v with %v", status, len(state.Fields), http.StatusOK, 1)
+	}
+
+	fields := FieldsMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeFields).data, &fields); err != nil {
+		t.Fatalf("Error unmarshalling fields message %v", err)
+	}
+
+	if len(fields.Fields) != 1 || fields.Fields[0].ID != "storm" || fields.Fields[0].Type != sim.FieldVortex || fields.Fields[0].Radius != 20 {
+		t.Errorf("Fields message is %+v, expected the storm vortex", fields)
+	}
+
+	// new joiners are sent the current fields
+	joiner := newClient(hub, nil, "10.0.0.2:4000")
+	hub.register <- joiner
+	nextReply(t, joiner, MessageTypeFields)
+
+	status, _ = adminRequest(t, mux, "/admin/set-field", `{"id":"bad","type":"nebula"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("Set invalid field status is %v, expected %v", status, http.StatusBadRequest)
+	}
+
+	status, result := adminRequest(t, mux, "/admin/remove-field", `{"id":"storm"}`)
+	if status != http.StatusOK || result["removed"] != true || len(state.Fields) != 0 {
+		t.Errorf("Remove field status is %v, result %v, fields %v, expected %v and no fields", status, result, len(state.Fields), http.StatusOK)
+	}
+
+	status, _ = adminRequest(t, mux, "/admin/remove-field", `{"id":"storm"}`)
+	if status != http.StatusNotFound {
+		t.Errorf("Remove missing field status is %v, expected %v", status, http.StatusNotFound)
+	}
+}
+
+func TestPublishFieldsNeverBlocks(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 10, 10, 100, 1)
+	// the hub is not running so nothing picks the fields up
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+
+	state.Mu.Lock()
+	publishFields(state, hub)
+	field, _ := sim.NewForceField(sim.FieldConfig{ID: "storm", Type: sim.FieldVortex, Radius: 20, Strength: 2})
+	sim.SetForceField(state, field)
+	publishFields(state, hub)
+	state.Mu.Unlock()
+
+	if fields := <-hub.fields; len(fields) != 1 || fields[0].ID != "storm" {
+		t.Errorf("Published fields are %+v, expected only the latest with the storm", fields)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is sent at the start of every frame on the negotiated
+// subprotocols and bumped whenever the frame or message layout changes
+const ProtocolVersion = uint8(4)
+
+// FrameHeader starts every binary frame and is followed by Count body packets
+type FrameHeader struct {
+	Version    uint8
+	Flags      uint8
+	Players    uint16
+	Spectators uint16
+	Tick       uint64
+	Time       int64
+	Count      uint16
+}
+
+const FrameHeaderBytes = (8 + 8 + 16 + 16 + 64 + 64 + 16) / 8
+
+// LegacyFrameHeaderBytes is the player count that starts the frames of
+// clients that did not negotiate a subprotocol, followed by body packets
+// until the end of the frame
+const LegacyFrameHeaderBytes = 16 / 8
+
+// Frame flags tell clients which bodies missing from a frame still exist
+const (
+	// FrameFlagFiltered marks frames limited to the client's viewport
+	FrameFlagFiltered = uint8(1 << iota)
+
+	// FrameFlagPartial marks frames that left out bodies to stay within the
+	// client's bandwidth budget, missing bodies keep their last known state
+	FrameFlagPartial
+)
+
+// FrameData is the JSON form of a frame, sent to clients that negotiated the
+// JSON subprotocol
+type FrameData struct {
+	V uint8          `json:"v"`
+	F uint8          `json:"f"`
+	P int            `json:"p"`
+	W int            `json:"w"`
+	T uint64         `json:"t"`
+	S int64          `json:"s"`
+	D []sim.BodyData `json:"d"`
+}
+
+// Websocket subprotocols a client can ask for through Sec-WebSocket-Protocol,
+// clients that ask for neither get legacy frames and no text messages
+const (
+	SubprotocolBinary = "galaxy.binary"
+	SubprotocolJSON   = "galaxy.json"
+)
+
+// frameFormat is the encoding of the frames sent to a client
+type frameFormat uint8
+
+const (
+	formatBinary frameFormat = iota
+	formatJSON
+
+	// formatLegacy is the layout clients without a subprotocol understand,
+	// they decode every message as a frame so they are sent nothing else
+	formatLegacy
+)
+
+// subprotocolFormat returns the frame format of a negotiated subprotocol
+func subprotocolFormat(subprotocol string) frameFormat {
+	switch subprotocol {
+	case SubprotocolJSON:
+		return formatJSON
+	case SubprotocolBinary:
+		return formatBinary
+	default:
+		return formatLegacy
+	}
+}
+
+// textMessages reports whether clients receiving the format may be sent JSON
+// text messages besides frames
+func (format frameFormat) textMessages() bool {
+	return format != formatLegacy
+}
+
+// partialFrames reports whether clients receiving the format keep the bodies
+// missing from a partial frame instead of dropping them
+func (format frameFormat) partialFrames() bool {
+	return format != formatLegacy
+}
+
+// kind returns the websocket message type frames are sent as
+func (format frameFormat) kind() int {
+	if format == formatJSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// slots estimates how many bodies fit in a frame of size bytes, given the
+// size of a full frame of count bodies
+func (format frameFormat) slots(size int, full []byte, count int) int {
+	switch format {
+	case formatBinary:
+		return (size - FrameHeaderBytes) / sim.BodyPacketBytes
+	case formatLegacy:
+		return (size - LegacyFrameHeaderBytes) / sim.BodyPacketBytes
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	// the header is counted against every body so this never overestimates
+	return size * count / len(full)
+}
+
+// serverEpoch is the origin of the monotonic server timestamps sent to clients
+var serverEpoch = time.Now()
+
+// serverTime returns nanoseconds since the server started from the monotonic clock
+func serverTime() int64 {
+	return time.Since(serverEpoch).Nanoseconds()
+}
+
+// Snapshot is a copy of the simulation taken once per send, every client
+// frame is built from it without holding the simulation lock
+type Snapshot struct {
+	Tick   uint64
+	Time   int64
+	Bodies []sim.BodyData
+
+	// simulation events since the previous snapshot, sent to every client
+	// as a reliable message ahead of the frame
+	Events []sim.Event
+
+	// packed body packets, shared by every frame built from the snapshot
+	packed [][]byte
+}
+
+func takeSnapshot(simState *sim.SimulationState) *Snapshot {
+	simState.Mu.Lock()
+	bodies := make([]sim.BodyData, len(simState.Bodies))
+	copy(bodies, simState.Bodies)
+	tick, _ := simState.LastTick()
+	simState.Mu.Unlock()
+
+	snapshot := &Snapshot{
+		Tick:   tick,
+		Time:   serverTime(),
+		Bodies: bodies,
+		packed: make([][]byte, len(bodies)),
+	}
+
+	for i := range bodies {
+		packed, err := bodies[i].Pack()
+		if err != nil {
+			slog.Error("Error packing frame body", "body", bodies[i].I, "err", err)
+			continue
+		}
+		snapshot.packed[i] = packed
+	}
+
+	return snapshot
+}
+
+// Audience is the number of connected players and spectators sent in frames
+type Audience struct {
+	Players    int
+	Spectators int
+}
+
+// encodeFrame encodes the frame header and every body accepted by include
+func encodeFrame(snapshot *Snapshot, audience Audience, flags uint8, format frameFormat, include func(body *sim.BodyData) bool) ([]byte, error) {
+	switch format {
+	case formatJSON:
+		return encodeFrameJSON(snapshot, audience, flags, include)
+	case formatLegacy:
+		return encodeFrameLegacy(snapshot, audience, include)
+	}
+	return encodeFrameBinary(snapshot, audience, flags, include)
+}
+
+// encodeFrameLegacy encodes the player count followed by the body packets,
+// the layout from before frames had a header
+func encodeFrameLegacy(snapshot *Snapshot, audience Audience, include func(body *sim.BodyData) bool) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	buffer.Grow(LegacyFrameHeaderBytes + len(snapshot.Bodies)*sim.BodyPacketBytes)
+	if err := binary.Write(buffer, binary.LittleEndian, uint16(audience.Players)); err != nil {
+		return nil, err
+	}
+
+	for i := range snapshot.Bodies {
+		if snapshot.packed[i] != nil && include(&snapshot.Bodies[i]) {
+			buffer.Write(snapshot.packed[i])
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func encodeFrameJSON(snapshot *Snapshot, audience Audience, flags uint8, include func(body *sim.BodyData) bool) ([]byte, error) {
+	frame := FrameData{
+		V: ProtocolVersion,
+		F: flags,
+		P: audience.Players,
+		W: audience.Spectators,
+		T: snapshot.Tick,
+		S: snapshot.Time,
+		D: make([]sim.BodyData, 0, len(snapshot.Bodies)),
+	}
+
+	for i := range snapshot.Bodies {
+		if snapshot.packed[i] != nil && include(&snapshot.Bodies[i]) {
+			frame.D = append(frame.D, snapshot.Bodies[i])
+		}
+	}
+
+	return json.Marshal(frame)
+}
+
+func encodeFrameBinary(snapshot *Snapshot, audience Audience, flags uint8, include func(body *sim.BodyData) bool) ([]byte, error) {
+	count := 0
+	for i := range snapshot.Bodies {
+		if snapshot.packed[i] != nil && include(&snapshot.Bodies[i]) {
+			count++
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.Grow(FrameHeaderBytes + count*sim.BodyPacketBytes)
+	header := FrameHeader{
+		Version:    ProtocolVersion,
+		Flags:      flags,
+		Players:    uint16(audience.Players),
+		Spectators: uint16(audience.Spectators),
+		Tick:       snapshot.Tick,
+		Time:       snapshot.Time,
+		Count:      uint16(count),
+	}
+
+	if err := binary.Write(buffer, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+
+	for i := range snapshot.Bodies {
+		if snapshot.packed[i] != nil && include(&snapshot.Bodies[i]) {
+			buffer.Write(snapshot.packed[i])
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Viewport is the area of the world a client is looking at, centred on X, Y
+// with a W by H size in world units and Zoom in pixels per world unit
+type Viewport struct {
+	X    float32 `json:"x"`
+	Y    float32 `json:"y"`
+	W    float32 `json:"w"`
+	H    float32 `json:"h"`
+	Zoom float32 `json:"zoom"`
+}
+
+// AOIConfig controls how client viewports filter the bodies in their frames
+type AOIConfig struct {
+	// Margin added on every side of a viewport as a fraction of its size
+	Margin float32
+
+	// Cell is the grid size viewports are snapped out to, clients whose
+	// snapped viewports match share one encoded frame
+	Cell float32
+
+	// AlwaysRadius includes bodies at least this large in every frame since
+	// their gravity is felt well outside of the viewport
+	AlwaysRadius float32
+
+	// MinPixelRadius drops bodies smaller than this many pixels on screen,
+	// disabled when <= 0
+	MinPixelRadius float32
+}
+
+func DefaultAOIConfig() AOIConfig {
+	return AOIConfig{
+		Margin:         0.25,
+		Cell:           10,
+		AlwaysRadius:   3,
+		MinPixelRadius: 0,
+	}
+}
+
+// viewKey identifies a snapped viewport, the zero key is the full frame
+type viewKey struct {
+	filtered               bool
+	minX, minY, maxX, maxY int32
+	zoom                   int8
+}
+
+func (config AOIConfig) key(view *Viewport) viewKey {
+	if view == nil || config.Cell <= 0 {
+		return viewKey{}
+	}
+
+	marginX := view.W * (0.5 + config.Margin)
+	marginY := view.H * (0.5 + config.Margin)
+	key := viewKey{
+		filtered: true,
+		minX:     int32(math.Floor(float64((view.X - marginX) / config.Cell))),
+		minY:     int32(math.Floor(float64((view.Y - marginY) / config.Cell))),
+		maxX:     int32(math.Ceil(float64((view.X + marginX) / config.Cell))),
+		maxY:     int32(math.Ceil(float64((view.Y + marginY) / config.Cell))),
+	}
+
+	if config.MinPixelRadius > 0 && view.Zoom > 0 {
+		key.zoom = int8(math.Max(-64, math.Min(63, math.Floor(math.Log2(float64(view.Zoom))))))
+	}
+
+	return key
+}
+
+func (key viewKey) flags() uint8 {
+	if key.filtered {
+		return FrameFlagFiltered
+	}
+	return 0
+}
+
+// includes reports whether a body belongs in frames built for the key
+func (config AOIConfig) includes(key viewKey, body *sim.BodyData) bool {
+	if !key.filtered || body.R >= config.AlwaysRadius {
+		return true
+	}
+
+	if config.MinPixelRadius > 0 && body.R*float32(math.Exp2(float64(key.zoom))) < config.MinPixelRadius {
+		return false
+	}
+
+	x, y := body.P.X(), body.P.Y()
+	return x+body.R >= float32(key.minX)*config.Cell && x-body.R <= float32(key.maxX)*config.Cell &&
+		y+body.R >= float32(key.minY)*config.Cell && y-body.R <= float32(key.maxY)*config.Cell
+}
+
+// frameKey identifies an encoded frame within a frameCache
+type frameKey struct {
+	view   viewKey
+	format frameFormat
+}
+
+// frameCache encodes each distinct snapped viewport once per format per snapshot
+type frameCache struct {
+	snapshot *Snapshot
+	audience Audience
+	config   AOIConfig
+	frames   map[frameKey][]byte
+}
+
+func newFrameCache(snapshot *Snapshot, audience Audience, config AOIConfig) *frameCache {
+	return &frameCache{
+		snapshot: snapshot,
+		audience: audience,
+		config:   config,
+		frames:   make(map[frameKey][]byte),
+	}
+}
+
+func (cache *frameCache) frameFor(view *Viewport, format frameFormat) ([]byte, error) {
+	key := frameKey{view: cache.config.key(view), format: format}
+	if frame, ok := cache.frames[key]; ok {
+		return frame, nil
+	}
+
+	frame, err := encodeFrame(cache.snapshot, cache.audience, key.view.flags(), format, func(body *sim.BodyData) bool {
+		return cache.config.includes(key.view, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.frames[key] = frame
+	return frame, nil
+}
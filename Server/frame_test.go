@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func readFrameIDs(t *testing.T, data []byte) []uint16 {
+	reader := bytes.NewReader(data)
+	header := FrameHeader{}
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Error binary reading header from packet %v", err)
+	}
+
+	bodies := make([]sim.BodyPacket, header.Count)
+	if err := binary.Read(reader, binary.LittleEndian, &bodies); err != nil {
+		t.Fatalf("Error binary reading bodies from packet %v", err)
+	}
+
+	ids := make([]uint16, len(bodies))
+	for i, body := range bodies {
+		ids[i] = body.I
+	}
+	return ids
+}
+
+func createAOISnapshot() *Snapshot {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 1, 10, 1000, 1)
+	state.Bodies = append(state.Bodies,
+		sim.BodyData{I: 0, P: mgl32.Vec2{0, 0}, R: 1},
+		sim.BodyData{I: 1, P: mgl32.Vec2{12, 0}, R: 1},
+		sim.BodyData{I: 2, P: mgl32.Vec2{200, 200}, R: 1},
+		sim.BodyData{I: 3, P: mgl32.Vec2{-300, 0}, R: 4},
+	)
+	return takeSnapshot(state)
+}
+
+func TestFrameViewportFilter(t *testing.T) {
+	snapshot := createAOISnapshot()
+	config := AOIConfig{Margin: 0.25, Cell: 10, AlwaysRadius: 3}
+	cache := newFrameCache(snapshot, Audience{Players: 1}, config)
+
+	full, err := cache.frameFor(nil, formatBinary)
+	if err != nil {
+		t.Fatalf("Error encoding full frame %v", err)
+	}
+
+	if ids := readFrameIDs(t, full); len(ids) != 4 {
+		t.Errorf("Full frame has %v bodies, expected %v", len(ids), 4)
+	}
+
+	view, err := cache.frameFor(&Viewport{X: 0, Y: 0, W: 20, H: 20, Zoom: 10}, formatBinary)
+	if err != nil {
+		t.Fatalf("Error encoding viewport frame %v", err)
+	}
+
+	// the far body is culled, the large body is always sent
+	ids := readFrameIDs(t, view)
+	expected := []uint16{0, 1, 3}
+	if len(ids) != len(expected) {
+		t.Fatalf("Viewport frame has bodies %v, expected %v", ids, expected)
+	}
+
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("Viewport frame body %v is %v, expected %v", i, ids[i], expected[i])
+		}
+	}
+}
+
+func TestFrameViewportSharing(t *testing.T) {
+	snapshot := createAOISnapshot()
+	cache := newFrameCache(snapshot, Audience{Players: 1}, DefaultAOIConfig())
+
+	first, _ := cache.frameFor(&Viewport{X: 1, Y: 1, W: 20, H: 20, Zoom: 10}, formatBinary)
+	second, _ := cache.frameFor(&Viewport{X: 2, Y: 0.5, W: 20, H: 20, Zoom: 10}, formatBinary)
+	far, _ := cache.frameFor(&Viewport{X: 200, Y: 200, W: 20, H: 20, Zoom: 10}, formatBinary)
+
+	if len(cache.frames) != 2 {
+		t.Errorf("Frame cache built %v frames, expected %v", len(cache.frames), 2)
+	}
+
+	if &first[0] != &second[0] {
+		t.Errorf("Similar viewports did not share an encoded frame")
+	}
+
+	ids := readFrameIDs(t, far)
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("Far viewport frame has bodies %v, expected %v", ids, []uint16{2, 3})
+	}
+}
+
+func TestFrameMinPixelRadius(t *testing.T) {
+	snapshot := createAOISnapshot()
+	config := AOIConfig{Margin: 0.25, Cell: 10, AlwaysRadius: 3, MinPixelRadius: 2}
+	cache := newFrameCache(snapshot, Audience{Players: 1}, config)
+
+	// at half a pixel per unit the small bodies are too small to draw
+	frame, _ := cache.frameFor(&Viewport{X: 0, Y: 0, W: 1000, H: 1000, Zoom: 0.5}, formatBinary)
+	ids := readFrameIDs(t, frame)
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Zoomed out frame has bodies %v, expected %v", ids, []uint16{3})
+	}
+}
+
+func TestClientSetViewport(t *testing.T) {
+	client := newClient(nil, nil, "test")
+
+	if !client.setViewport(Viewport{X: 1, Y: 2, W: 3, H: 4, Zoom: 5}) {
+		t.Errorf("setViewport valid is %v, expected %v", false, true)
+	}
+
+	if view := client.viewport.Load(); view == nil || view.W != 3 {
+		t.Errorf("Client viewport is %v, expected W %v", view, 3)
+	}
+
+	if client.setViewport(Viewport{W: -1, H: 4}) {
+		t.Errorf("setViewport negative size is %v, expected %v", true, false)
+	}
+
+	if !client.setViewport(Viewport{}) {
+		t.Errorf("setViewport clear is %v, expected %v", false, true)
+	}
+
+	if view := client.viewport.Load(); view != nil {
+		t.Errorf("Cleared client viewport is %v, expected nil", view)
+	}
+}
+
+func TestFrameJSON(t *testing.T) {
+	snapshot := createAOISnapshot()
+	snapshot.Tick = 9
+	cache := newFrameCache(snapshot, Audience{Players: 2, Spectators: 3}, DefaultAOIConfig())
+
+	data, err := cache.frameFor(&Viewport{X: 0, Y: 0, W: 20, H: 20, Zoom: 10}, formatJSON)
+	if err != nil {
+		t.Fatalf("Error encoding JSON frame %v", err)
+	}
+
+	frame := FrameData{}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("Error unmarshalling JSON frame %v", err)
+	}
+
+	if frame.V != ProtocolVersion || frame.F != FrameFlagFiltered || frame.P != 2 || frame.W != 3 || frame.T != 9 {
+		t.Errorf("JSON frame header is %v %v %v %v %v, expected %v %v %v %v %v", frame.V, frame.F, frame.P, frame.W, frame.T, ProtocolVersion, FrameFlagFiltered, 2, 3, 9)
+	}
+
+	if len(frame.D) != 3 || frame.D[1].I != 1 || frame.D[1].P != snapshot.Bodies[1].P {
+		t.Errorf("JSON frame bodies are %v, expected bodies 0, 1 and 3", frame.D)
+	}
+
+	// each format is encoded once and kept apart from the other
+	again, _ := cache.frameFor(&Viewport{X: 1, Y: 1, W: 20, H: 20, Zoom: 10}, formatJSON)
+	packed, _ := cache.frameFor(&Viewport{X: 0, Y: 0, W: 20, H: 20, Zoom: 10}, formatBinary)
+	if &again[0] != &data[0] {
+		t.Errorf("Similar viewports did not share an encoded JSON frame")
+	}
+
+	if len(cache.frames) != 2 || packed[0] != ProtocolVersion {
+		t.Errorf("Frame cache built %v frames, expected a binary and a JSON frame", len(cache.frames))
+	}
+}
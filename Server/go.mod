@@ -1,8 +1,10 @@
 module github.com/TylerStein/galaxy-sandbox-online
 
-go 1.16
+go 1.21
 
 require (
 	github.com/go-gl/mathgl v1.0.0
 	github.com/gorilla/websocket v1.4.2
-)
\ No newline at end of file
+)
+
+require golang.org/x/image v0.0.0-20190321063152-3fc05d484e9f // indirect
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+const DefaultHealthMaxTickAge = 5 * time.Second
+
+// DefaultShutdownDrain is how long readiness fails before the server stops
+// accepting connections, so load balancers stop sending new clients first
+const DefaultShutdownDrain = 5 * time.Second
+
+// healthTimeout bounds a probe so a stuck server fails it instead of hanging
+const healthTimeout = 2 * time.Second
+
+// Server lifecycle phases reported by /readyz
+const (
+	phaseStarting int32 = iota
+	phaseReady
+	phaseShuttingDown
+)
+
+var phaseNames = map[int32]string{
+	phaseStarting:     "starting",
+	phaseReady:        "ready",
+	phaseShuttingDown: "shutting_down",
+}
+
+// Health answers liveness and readiness probes from the simulation and hub state
+type Health struct {
+	simState   *sim.SimulationState
+	hub        *Hub
+	scheduler  *sim.Scheduler
+	maxClients int
+	maxTickAge time.Duration
+	startedAt  time.Time
+	phase      atomic.Int32
+}
+
+type HealthReport struct {
+	Status     string             `json:"status"`
+	Phase      string             `json:"phase"`
+	Reason     string             `json:"reason,omitempty"`
+	Tick       uint64             `json:"tick"`
+	LastTickAt time.Time          `json:"lastTickAt"`
+	TickLagMs  int64              `json:"tickLagMs"`
+	Clients    int                `json:"clients"`
+	MaxClients int                `json:"maxClients"`
+	Spectators int                `json:"spectators"`
+	Bodies     int                `json:"bodies"`
+	MaxBodies  int                `json:"maxBodies"`
+	Invariants sim.InvariantStats `json:"invariants"`
+	Scheduler  sim.SchedulerStats `json:"scheduler"`
+}
+
+func newHealth(simState *sim.SimulationState, hub *Hub, scheduler *sim.Scheduler, maxClients int, maxTickAge time.Duration) *Health {
+	return &Health{
+		simState:   simState,
+		hub:        hub,
+		scheduler:  scheduler,
+		maxClients: maxClients,
+		maxTickAge: maxTickAge,
+		startedAt:  time.Now(),
+	}
+}
+
+func (health *Health) setPhase(phase int32) {
+	health.phase.Store(phase)
+}
+
+func (health *Health) report(now time.Time) HealthReport {
+	tick, lastTickAt := health.simState.LastTick()
+
+	// measure lag from startup until the first tick completes
+	since := lastTickAt
+	if since.IsZero() {
+		since = health.startedAt
+	}
+
+	// never take the simulation lock, the probes have to answer when it is stuck
+	summary := health.simState.Summary()
+	audience := health.hub.audience()
+	return HealthReport{
+		Status:     "ok",
+		Phase:      phaseNames[health.phase.Load()],
+		Tick:       tick,
+		LastTickAt: lastTickAt,
+		TickLagMs:  now.Sub(since).Milliseconds(),
+		Clients:    audience.Players,
+		MaxClients: health.maxClients,
+		Spectators: audience.Spectators,
+		Bodies:     summary.Bodies,
+		MaxBodies:  summary.MaxBodies,
+		Invariants: summary.Invariants,
+		Scheduler:  health.scheduler.Stats(),
+	}
+}
+
+// live reports whether the simulation has completed a tick recently enough
+func (health *Health) live(report *HealthReport) bool {
+	if time.Duration(report.TickLagMs)*time.Millisecond > health.maxTickAge {
+		report.Status = "fail"
+		report.Reason = "simulation tick is stale"
+		return false
+	}
+	return true
+}
+
+// ready reports whether the server should be sent new connections
+func (health *Health) ready(report *HealthReport) bool {
+	if !health.live(report) {
+		return false
+	}
+
+	switch health.phase.Load() {
+	case phaseStarting:
+		report.Reason = "simulation state is being restored"
+	case phaseShuttingDown:
+		report.Reason = "server is shutting down"
+	default:
+		if report.Tick == 0 {
+			report.Reason = "waiting for the first simulation tick"
+		} else if report.Clients >= report.MaxClients {
+			report.Reason = "client capacity exhausted"
+		} else {
+			return true
+		}
+	}
+
+	report.Status = "fail"
+	return false
+}
+
+// register adds the probes to mux, each bounded by healthTimeout
+func (health *Health) register(mux *http.ServeMux) {
+	timedOut := `{"status":"fail","reason":"health check timed out"}`
+	mux.Handle("/healthz", http.TimeoutHandler(http.HandlerFunc(health.serveHealthz), healthTimeout, timedOut))
+	mux.Handle("/readyz", http.TimeoutHandler(http.HandlerFunc(health.serveReadyz), healthTimeout, timedOut))
+}
+
+func (health *Health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	report := health.report(time.Now())
+	writeHealthReport(w, report, health.live(&report))
+}
+
+func (health *Health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	report := health.report(time.Now())
+	writeHealthReport(w, report, health.ready(&report))
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport, ok bool) {
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Error writing health report", "err", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+func serveHealthRequest(t *testing.T, handler http.HandlerFunc, path string) (int, HealthReport) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+	report := HealthReport{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Error unmarshalling %v response %v", path, err)
+	}
+
+	return recorder.Code, report
+}
+
+func TestHealthz(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	scheduler := sim.NewScheduler(state, sim.DefaultSchedulerConfig(16*time.Millisecond))
+	health := newHealth(state, hub, scheduler, 1, time.Second)
+
+	code, report := serveHealthRequest(t, health.serveHealthz, "/healthz")
+	if code != http.StatusOK {
+		t.Errorf("Startup /healthz code is %v, expected %v", code, http.StatusOK)
+	}
+
+	state.RecordTick(42, time.Now())
+	code, report = serveHealthRequest(t, health.serveHealthz, "/healthz")
+	if code != http.StatusOK {
+		t.Errorf("/healthz code is %v, expected %v", code, http.StatusOK)
+	}
+
+	if report.Tick != 42 {
+		t.Errorf("/healthz tick is %v, expected %v", report.Tick, 42)
+	}
+
+	state.RecordTick(43, time.Now().Add(-2*time.Second))
+	code, report = serveHealthRequest(t, health.serveHealthz, "/healthz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Stale /healthz code is %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	if report.TickLagMs < 2000 {
+		t.Errorf("Stale /healthz tick lag is %v, expected at least %v", report.TickLagMs, 2000)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	scheduler := sim.NewScheduler(state, sim.DefaultSchedulerConfig(16*time.Millisecond))
+	health := newHealth(state, hub, scheduler, 1, time.Second)
+	sim.AddSimulationBody(state, sim.BodyData{R: 1})
+
+	code, _ := serveHealthRequest(t, health.serveReadyz, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Starting /readyz code is %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	health.setPhase(phaseReady)
+	code, _ = serveHealthRequest(t, health.serveReadyz, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Unticked /readyz code is %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	state.RecordTick(1, time.Now())
+	code, report := serveHealthRequest(t, health.serveReadyz, "/readyz")
+	if code != http.StatusOK {
+		t.Errorf("/readyz code is %v, expected %v (%v)", code, http.StatusOK, report.Reason)
+	}
+
+	if report.Bodies != 1 {
+		t.Errorf("/readyz bodies is %v, expected %v", report.Bodies, 1)
+	}
+
+	hub.count.Store(1)
+	code, report = serveHealthRequest(t, health.serveReadyz, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Full /readyz code is %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	if report.Clients != 1 {
+		t.Errorf("Full /readyz clients is %v, expected %v", report.Clients, 1)
+	}
+
+	hub.count.Store(0)
+	health.setPhase(phaseShuttingDown)
+	code, report = serveHealthRequest(t, health.serveReadyz, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Shutdown /readyz code is %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	if report.Phase != "shutting_down" {
+		t.Errorf("Shutdown /readyz phase is %v, expected %v", report.Phase, "shutting_down")
+	}
+}
+
+func TestHealthzWithoutLock(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	scheduler := sim.NewScheduler(state, sim.DefaultSchedulerConfig(16*time.Millisecond))
+	health := newHealth(state, hub, scheduler, 1, time.Second)
+	sim.AddSimulationBody(state, sim.BodyData{R: 1})
+	state.RecordTick(1, time.Now())
+
+	// a stuck simulation holds its lock, the probe still has to answer
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+
+	done := make(chan HealthReport)
+	go func() {
+		_, report := serveHealthRequest(t, health.serveHealthz, "/healthz")
+		done <- report
+	}()
+
+	select {
+	case report := <-done:
+		if report.Bodies != 1 {
+			t.Errorf("/healthz bodies is %v, expected %v", report.Bodies, 1)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("/healthz did not answer while the simulation lock was held")
+	}
+}
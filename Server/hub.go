@@ -4,14 +4,65 @@
 
 package main
 
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+// Message is a single websocket message with its frame type
+type Message struct {
+	kind int
+	data []byte
+}
+
+// ClientMessage is a message received from or addressed to a single client
+type ClientMessage struct {
+	Message
+	client *Client
+
+	// Server time the message was read from the connection.
+	at int64
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Messages to broadcast to clients
-	broadcast chan []byte
+	// Simulation snapshots to encode and broadcast to clients
+	broadcast chan *Snapshot
 
 	// Messages recieved from clients
-	incoming chan []byte
+	incoming chan *ClientMessage
+
+	// Messages addressed to a single client
+	direct chan *ClientMessage
+
+	// Chat messages relayed to every client
+	chat chan ChatMessage
+
+	// Chat settings and recent chat messages sent to new joiners, history
+	// is only used from run.
+	chatConfig ChatConfig
+	history    []Message
+
+	// Latest force field change and the fields message sent to new joiners,
+	// fieldsMessage is only used from run.
+	fields        chan []sim.FieldConfig
+	fieldsMessage *Message
+
+	// Moderation requests matched against every registered client
+	kick chan *kickRequest
+	find chan *findRequest
+
+	// Chat mutes by session and address, kept in memory only
+	mutes *BanList
+
+	// Proxies whose X-Forwarded-For header is trusted for peer addresses
+	proxies TrustedProxies
 
 	// Registered clients.
 	clients map[*Client]bool
@@ -21,36 +72,285 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Number of registered clients and how many of them are spectators,
+	// safe to read outside of run.
+	count      atomic.Int64
+	spectators atomic.Int64
+
+	// Number of registered spectators, only used from run.
+	spectating int
+
+	// Number of frames broadcast, used to apply client send tiers.
+	frames uint64
+
+	// Area of interest filtering applied to clients with a viewport.
+	aoi AOIConfig
+
+	// Bandwidth limit per client in bytes per second, 0 for unlimited.
+	bandwidth int64
+
+	// permessage-deflate settings for client connections.
+	compression CompressionConfig
+
+	// Audit log of connections and player actions, nil for none.
+	audit *AuditLog
+
+	// Admin names keyed by token, clients connecting with one of them are
+	// given the admin body quota.
+	adminTokens map[string]string
+
+	// Live bodies each player may own.
+	quota QuotaConfig
+
+	// Limits and permissions of the sandbox tools.
+	tools ToolConfig
+
+	// Limits of the trajectory previews.
+	preview PreviewConfig
+
+	// Frames a client may fall behind before it is moved to a slower send
+	// tier, and disconnected once it is on the slowest one.
+	slowFrames int
 }
 
-func newHub(broadcast chan []byte, incoming chan []byte) *Hub {
+func newHub(broadcast chan *Snapshot, incoming chan *ClientMessage) *Hub {
 	return &Hub{
-		broadcast:  broadcast,
-		incoming:   incoming,
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		broadcast:   broadcast,
+		incoming:    incoming,
+		direct:      make(chan *ClientMessage),
+		chat:        make(chan ChatMessage),
+		fields:      make(chan []sim.FieldConfig, 1),
+		kick:        make(chan *kickRequest),
+		find:        make(chan *findRequest),
+		mutes:       &BanList{bans: []Ban{}},
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		clients:     make(map[*Client]bool),
+		aoi:         DefaultAOIConfig(),
+		slowFrames:  int(DefaultSlowClientFrames),
+		compression: DefaultCompressionConfig(),
+		chatConfig:  DefaultChatConfig(),
+		quota:       DefaultQuotaConfig(),
+		tools:       DefaultToolConfig(),
+		preview:     DefaultPreviewConfig(),
+	}
+}
+
+// clientCount returns the number of registered clients from any goroutine.
+func (h *Hub) clientCount() int {
+	return int(h.count.Load())
+}
+
+// audience returns the number of registered players and spectators from any
+// goroutine.
+func (h *Hub) audience() Audience {
+	spectators := int(h.spectators.Load())
+	return Audience{Players: int(h.count.Load()) - spectators, Spectators: spectators}
+}
+
+// add registers a client, sends it the chat history and announces players,
+// only called from run.
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+	if client.spectator {
+		h.spectating++
+	}
+
+	// a client whose queue fills up is dropped by deliver, stop sending to it
+	if h.fieldsMessage != nil {
+		h.deliver(client, *h.fieldsMessage)
+	}
+	for _, message := range h.history {
+		if !h.clients[client] {
+			return
+		}
+		h.deliver(client, message)
+	}
+
+	if !h.clients[client] || client.spectator {
+		return
+	}
+	h.relay(systemChat(fmt.Sprintf("player %v joined", client.id)))
+}
+
+// remove forgets a client and announces players leaving, only called from run.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	if client.spectator {
+		h.spectating--
+		return
+	}
+	h.relay(systemChat(fmt.Sprintf("player %v left", client.id)))
+}
+
+func systemChat(text string) ChatMessage {
+	return ChatMessage{Type: MessageTypeChat, Text: text, Time: serverTime(), System: true}
+}
+
+// relay sends a chat message to every client and keeps it in the history,
+// only called from run.
+func (h *Hub) relay(chat ChatMessage) {
+	message, err := newTextMessage(chat)
+	if err != nil {
+		slog.Error("Error encoding chat message", "err", err)
+		return
+	}
+
+	if h.chatConfig.HistorySize > 0 {
+		if len(h.history) >= h.chatConfig.HistorySize {
+			h.history = h.history[1:]
+		}
+		h.history = append(h.history, message)
+	}
+
+	for client := range h.clients {
+		h.deliver(client, message)
+	}
+}
+
+// setFields sends the force fields to every client and keeps them for new
+// joiners, only called from run.
+func (h *Hub) setFields(fields []sim.FieldConfig) {
+	message, err := newTextMessage(FieldsMessage{Type: MessageTypeFields, Fields: fields})
+	if err != nil {
+		slog.Error("Error encoding fields message", "err", err)
+		return
+	}
+
+	h.fieldsMessage = &message
+	for client := range h.clients {
+		h.deliver(client, message)
+	}
+}
+
+// drop removes a client and closes its connection with code and reason.
+func (h *Hub) drop(client *Client, code int, reason string) {
+	h.remove(client)
+	client.closeWith(code, reason)
+	h.audit.record("disconnect", client, "reason", reason)
+	client.logger.Warn("Dropping client", "reason", reason, "clients", len(h.clients))
+}
+
+// deliver queues a control message for a client, these are never dropped so
+// a client with a full queue is disconnected instead.
+func (h *Hub) deliver(client *Client, message Message) {
+	// legacy clients would decode text messages as frames
+	if message.kind == websocket.TextMessage && !client.format.textMessages() {
+		return
+	}
+
+	select {
+	case client.send <- message:
+	default:
+		h.drop(client, websocket.CloseTryAgainLater, "send queue full")
+	}
+}
+
+// deliverFrame replaces the frame still waiting to be written to a client, if
+// any, with a newer one. Clients that keep falling behind are moved to slower
+// send tiers and disconnected once they can not keep up with the slowest.
+func (h *Hub) deliverFrame(client *Client, message Message) {
+	select {
+	case <-client.frame:
+		client.behind++
+	default:
+		if client.behind > 0 {
+			client.behind--
+		}
+	}
+	client.frame <- message
+
+	if h.slowFrames <= 0 || client.behind < h.slowFrames {
+		return
+	}
+
+	client.behind = 0
+	tier, ok := client.downgrade()
+	if !ok {
+		h.drop(client, websocket.CloseTryAgainLater, "client too slow")
+		return
+	}
+
+	client.logger.Info("Slowing send rate of lagging client", "tier", tier)
+	notice, err := newTextMessage(RateMessage{Type: MessageTypeRate, Tier: tier})
+	if err != nil {
+		client.logger.Error("Error encoding rate message", "err", err)
+		return
+	}
+	h.deliver(client, notice)
+}
+
+// deliverEvents sends the snapshot's simulation events to every client, they
+// are not filtered by send tier or viewport so clients never miss one
+func (h *Hub) deliverEvents(snapshot *Snapshot) {
+	if len(snapshot.Events) == 0 {
+		return
+	}
+
+	message, err := newTextMessage(EventsMessage{Type: MessageTypeEvents, Tick: snapshot.Tick, Events: snapshot.Events})
+	if err != nil {
+		slog.Error("Error encoding events message", "err", err)
+		return
+	}
+
+	for client := range h.clients {
+		h.deliver(client, message)
 	}
 }
 
 func (h *Hub) run() {
 	for {
+		h.count.Store(int64(len(h.clients)))
+		h.spectators.Store(int64(h.spectating))
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.add(client)
+			slog.Debug("Client registered", "conn", client.id, "spectator", client.spectator, "clients", len(h.clients))
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
+				h.remove(client)
 				close(client.send)
+				h.audit.record("disconnect", client, "reason", "closed by client")
+				client.logger.Info("Client disconnected", "clients", len(h.clients))
+			}
+		case chat := <-h.chat:
+			h.relay(chat)
+		case fields := <-h.fields:
+			h.setFields(fields)
+		case request := <-h.kick:
+			h.kickMatching(request)
+		case request := <-h.find:
+			request.done <- h.matching(request.match)
+		case message := <-h.direct:
+			if _, ok := h.clients[message.client]; ok {
+				h.deliver(message.client, message.Message)
 			}
-		case message := <-h.broadcast:
+		case snapshot := <-h.broadcast:
+			h.frames++
+			h.deliverEvents(snapshot)
+			h.deliverQuotas(snapshot)
+			audience := Audience{Players: len(h.clients) - h.spectating, Spectators: h.spectating}
+			cache := newFrameCache(snapshot, audience, h.aoi)
+			now := time.Now()
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if h.frames%uint64(client.sendEvery.Load()) != 0 {
+					continue
 				}
+
+				rate := effectiveRate(client.bytesPerSecond.Load(), h.bandwidth)
+				data, err := budgetFrame(cache, client.viewport.Load(), client.format, client.budget, rate, now)
+				if err != nil {
+					client.logger.Error("Error encoding frame", "err", err)
+					continue
+				}
+
+				if data == nil {
+					client.dropLog.log(client.logger, slog.LevelDebug, "Skipping frame over bandwidth budget", "rate", rate)
+					continue
+				}
+
+				h.deliverFrame(client, Message{kind: client.format.kind(), data: data})
 			}
 		}
 	}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+func TestHubSendTiers(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	go hub.run()
+
+	high := newClient(hub, nil, "high")
+	low := newClient(hub, nil, "low")
+	low.setSendTier("low")
+	hub.register <- high
+	hub.register <- low
+
+	highFrames, lowFrames := 0, 0
+	for i := 0; i < 8; i++ {
+		broadcast <- &Snapshot{Tick: uint64(i)}
+
+		// run has finished with the last broadcast once it accepts another register
+		hub.register <- newClient(hub, nil, "sync")
+
+		highFrames += len(high.frame)
+		lowFrames += len(low.frame)
+		drainFrame(high)
+		drainFrame(low)
+	}
+
+	if highFrames != 8 {
+		t.Errorf("High tier client received %v frames, expected %v", highFrames, 8)
+	}
+
+	if lowFrames != 2 {
+		t.Errorf("Low tier client received %v frames, expected %v", lowFrames, 2)
+	}
+}
+
+func drainFrame(client *Client) {
+	select {
+	case <-client.frame:
+	default:
+	}
+}
+
+func TestHubCoalescesFrames(t *testing.T) {
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.slowFrames = 0
+
+	// nothing reads from the client, as if its connection had stalled
+	client := newClient(hub, nil, "stalled")
+	hub.clients[client] = true
+
+	for i := 0; i < 10; i++ {
+		hub.deliverFrame(client, Message{kind: websocket.BinaryMessage, data: []byte{byte(i)}})
+		hub.deliver(client, Message{kind: websocket.TextMessage, data: []byte{byte(i)}})
+	}
+
+	if len(client.frame) != 1 {
+		t.Fatalf("Client has %v pending frames, expected %v", len(client.frame), 1)
+	}
+
+	if frame := <-client.frame; frame.data[0] != 9 {
+		t.Errorf("Pending frame is %v, expected the latest frame %v", frame.data[0], 9)
+	}
+
+	if len(client.send) != 10 {
+		t.Errorf("Client has %v pending control messages, expected %v", len(client.send), 10)
+	}
+}
+
+func TestHubSlowReader(t *testing.T) {
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.slowFrames = 0
+	client := newClient(hub, nil, "slow")
+	hub.clients[client] = true
+
+	frames := make(chan byte, 100)
+	controls := make(chan byte, 100)
+	go func() {
+		for {
+			select {
+			case message := <-client.send:
+				controls <- message.data[0]
+			case message := <-client.frame:
+				frames <- message.data[0]
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		hub.deliverFrame(client, Message{kind: websocket.BinaryMessage, data: []byte{byte(i)}})
+		if i%5 == 0 {
+			hub.deliver(client, Message{kind: websocket.TextMessage, data: []byte{byte(i)}})
+		}
+	}
+
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for last := byte(0); last != 49; received++ {
+		select {
+		case last = <-frames:
+		case <-timeout:
+			t.Fatalf("Slow reader did not receive the latest frame")
+		}
+	}
+
+	if received >= 50 {
+		t.Errorf("Slow reader received %v frames, expected fewer than %v", received, 50)
+	}
+
+	for i := 0; i < 50; i += 5 {
+		select {
+		case control := <-controls:
+			if control != byte(i) {
+				t.Errorf("Control message is %v, expected %v", control, i)
+			}
+		case <-timeout:
+			t.Fatalf("Slow reader did not receive control message %v", i)
+		}
+	}
+}
+
+func TestHubSlowClientDowngrade(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	hub.slowFrames = 4
+	go hub.run()
+
+	client := newClient(hub, nil, "stalled")
+	hub.register <- client
+
+	tiers := []string{}
+	for i := 1; i <= 100; i++ {
+		broadcast <- &Snapshot{Tick: uint64(i)}
+		hub.register <- newClient(hub, nil, "sync")
+
+		for len(client.send) > 0 {
+			message := <-client.send
+			rate := RateMessage{}
+			if err := json.Unmarshal(message.data, &rate); err != nil {
+				t.Fatalf("Error unmarshalling control message %v", err)
+			}
+
+			if rate.Type == MessageTypeRate {
+				tiers = append(tiers, rate.Tier)
+			}
+		}
+
+		if reason := client.closeReason.Load(); reason != nil {
+			break
+		}
+	}
+
+	if len(tiers) != 2 || tiers[0] != "medium" || tiers[1] != "low" {
+		t.Errorf("Client was moved to tiers %v, expected %v", tiers, []string{"medium", "low"})
+	}
+
+	reason := client.closeReason.Load()
+	if reason == nil {
+		t.Fatalf("Slow client was not disconnected")
+	}
+
+	if reason.code != websocket.CloseTryAgainLater {
+		t.Errorf("Close code is %v, expected %v", reason.code, websocket.CloseTryAgainLater)
+	}
+
+	for len(client.send) > 0 {
+		<-client.send
+	}
+
+	if _, ok := <-client.send; ok {
+		t.Errorf("Client send channel is open, expected it to be closed")
+	}
+}
+
+// nextReply returns the next message queued for a client with the given
+// type, skipping chat and anything else sent to every client
+func nextReply(t *testing.T, client *Client, kind string) Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-client.send:
+			control := ControlMessage{}
+			if err := json.Unmarshal(message.data, &control); err != nil {
+				t.Fatalf("Error unmarshalling control message %v", err)
+			}
+
+			if control.Type == kind {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("Client did not receive a %v message", kind)
+		}
+	}
+}
+
+func TestClientCloseReason(t *testing.T) {
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	clients := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading connection %v", err)
+			return
+		}
+
+		client := newClient(hub, conn, "test")
+		go client.writePump()
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Error dialing test server %v", err)
+	}
+	defer conn.Close()
+
+	client := <-clients
+	hub.clients[client] = true
+	hub.drop(client, websocket.CloseTryAgainLater, "client too slow")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Read error is %v, expected a close error", err)
+	}
+
+	if closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "client too slow" {
+		t.Errorf("Close is %v %v, expected %v %v", closeErr.Code, closeErr.Text, websocket.CloseTryAgainLater, "client too slow")
+	}
+}
+
+func TestHubRateMessage(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	handleControlMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"rate","tier":"medium"}`)}})
+	if every := client.sendEvery.Load(); every != sendTiers["medium"] {
+		t.Errorf("Client sendEvery is %v, expected %v", every, sendTiers["medium"])
+	}
+
+	go handleControlMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"rate","tier":"warp"}`)}})
+	reply := nextReply(t, client, MessageTypeError)
+	if reply.kind != websocket.TextMessage {
+		t.Errorf("Reply kind is %v, expected %v", reply.kind, websocket.TextMessage)
+	}
+
+	if every := client.sendEvery.Load(); every != sendTiers["medium"] {
+		t.Errorf("Client sendEvery after invalid tier is %v, expected %v", every, sendTiers["medium"])
+	}
+}
+
+// readJoin reads the chat message announcing a new connection
+func readJoin(t *testing.T, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Error reading join message %v", err)
+	}
+
+	chat := ChatMessage{}
+	if err := json.Unmarshal(data, &chat); err != nil || !chat.System {
+		t.Fatalf("First message is %s, expected a system chat message", data)
+	}
+}
+
+func TestHubSubprotocols(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	hub.chatConfig.HistorySize = 0
+	go hub.run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		subprotocols []string
+		expected     string
+		kind         int
+	}{
+		{nil, "", websocket.BinaryMessage},
+		{[]string{"galaxy.unknown"}, "", websocket.BinaryMessage},
+		{[]string{SubprotocolBinary}, SubprotocolBinary, websocket.BinaryMessage},
+		{[]string{SubprotocolJSON}, SubprotocolJSON, websocket.TextMessage},
+	}
+
+	for _, test := range tests {
+		dialer := websocket.Dialer{Subprotocols: test.subprotocols}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Error dialing test server %v", err)
+		}
+
+		if conn.Subprotocol() != test.expected {
+			t.Errorf("Negotiated subprotocol is %v, expected %v", conn.Subprotocol(), test.expected)
+		}
+
+		for hub.clientCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// legacy clients are only sent frames, so no join message either
+		if len(test.expected) > 0 {
+			readJoin(t, conn)
+		}
+		broadcast <- createAOISnapshot()
+
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading frame %v", err)
+		}
+
+		if kind != test.kind {
+			t.Errorf("Frame kind for %v is %v, expected %v", test.subprotocols, kind, test.kind)
+		}
+
+		if kind == websocket.TextMessage {
+			frame := FrameData{}
+			if err := json.Unmarshal(data, &frame); err != nil || len(frame.D) != 4 {
+				t.Errorf("JSON frame has %v bodies, expected %v (%v)", len(frame.D), 4, err)
+			}
+		} else if len(test.expected) == 0 {
+			if len(data) != LegacyFrameHeaderBytes+4*sim.BodyPacketBytes || binary.LittleEndian.Uint16(data) != 1 {
+				t.Errorf("Legacy frame is %v bytes for %v players, expected %v bytes for %v", len(data), binary.LittleEndian.Uint16(data), LegacyFrameHeaderBytes+4*sim.BodyPacketBytes, 1)
+			}
+		} else if ids := readFrameIDs(t, data); len(ids) != 4 {
+			t.Errorf("Binary frame has %v bodies, expected %v", len(ids), 4)
+		}
+
+		conn.Close()
+		for hub.clientCount() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestHubSpectators(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	go hub.run()
+
+	player := newClient(hub, nil, "player")
+	spectator := newClient(hub, nil, "spectator")
+	spectator.spectator = true
+	hub.register <- player
+	hub.register <- spectator
+
+	broadcast <- &Snapshot{Tick: 1}
+	hub.register <- newClient(hub, nil, "sync")
+
+	reader := bytes.NewReader((<-spectator.frame).data)
+	header := FrameHeader{}
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Error binary reading header from packet %v", err)
+	}
+
+	// the sync client is a player registered after the broadcast
+	if header.Players != 1 || header.Spectators != 1 {
+		t.Errorf("Frame players and spectators are %v and %v, expected %v and %v", header.Players, header.Spectators, 1, 1)
+	}
+
+	// the counts are published when run loops after handling the unregister
+	hub.unregister <- spectator
+	deadline := time.Now().Add(5 * time.Second)
+	for audience := hub.audience(); audience.Players != 2 || audience.Spectators != 0; audience = hub.audience() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Hub audience is %v, expected %v players and %v spectators", audience, 2, 0)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubEvents(t *testing.T) {
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	go hub.run()
+
+	// events are delivered even when the client's send tier skips the frame
+	client := newClient(hub, nil, "low")
+	client.setSendTier("low")
+	hub.register <- client
+
+	into := uint16(1)
+	broadcast <- &Snapshot{Tick: 1, Events: []sim.Event{{Kind: sim.EventMerged, Tick: 1, Body: 2, Into: &into, Speed: 3}}}
+
+	events := EventsMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeEvents).data, &events); err != nil {
+		t.Fatalf("Error unmarshalling events message %v", err)
+	}
+
+	if events.Tick != 1 || len(events.Events) != 1 {
+		t.Fatalf("Events message is %+v, expected %v event at tick %v", events, 1, 1)
+	}
+
+	event := events.Events[0]
+	if event.Kind != sim.EventMerged || event.Body != 2 || event.Into == nil || *event.Into != 1 || event.Speed != 3 {
+		t.Errorf("Event is %+v, expected body %v merged into %v at speed %v", event, 2, 1, 3)
+	}
+
+	if len(client.frame) != 0 {
+		t.Errorf("Low tier client has %v frames queued, expected %v", len(client.frame), 0)
+	}
+}
+
+func TestHubSpectatorCapacity(t *testing.T) {
+	tests := []struct {
+		query    string
+		audience Audience
+		spectate bool
+		ok       bool
+		full     bool
+	}{
+		{"", Audience{Players: 1, Spectators: 5}, false, true, false},
+		{"mode=play", Audience{Players: 2, Spectators: 0}, false, true, true},
+		{"mode=spectate", Audience{Players: 2, Spectators: 4}, true, true, false},
+		{"mode=spectate", Audience{Players: 0, Spectators: 5}, true, true, true},
+		{"mode=admin", Audience{}, false, false, false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ws?"+test.query, nil)
+		spectate, ok := isSpectateRequest(request)
+		if spectate != test.spectate || ok != test.ok {
+			t.Errorf("isSpectateRequest(%v) is %v, %v, expected %v, %v", test.query, spectate, ok, test.spectate, test.ok)
+		}
+
+		if ok && atCapacity(test.audience, spectate, 2, 5) != test.full {
+			t.Errorf("atCapacity(%v, %v) is %v, expected %v", test.audience, spectate, !test.full, test.full)
+		}
+	}
+}
+
+func TestHubLegacyTextMessages(t *testing.T) {
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	client := newClient(hub, nil, "legacy")
+	client.format = formatLegacy
+
+	text, _ := newTextMessage(systemChat("hello"))
+	hub.deliver(client, text)
+	hub.deliver(client, Message{kind: websocket.BinaryMessage, data: []byte{1}})
+
+	if len(client.send) != 1 {
+		t.Fatalf("Legacy client has %v queued messages, expected %v", len(client.send), 1)
+	}
+
+	if message := <-client.send; message.kind != websocket.BinaryMessage {
+		t.Errorf("Legacy client was sent a message of kind %v, expected %v", message.kind, websocket.BinaryMessage)
+	}
+}
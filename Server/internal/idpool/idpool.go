@@ -25,6 +25,12 @@ func (pool *IDPool) EnqueueId(value uint16) {
 	pool.pool = append(pool.pool, value)
 }
 
+// Clone returns a copy of the pool that can be dequeued from without
+// affecting the original
+func (pool *IDPool) Clone() IDPool {
+	return IDPool{step: pool.step, size: pool.size, pool: append([]uint16(nil), pool.pool...)}
+}
+
 func (pool *IDPool) AddStep() {
 	newArr := make([]uint16, pool.step)
 	for i := 0; i < pool.step; i++ {
@@ -84,3 +84,23 @@ func TestIdPoolStep(t *testing.T) {
 		t.Errorf("IDPool third Dequeue value is %v, expected %v", id, expectedId)
 	}
 }
+
+func TestIdPoolClone(t *testing.T) {
+	idPool := NewIDPool(1, 1)
+	clone := idPool.Clone()
+
+	clone.DequeueId()
+	clone.DequeueId()
+
+	id := idPool.DequeueId()
+	expectedId := uint16(0)
+	if id != expectedId {
+		t.Errorf("IDPool Dequeue after clone value is %v, expected %v", id, expectedId)
+	}
+
+	id = idPool.DequeueId()
+	expectedId = 1
+	if id != expectedId {
+		t.Errorf("IDPool second Dequeue after clone value is %v, expected %v", id, expectedId)
+	}
+}
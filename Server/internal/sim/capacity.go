@@ -0,0 +1,138 @@
+package sim
+
+import "fmt"
+
+// CapacityPolicy decides what happens to a spawn when the simulation is full
+type CapacityPolicy string
+
+const (
+	// CapacityReject refuses the spawn
+	CapacityReject CapacityPolicy = "reject"
+	// CapacityEvictOldest removes the body that has been alive the longest
+	CapacityEvictOldest CapacityPolicy = "evict_oldest"
+	// CapacityEvictSmallest removes the body with the smallest radius
+	CapacityEvictSmallest CapacityPolicy = "evict_smallest"
+	// CapacityEvictOwnOldest removes the spawning player's oldest body and
+	// refuses the spawn when the player has none
+	CapacityEvictOwnOldest CapacityPolicy = "evict_own_oldest"
+)
+
+// ParseCapacityPolicy checks that value names one of the capacity policies
+func ParseCapacityPolicy(value string) (CapacityPolicy, error) {
+	switch policy := CapacityPolicy(value); policy {
+	case CapacityReject, CapacityEvictOldest, CapacityEvictSmallest, CapacityEvictOwnOldest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown capacity policy %q", value)
+	}
+}
+
+// LifetimeRules limit how long bodies stay in the simulation, every rule is
+// disabled when 0
+type LifetimeRules struct {
+	// TTL is how many seconds a body lives before it is removed
+	TTL float32
+
+	// Bodies with a radius below DecayRadius lose DecayRate of their mass and
+	// radius per second and are removed once smaller than MinRadius
+	DecayRadius float32
+	DecayRate   float32
+	MinRadius   float32
+}
+
+// SpawnResult is the body added by a spawn and any bodies evicted for it
+type SpawnResult struct {
+	ID      uint16
+	Evicted []uint16
+
+	// Parent is the body an orbit assisted spawn was put in orbit around
+	Parent *uint16
+}
+
+// Removal reasons of the lifetime and capacity rules
+const (
+	RemovedExpired RemoveReason = "expired"
+	RemovedDecayed RemoveReason = "decayed"
+	RemovedEvicted RemoveReason = "evicted"
+)
+
+// bodyLimit returns the number of bodies that fit in the simulation
+func (simState *SimulationState) bodyLimit() int {
+	limit := cap(simState.Bodies)
+	if simState.BodyLimit > 0 && simState.BodyLimit < limit {
+		limit = simState.BodyLimit
+	}
+	return limit
+}
+
+// makeRoom evicts a body for a spawn by owner according to the capacity
+// policy, returning the evicted id or false when the spawn must be refused
+func makeRoom(simState *SimulationState, owner uint64) (uint16, bool) {
+	// evicting more than one body per spawn would empty the world while the
+	// limit is lowered for load shedding
+	if len(simState.Bodies) > simState.bodyLimit() {
+		return 0, false
+	}
+
+	victim := -1
+	switch simState.Capacity {
+	case CapacityEvictOldest:
+		if len(simState.Bodies) > 0 {
+			victim = 0
+		}
+	case CapacityEvictSmallest:
+		for i := range simState.Bodies {
+			if victim < 0 || simState.Bodies[i].R < simState.Bodies[victim].R {
+				victim = i
+			}
+		}
+	case CapacityEvictOwnOldest:
+		for i := range simState.Bodies {
+			if owner != 0 && simState.Bodies[i].Owner == owner {
+				victim = i
+				break
+			}
+		}
+	}
+
+	if victim < 0 {
+		return 0, false
+	}
+
+	// bodies are kept in spawn order so removing one keeps the rest in order
+	body := simState.Bodies[victim]
+	simState.Bodies = append(simState.Bodies[:victim], simState.Bodies[victim+1:]...)
+	simState.emit(Event{Kind: EventRemoved, Body: body.I, Reason: RemovedEvicted, P: body.P, Owner: body.Owner})
+	return body.I, true
+}
+
+// applyLifetime ages every body by deltaTime, removing expired bodies and
+// shrinking small ones
+func applyLifetime(simState *SimulationState, deltaTime float32) {
+	rules := simState.Lifetime
+	remaining := simState.Bodies[:0]
+	for _, body := range simState.Bodies {
+		body.Age += deltaTime
+		if rules.TTL > 0 && body.Age >= rules.TTL {
+			simState.emit(Event{Kind: EventRemoved, Body: body.I, Reason: RemovedExpired, P: body.P, Owner: body.Owner})
+			continue
+		}
+
+		if rules.DecayRate > 0 && body.R < rules.DecayRadius {
+			factor := 1 - rules.DecayRate*deltaTime
+			if factor < 0 {
+				factor = 0
+			}
+			body.R *= factor
+			body.M *= factor
+
+			if body.R < rules.MinRadius || body.R <= 0 {
+				simState.emit(Event{Kind: EventRemoved, Body: body.I, Reason: RemovedDecayed, P: body.P, Owner: body.Owner})
+				continue
+			}
+		}
+
+		remaining = append(remaining, body)
+	}
+	simState.Bodies = remaining
+}
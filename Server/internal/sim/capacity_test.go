@@ -0,0 +1,111 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func createFullState(policy CapacityPolicy) *SimulationState {
+	state := CreateEmptySimulationState(3, 0, 1, 1, 100, 100, 1)
+	state.Capacity = policy
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{0, 0}, R: 2, Owner: 1})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{10, 0}, R: 0.5, Owner: 2})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{20, 0}, R: 1, Owner: 2})
+	return state
+}
+
+func TestCapacityUsesEverySlot(t *testing.T) {
+	state := createFullState(CapacityReject)
+	if len(state.Bodies) != 3 {
+		t.Fatalf("Simulation has %v bodies, expected %v", len(state.Bodies), 3)
+	}
+
+	if _, err := AddSimulationBody(state, BodyData{R: 1}); err != ErrSimulationFull {
+		t.Errorf("Spawn into a full simulation error is %v, expected %v", err, ErrSimulationFull)
+	}
+}
+
+func TestCapacityEviction(t *testing.T) {
+	tests := []struct {
+		policy  CapacityPolicy
+		owner   uint64
+		evicted uint16
+	}{
+		{CapacityEvictOldest, 1, 0},
+		{CapacityEvictSmallest, 1, 1},
+		{CapacityEvictOwnOldest, 2, 1},
+	}
+
+	for _, test := range tests {
+		state := createFullState(test.policy)
+		result, err := SpawnSimulationBody(state, BodyData{P: mgl32.Vec2{30, 0}, R: 1, Owner: test.owner})
+		if err != nil {
+			t.Errorf("%v spawn error is %v, expected nil", test.policy, err)
+			continue
+		}
+
+		if len(result.Evicted) != 1 || result.Evicted[0] != test.evicted {
+			t.Errorf("%v evicted %v, expected [%v]", test.policy, result.Evicted, test.evicted)
+		}
+
+		if len(state.Bodies) != 3 || state.Bodies[2].I != result.ID {
+			t.Errorf("%v bodies are %v, expected the new body last of %v", test.policy, state.Bodies, 3)
+		}
+	}
+
+	// players without bodies of their own can not evict anything
+	state := createFullState(CapacityEvictOwnOldest)
+	if _, err := AddSimulationBody(state, BodyData{R: 1, Owner: 3}); err != ErrSimulationFull {
+		t.Errorf("Spawn without own bodies error is %v, expected %v", err, ErrSimulationFull)
+	}
+}
+
+func TestParseCapacityPolicy(t *testing.T) {
+	if policy, err := ParseCapacityPolicy("evict_smallest"); err != nil || policy != CapacityEvictSmallest {
+		t.Errorf("ParseCapacityPolicy is %v, %v, expected %v", policy, err, CapacityEvictSmallest)
+	}
+
+	if _, err := ParseCapacityPolicy("evict_everyone"); err == nil {
+		t.Errorf("ParseCapacityPolicy error is nil, expected an error")
+	}
+}
+
+func TestLifetimeExpiry(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	state.Lifetime.TTL = 1
+	id, _ := AddSimulationBody(state, BodyData{R: 1})
+	state.PublishEvents(0)
+
+	UpdateSimulationState(state, 0.6)
+	if len(state.Bodies) != 1 {
+		t.Fatalf("Simulation has %v bodies before the TTL, expected %v", len(state.Bodies), 1)
+	}
+
+	UpdateSimulationState(state, 0.6)
+	if len(state.Bodies) != 0 {
+		t.Errorf("Simulation has %v bodies after the TTL, expected %v", len(state.Bodies), 0)
+	}
+
+	events := publishedEvents(state, 2)
+	if len(events) != 1 || events[0].Body != id || events[0].Reason != RemovedExpired {
+		t.Errorf("Published events are %+v, expected body %v %v", events, id, RemovedExpired)
+	}
+}
+
+func TestLifetimeDecay(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	state.Lifetime = LifetimeRules{DecayRadius: 1, DecayRate: 0.5, MinRadius: 0.2}
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{0, 0}, R: 0.5})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{50, 0}, R: 2})
+
+	UpdateSimulationState(state, 1)
+	if len(state.Bodies) != 2 || state.Bodies[0].R != 0.25 || state.Bodies[1].R != 2 {
+		t.Fatalf("Bodies are %v, expected only the small one to halve", state.Bodies)
+	}
+
+	UpdateSimulationState(state, 1)
+	if len(state.Bodies) != 1 || state.Bodies[0].R != 2 {
+		t.Errorf("Bodies are %v, expected the decayed body to be removed", state.Bodies)
+	}
+}
@@ -0,0 +1,47 @@
+package sim
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// sweptCircleImpact finds the earliest fraction of the step [0, 1] at which two
+// circles moving linearly from a0 to a1 and b0 to b1 come within radius of each
+// other, returning false if they never touch during the step
+func sweptCircleImpact(a0 mgl32.Vec2, a1 mgl32.Vec2, b0 mgl32.Vec2, b1 mgl32.Vec2, radius float32) (float32, bool) {
+	// work in the frame of b so only a relative motion is swept
+	start := a0.Sub(b0)
+	motion := a1.Sub(a0).Sub(b1.Sub(b0))
+
+	c := start.Dot(start) - radius*radius
+	if c < 0 {
+		// already overlapping at the start of the step
+		return 0, true
+	}
+
+	a := motion.Dot(motion)
+	if a == 0 {
+		return 0, false
+	}
+
+	b := start.Dot(motion)
+	if b >= 0 {
+		// moving apart or sliding past
+		return 0, false
+	}
+
+	disc := b*b - a*c
+	if disc <= 0 {
+		return 0, false
+	}
+
+	t := (-b - sqrt32(disc)) / a
+	if t < 0 || t > 1 {
+		return 0, false
+	}
+
+	return t, true
+}
+
+// impactPosition is where a body moving linearly from p0 to p1 is at the
+// fraction t of the step
+func impactPosition(p0 mgl32.Vec2, p1 mgl32.Vec2, t float32) mgl32.Vec2 {
+	return p0.Add(p1.Sub(p0).Mul(t))
+}
@@ -0,0 +1,127 @@
+package sim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/idpool"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestSweptCircleImpact(t *testing.T) {
+	// a passes straight through b, touching when 8 units along its 20 unit step
+	toi, hit := sweptCircleImpact(mgl32.Vec2{-10, 0}, mgl32.Vec2{10, 0}, mgl32.Vec2{0, 0}, mgl32.Vec2{0, 0}, 2)
+	if !hit {
+		t.Fatalf("Swept impact hit is %v, expected %v", hit, true)
+	}
+
+	if math.Abs(float64(toi-0.4)) > 0.0001 {
+		t.Errorf("Swept impact time is %f, expected %f", toi, 0.4)
+	}
+
+	// a passes above b without touching
+	_, hit = sweptCircleImpact(mgl32.Vec2{-10, 3}, mgl32.Vec2{10, 3}, mgl32.Vec2{0, 0}, mgl32.Vec2{0, 0}, 2)
+	if hit {
+		t.Errorf("Swept impact miss hit is %v, expected %v", hit, false)
+	}
+
+	// a stops short of b
+	_, hit = sweptCircleImpact(mgl32.Vec2{-10, 0}, mgl32.Vec2{-5, 0}, mgl32.Vec2{0, 0}, mgl32.Vec2{0, 0}, 2)
+	if hit {
+		t.Errorf("Swept impact short hit is %v, expected %v", hit, false)
+	}
+
+	// a and b move towards each other and cross mid step
+	_, hit = sweptCircleImpact(mgl32.Vec2{-5, 0}, mgl32.Vec2{5, 0}, mgl32.Vec2{5, 0}, mgl32.Vec2{-5, 0}, 1)
+	if !hit {
+		t.Errorf("Swept impact crossing hit is %v, expected %v", hit, true)
+	}
+
+	// a and b start overlapping
+	toi, hit = sweptCircleImpact(mgl32.Vec2{0, 0}, mgl32.Vec2{0, 0}, mgl32.Vec2{0.5, 0}, mgl32.Vec2{0.5, 0}, 1)
+	if !hit || toi != 0 {
+		t.Errorf("Swept impact overlap is %v at %f, expected %v at %f", hit, toi, true, 0.0)
+	}
+}
+
+func createTunnelSimulationState(continuous bool, offset mgl32.Vec2, velocity mgl32.Vec2) *SimulationState {
+	bodies := make([]BodyData, 2, 2)
+	bodies[0] = BodyData{
+		I: idpool.NewID(0),
+		P: mgl32.Vec2{0, 0},
+		V: mgl32.Vec2{0, 0},
+		M: 100,
+		R: 2,
+		T: 0,
+	}
+
+	bodies[1] = BodyData{
+		I: idpool.NewID(1),
+		P: offset,
+		V: velocity,
+		M: 1,
+		R: 0.25,
+		T: 0,
+	}
+
+	return &SimulationState{
+		GravityConstant:     0,
+		TimeScale:           3.75,
+		MaxVelocity:         50,
+		Bounds:              100,
+		ContinuousCollision: continuous,
+		Bodies:              bodies,
+		IdPool:              idpool.NewIDPool(2, 2),
+	}
+}
+
+func TestContinuousCollisionFastBodies(t *testing.T) {
+	deltaTime := float32(0.05)
+	speed := float32(50)
+
+	for angle := 0; angle < 360; angle += 15 {
+		rad := float64(angle) * math.Pi / 180
+		direction := mgl32.Vec2{float32(math.Cos(rad)), float32(math.Sin(rad))}
+
+		for _, lateral := range []float32{0, 0.5, 1, 2} {
+			// start just outside the large body, aimed to pass through it within one step
+			normal := mgl32.Vec2{-direction.Y(), direction.X()}
+			offset := direction.Mul(-3).Add(normal.Mul(lateral))
+			simState := createTunnelSimulationState(true, offset, direction.Mul(speed))
+
+			UpdateSimulationState(simState, deltaTime)
+
+			if len(simState.Bodies) != 1 {
+				t.Errorf("len(Bodies) at angle %v lateral %v is %v, expected %v", angle, lateral, len(simState.Bodies), 1)
+				continue
+			}
+
+			if simState.Bodies[0].I != idpool.NewID(0) {
+				t.Errorf("Remaining body at angle %v lateral %v is %v, expected %v", angle, lateral, simState.Bodies[0].I, idpool.NewID(0))
+			}
+		}
+	}
+}
+
+func TestDiscreteCollisionTunnels(t *testing.T) {
+	deltaTime := float32(0.05)
+
+	// the small body moves over 9 units per step, jumping over the large body entirely
+	simState := createTunnelSimulationState(false, mgl32.Vec2{-3, 0}, mgl32.Vec2{50, 0})
+	UpdateSimulationState(simState, deltaTime)
+
+	if len(simState.Bodies) != 2 {
+		t.Errorf("len(Bodies) is %v, expected %v", len(simState.Bodies), 2)
+	}
+}
+
+func TestContinuousCollisionMiss(t *testing.T) {
+	deltaTime := float32(0.05)
+
+	simState := createTunnelSimulationState(true, mgl32.Vec2{-3, 2.5}, mgl32.Vec2{50, 0})
+	UpdateSimulationState(simState, deltaTime)
+
+	if len(simState.Bodies) != 2 {
+		t.Errorf("len(Bodies) is %v, expected %v", len(simState.Bodies), 2)
+	}
+}
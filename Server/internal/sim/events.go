@@ -0,0 +1,192 @@
+package sim
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// EventKind names something that happened to a body during the simulation
+type EventKind string
+
+const (
+	EventSpawned EventKind = "spawned"
+	EventMerged  EventKind = "merged"
+	EventEscaped EventKind = "escaped"
+	EventRemoved EventKind = "removed"
+)
+
+// RemoveReason tells why a body was removed outside of merges and escapes
+type RemoveReason string
+
+const (
+	RemovedByAdmin RemoveReason = "admin"
+	RemovedInvalid RemoveReason = "invalid"
+
+	// RemovedByCollision is used for bodies destroyed by a collision hook
+	RemovedByCollision RemoveReason = "collision"
+
+	// RemovedByOwner is used for bodies the player that spawned them removed
+	RemovedByOwner RemoveReason = "owner"
+)
+
+// Event is a single change to a body, merges carry the body it was absorbed
+// into and the relative speed of the impact
+type Event struct {
+	Kind   EventKind    `json:"kind"`
+	Tick   uint64       `json:"tick"`
+	Body   uint16       `json:"body"`
+	Into   *uint16      `json:"into,omitempty"`
+	Speed  float32      `json:"speed,omitempty"`
+	Reason RemoveReason `json:"reason,omitempty"`
+	P      mgl32.Vec2   `json:"p"`
+
+	// connection that spawned the body, 0 for none, never sent to clients
+	Owner uint64 `json:"-"`
+}
+
+// maxHeldEvents is how many events may be held back for a subscriber whose
+// channel is full before new batches are dropped for it
+const maxHeldEvents = 4096
+
+// droppedLogInterval is the least time between warnings about dropped
+// events, drops in between are summed into the next one
+const droppedLogInterval = 10 * time.Second
+
+// eventBus holds the events of the tick in progress and the subscribers they
+// are published to once the tick completes
+type eventBus struct {
+	// events since the last publish, guarded by the simulation lock
+	pending []Event
+
+	mu          sync.Mutex
+	next        int
+	subscribers map[int]*subscriber
+	dropped     uint64
+
+	lastDropLog     time.Time
+	unloggedDropped uint64
+}
+
+// subscriber is a channel events are published to and the events that did
+// not fit in it yet, which are sent ahead of the next batch
+type subscriber struct {
+	events chan []Event
+	held   []Event
+}
+
+// emit queues an event for the current tick, the caller must hold the
+// simulation lock. Every removal emits exactly one event so this is also
+// where the ids of removed bodies are released.
+func (simState *SimulationState) emit(event Event) {
+	simState.events.pending = append(simState.events.pending, event)
+	if event.Kind != EventSpawned {
+		simState.releaseId(event.Body)
+	}
+}
+
+// Subscribe returns a channel receiving the events of every tick that had
+// any. When the channel is full events are held back and merged into the next
+// batch sent rather than blocking the simulation, they are only dropped once
+// maxHeldEvents are held. Batches are shared between subscribers and must not
+// be modified, cancel stops delivery and closes the channel.
+func (simState *SimulationState) Subscribe(buffer int) (<-chan []Event, func()) {
+	bus := &simState.events
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[int]*subscriber)
+	}
+
+	id := bus.next
+	bus.next++
+	events := make(chan []Event, buffer)
+	bus.subscribers[id] = &subscriber{events: events}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			defer bus.mu.Unlock()
+			delete(bus.subscribers, id)
+			close(events)
+		})
+	}
+	return events, cancel
+}
+
+// DroppedEvents returns the number of event batches dropped because a
+// subscriber was not keeping up
+func (simState *SimulationState) DroppedEvents() uint64 {
+	simState.events.mu.Lock()
+	defer simState.events.mu.Unlock()
+	return simState.events.dropped
+}
+
+// PublishEvents stamps the events collected since the last call with tick
+// and sends them to every subscriber, along with any held back for it
+func (simState *SimulationState) PublishEvents(tick uint64) {
+	simState.Mu.Lock()
+	batch := simState.events.pending
+	simState.events.pending = nil
+	simState.Mu.Unlock()
+
+	for i := range batch {
+		batch[i].Tick = tick
+	}
+
+	bus := &simState.events
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for _, subscriber := range bus.subscribers {
+		bus.publish(subscriber, batch, tick)
+	}
+}
+
+// publish sends batch to a subscriber or holds it back when the channel is
+// full, the caller must hold mu
+func (bus *eventBus) publish(subscriber *subscriber, batch []Event, tick uint64) {
+	if len(batch) == 0 && len(subscriber.held) == 0 {
+		return
+	}
+
+	// held events are owned by the subscriber so the batch can be appended
+	events := batch
+	if len(subscriber.held) > 0 {
+		events = append(subscriber.held, batch...)
+	}
+
+	select {
+	case subscriber.events <- events:
+		subscriber.held = nil
+		return
+	default:
+	}
+
+	if len(events) > maxHeldEvents {
+		bus.dropped++
+		bus.logDropped(tick, len(batch))
+	} else if len(subscriber.held) > 0 {
+		subscriber.held = events
+	} else {
+		subscriber.held = append([]Event(nil), batch...)
+	}
+}
+
+// logDropped warns about dropped events at most once per
+// droppedLogInterval, the caller must hold mu
+func (bus *eventBus) logDropped(tick uint64, events int) {
+	bus.unloggedDropped += uint64(events)
+
+	now := time.Now()
+	if !bus.lastDropLog.IsZero() && now.Sub(bus.lastDropLog) < droppedLogInterval {
+		return
+	}
+
+	slog.Warn("Dropping simulation events for slow subscriber", "tick", tick, "events", bus.unloggedDropped, "totalBatches", bus.dropped)
+	bus.lastDropLog = now
+	bus.unloggedDropped = 0
+}
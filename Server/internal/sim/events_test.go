@@ -0,0 +1,138 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func publishedEvents(state *SimulationState, tick uint64) []Event {
+	events, cancel := state.Subscribe(1)
+	defer cancel()
+
+	state.PublishEvents(tick)
+	select {
+	case batch := <-events:
+		return batch
+	default:
+		return nil
+	}
+}
+
+func TestSpawnEvent(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 1, 10, 100, 1)
+	id, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{1, 2}, R: 1, Owner: 3})
+
+	events := publishedEvents(state, 5)
+	if len(events) != 1 {
+		t.Fatalf("Published %v events, expected %v", len(events), 1)
+	}
+
+	event := events[0]
+	if event.Kind != EventSpawned || event.Body != id || event.Owner != 3 || event.Tick != 5 {
+		t.Errorf("Spawn event is %+v, expected body %v owner %v at tick %v", event, id, 3, 5)
+	}
+}
+
+func TestMergeEvent(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	big, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{0, 0}, V: mgl32.Vec2{1, 0}, R: 2})
+	small, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{1, 0}, V: mgl32.Vec2{-2, 0}, R: 1})
+	state.PublishEvents(0)
+
+	UpdateSimulationState(state, 0.01)
+	events := publishedEvents(state, 1)
+	if len(events) != 1 {
+		t.Fatalf("Published %v events, expected %v", len(events), 1)
+	}
+
+	event := events[0]
+	if event.Kind != EventMerged || event.Body != small || event.Into == nil || *event.Into != big {
+		t.Fatalf("Merge event is %+v, expected body %v into %v", event, small, big)
+	}
+
+	if event.Speed < 2.9 || event.Speed > 3.1 {
+		t.Errorf("Merge event speed is %v, expected %v", event.Speed, 3)
+	}
+}
+
+func TestEscapeEvent(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 10, 1)
+	id, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{9.5, 0}, V: mgl32.Vec2{100, 0}, R: 1})
+	state.PublishEvents(0)
+
+	UpdateSimulationState(state, 0.1)
+	events := publishedEvents(state, 1)
+	if len(events) != 1 || events[0].Kind != EventEscaped || events[0].Body != id {
+		t.Errorf("Published events are %+v, expected body %v escaping", events, id)
+	}
+}
+
+func TestRemoveEvent(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 1, 10, 100, 1)
+	id, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{1, 0}, R: 1})
+	state.PublishEvents(0)
+
+	RemoveSimulationBodies(state, RemovedByAdmin, func(body *BodyData) bool { return true })
+	events := publishedEvents(state, 1)
+	if len(events) != 1 || events[0].Kind != EventRemoved || events[0].Body != id || events[0].Reason != RemovedByAdmin {
+		t.Errorf("Published events are %+v, expected body %v removed by %v", events, id, RemovedByAdmin)
+	}
+}
+
+func TestSubscribeHoldsWhenFull(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 1, 10, 100, 1)
+	events, cancel := state.Subscribe(1)
+
+	for tick := uint64(1); tick <= 3; tick++ {
+		AddSimulationBody(state, BodyData{P: mgl32.Vec2{float32(tick), 0}, R: 1})
+		state.PublishEvents(tick)
+	}
+
+	if batch := <-events; len(batch) != 1 || batch[0].Tick != 1 {
+		t.Errorf("First batch is %+v, expected the event of tick %v", batch, 1)
+	}
+
+	// held events go out with the next publish even when it has none
+	state.PublishEvents(4)
+	if batch := <-events; len(batch) != 2 || batch[0].Tick != 2 || batch[1].Tick != 3 {
+		t.Errorf("Second batch is %+v, expected the events of ticks 2 and 3", batch)
+	}
+
+	if dropped := state.DroppedEvents(); dropped != 0 {
+		t.Errorf("Dropped %v batches, expected %v", dropped, 0)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("Subscription is still open after cancel")
+	}
+}
+
+func TestSubscribeDropsPastHeldLimit(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 1, 10, 100, 1)
+	events, cancel := state.Subscribe(1)
+	defer cancel()
+
+	// the third batch would hold more than the limit
+	size := maxHeldEvents/2 + 1
+	for tick := uint64(1); tick <= 3; tick++ {
+		state.Mu.Lock()
+		for i := 0; i < size; i++ {
+			state.emit(Event{Kind: EventSpawned, Body: uint16(i)})
+		}
+		state.Mu.Unlock()
+		state.PublishEvents(tick)
+	}
+
+	if dropped := state.DroppedEvents(); dropped != 1 {
+		t.Errorf("Dropped %v batches, expected %v", dropped, 1)
+	}
+
+	<-events
+	state.PublishEvents(4)
+	if batch := <-events; len(batch) != size || batch[0].Tick != 2 {
+		t.Errorf("Held batch has %v events from tick %v, expected %v from tick %v", len(batch), batch[0].Tick, size, 2)
+	}
+}
@@ -0,0 +1,255 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// FieldType names one of the built in force fields
+type FieldType string
+
+const (
+	// FieldWind pushes bodies in Direction
+	FieldWind FieldType = "wind"
+	// FieldAttractor pulls bodies towards Center, or pushes them away when
+	// Strength is negative
+	FieldAttractor FieldType = "attractor"
+	// FieldVortex swirls bodies counter clockwise around Center, clockwise
+	// when Strength is negative
+	FieldVortex FieldType = "vortex"
+	// FieldDrag slows the motion of bodies towards or away from Center,
+	// leaving their motion around it alone. Strength is the fraction of that
+	// motion removed per second.
+	FieldDrag FieldType = "drag"
+	// FieldNebula slows bodies inside of Radius, Strength is the fraction of
+	// their velocity removed per second
+	FieldNebula FieldType = "nebula"
+)
+
+// maxFieldID is the longest id a force field may have
+const maxFieldID = 64
+
+// FieldConfig describes a force field, it is also sent to clients so they can
+// draw the field. Radius limits the field to a circle around Center, 0 applies
+// it everywhere except for nebulas which always need one.
+type FieldConfig struct {
+	ID        string     `json:"id"`
+	Type      FieldType  `json:"type"`
+	Center    mgl32.Vec2 `json:"center"`
+	Direction mgl32.Vec2 `json:"direction"`
+	Radius    float32    `json:"radius"`
+	Strength  float32    `json:"strength"`
+}
+
+// ForceField is evaluated for every body on every tick on top of gravity
+type ForceField interface {
+	// Acceleration returns the change in velocity per second the field
+	// applies to a body
+	Acceleration(body *BodyData) mgl32.Vec2
+
+	// Config returns the settings of the field
+	Config() FieldConfig
+}
+
+// NewForceField validates config and creates the built in field it describes
+func NewForceField(config FieldConfig) (ForceField, error) {
+	if len(config.ID) == 0 || len(config.ID) > maxFieldID {
+		return nil, fmt.Errorf("field id must be 1 to %v characters", maxFieldID)
+	}
+
+	if !IsFiniteVec2(config.Center) || !IsFiniteVec2(config.Direction) || !IsFinite32(config.Radius) || !IsFinite32(config.Strength) {
+		return nil, fmt.Errorf("field %v has values that are not finite", config.ID)
+	}
+
+	if config.Radius < 0 {
+		return nil, fmt.Errorf("field %v radius must not be negative", config.ID)
+	}
+
+	switch config.Type {
+	case FieldWind:
+		if config.Direction.Len() == 0 {
+			return nil, fmt.Errorf("wind field %v needs a direction", config.ID)
+		}
+		return &windField{config: config, acceleration: config.Direction.Normalize().Mul(config.Strength)}, nil
+	case FieldAttractor:
+		return &attractorField{config: config}, nil
+	case FieldVortex:
+		return &vortexField{config: config}, nil
+	case FieldDrag:
+		return &dragField{config: config}, nil
+	case FieldNebula:
+		if config.Radius == 0 {
+			return nil, fmt.Errorf("nebula field %v needs a radius", config.ID)
+		}
+		return &nebulaField{config: config}, nil
+	default:
+		return nil, fmt.Errorf("field %v has unknown type %q", config.ID, config.Type)
+	}
+}
+
+// ReadForceFields creates the fields listed in a JSON file of field configs
+func ReadForceFields(path string) ([]ForceField, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []FieldConfig{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	fields := make([]ForceField, 0, len(configs))
+	for _, config := range configs {
+		field, err := NewForceField(config)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// SetForceField adds a field or replaces the one with the same id, the caller
+// must hold the simulation lock
+func SetForceField(simState *SimulationState, field ForceField) {
+	id := field.Config().ID
+	for i := range simState.Fields {
+		if simState.Fields[i].Config().ID == id {
+			simState.Fields[i] = field
+			return
+		}
+	}
+	simState.Fields = append(simState.Fields, field)
+}
+
+// RemoveForceField removes the field with id and returns whether there was
+// one, the caller must hold the simulation lock
+func RemoveForceField(simState *SimulationState, id string) bool {
+	for i := range simState.Fields {
+		if simState.Fields[i].Config().ID == id {
+			simState.Fields = append(simState.Fields[:i:i], simState.Fields[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ForceFieldConfigs returns the settings of every field, the caller must hold
+// the simulation lock
+func ForceFieldConfigs(simState *SimulationState) []FieldConfig {
+	configs := make([]FieldConfig, len(simState.Fields))
+	for i := range simState.Fields {
+		configs[i] = simState.Fields[i].Config()
+	}
+	return configs
+}
+
+// fieldAcceleration sums the acceleration of every field on a body
+func fieldAcceleration(fields []ForceField, body *BodyData) mgl32.Vec2 {
+	acceleration := mgl32.Vec2{0, 0}
+	for _, field := range fields {
+		acceleration = acceleration.Add(field.Acceleration(body))
+	}
+	return acceleration
+}
+
+// reach returns the offset of a body from the field's centre and whether the
+// body is inside of the field
+func (config *FieldConfig) reach(body *BodyData) (mgl32.Vec2, float32, bool) {
+	offset := body.P.Sub(config.Center)
+	distance := offset.Len()
+	return offset, distance, config.Radius == 0 || distance <= config.Radius
+}
+
+type windField struct {
+	config       FieldConfig
+	acceleration mgl32.Vec2
+}
+
+func (field *windField) Acceleration(body *BodyData) mgl32.Vec2 {
+	if _, _, inside := field.config.reach(body); !inside {
+		return mgl32.Vec2{0, 0}
+	}
+	return field.acceleration
+}
+
+func (field *windField) Config() FieldConfig {
+	return field.config
+}
+
+type attractorField struct {
+	config FieldConfig
+}
+
+// Acceleration falls off with the square of the distance, softened so bodies
+// passing through the centre are not flung out
+func (field *attractorField) Acceleration(body *BodyData) mgl32.Vec2 {
+	offset, distance, inside := field.config.reach(body)
+	if !inside || distance == 0 {
+		return mgl32.Vec2{0, 0}
+	}
+	return offset.Mul(-field.config.Strength / (distance * (1 + distance*distance)))
+}
+
+func (field *attractorField) Config() FieldConfig {
+	return field.config
+}
+
+type vortexField struct {
+	config FieldConfig
+}
+
+// Acceleration is tangential and fades out towards the edge of the radius
+func (field *vortexField) Acceleration(body *BodyData) mgl32.Vec2 {
+	offset, distance, inside := field.config.reach(body)
+	if !inside || distance == 0 {
+		return mgl32.Vec2{0, 0}
+	}
+
+	strength := field.config.Strength
+	if field.config.Radius > 0 {
+		strength *= 1 - distance/field.config.Radius
+	}
+	return mgl32.Vec2{-offset.Y(), offset.X()}.Mul(strength / distance)
+}
+
+func (field *vortexField) Config() FieldConfig {
+	return field.config
+}
+
+type dragField struct {
+	config FieldConfig
+}
+
+func (field *dragField) Acceleration(body *BodyData) mgl32.Vec2 {
+	offset, distance, inside := field.config.reach(body)
+	if !inside || distance == 0 {
+		return mgl32.Vec2{0, 0}
+	}
+
+	radial := offset.Mul(1 / distance)
+	return radial.Mul(-body.V.Dot(radial) * field.config.Strength)
+}
+
+func (field *dragField) Config() FieldConfig {
+	return field.config
+}
+
+type nebulaField struct {
+	config FieldConfig
+}
+
+func (field *nebulaField) Acceleration(body *BodyData) mgl32.Vec2 {
+	if _, _, inside := field.config.reach(body); !inside {
+		return mgl32.Vec2{0, 0}
+	}
+	return body.V.Mul(-field.config.Strength)
+}
+
+func (field *nebulaField) Config() FieldConfig {
+	return field.config
+}
@@ -0,0 +1,86 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func mustField(t *testing.T, config FieldConfig) ForceField {
+	field, err := NewForceField(config)
+	if err != nil {
+		t.Fatalf("Error creating %v field %v", config.Type, err)
+	}
+	return field
+}
+
+func TestNewForceFieldValidation(t *testing.T) {
+	invalid := []FieldConfig{
+		{Type: FieldAttractor},
+		{ID: "a", Type: "gust"},
+		{ID: "a", Type: FieldWind},
+		{ID: "a", Type: FieldNebula},
+		{ID: "a", Type: FieldVortex, Radius: -1},
+	}
+
+	for _, config := range invalid {
+		if _, err := NewForceField(config); err == nil {
+			t.Errorf("NewForceField(%+v) error is nil, expected an error", config)
+		}
+	}
+}
+
+func TestForceFieldAcceleration(t *testing.T) {
+	body := &BodyData{P: mgl32.Vec2{2, 0}, V: mgl32.Vec2{1, 1}}
+
+	tests := []struct {
+		config   FieldConfig
+		expected mgl32.Vec2
+	}{
+		{FieldConfig{ID: "wind", Type: FieldWind, Direction: mgl32.Vec2{0, 2}, Strength: 3}, mgl32.Vec2{0, 3}},
+		{FieldConfig{ID: "wind", Type: FieldWind, Direction: mgl32.Vec2{0, 2}, Radius: 1, Strength: 3}, mgl32.Vec2{0, 0}},
+		{FieldConfig{ID: "attractor", Type: FieldAttractor, Strength: 5}, mgl32.Vec2{-1, 0}},
+		{FieldConfig{ID: "vortex", Type: FieldVortex, Radius: 4, Strength: 2}, mgl32.Vec2{0, 1}},
+		{FieldConfig{ID: "drag", Type: FieldDrag, Strength: 0.5}, mgl32.Vec2{-0.5, 0}},
+		{FieldConfig{ID: "nebula", Type: FieldNebula, Center: mgl32.Vec2{2, 1}, Radius: 2, Strength: 0.5}, mgl32.Vec2{-0.5, -0.5}},
+		{FieldConfig{ID: "nebula", Type: FieldNebula, Center: mgl32.Vec2{10, 0}, Radius: 2, Strength: 0.5}, mgl32.Vec2{0, 0}},
+	}
+
+	for _, test := range tests {
+		acceleration := mustField(t, test.config).Acceleration(body)
+		if !acceleration.ApproxEqualThreshold(test.expected, 1e-5) {
+			t.Errorf("%v field acceleration is %v, expected %v", test.config.ID, acceleration, test.expected)
+		}
+	}
+}
+
+func TestSetAndRemoveForceField(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	SetForceField(state, mustField(t, FieldConfig{ID: "a", Type: FieldDrag, Strength: 1}))
+	SetForceField(state, mustField(t, FieldConfig{ID: "b", Type: FieldDrag, Strength: 1}))
+	SetForceField(state, mustField(t, FieldConfig{ID: "a", Type: FieldDrag, Strength: 2}))
+
+	configs := ForceFieldConfigs(state)
+	if len(configs) != 2 || configs[0].ID != "a" || configs[0].Strength != 2 {
+		t.Errorf("Fields are %+v, expected a replaced in place and b", configs)
+	}
+
+	if !RemoveForceField(state, "a") || RemoveForceField(state, "a") {
+		t.Errorf("RemoveForceField did not remove a exactly once")
+	}
+
+	if configs := ForceFieldConfigs(state); len(configs) != 1 || configs[0].ID != "b" {
+		t.Errorf("Fields are %+v, expected only b", configs)
+	}
+}
+
+func TestForceFieldUpdate(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	state.Fields = []ForceField{mustField(t, FieldConfig{ID: "wind", Type: FieldWind, Direction: mgl32.Vec2{1, 0}, Strength: 10})}
+	AddSimulationBody(state, BodyData{R: 1})
+
+	UpdateSimulationState(state, 0.1)
+	if velocity := state.Bodies[0].V; !velocity.ApproxEqualThreshold(mgl32.Vec2{1, 0}, 1e-5) {
+		t.Errorf("Body velocity is %v, expected %v", velocity, mgl32.Vec2{1, 0})
+	}
+}
@@ -0,0 +1,93 @@
+package sim
+
+// CollisionOutcome is what happens to two bodies that touch during a tick
+type CollisionOutcome int
+
+const (
+	// CollisionMerge has the larger body absorb the smaller one
+	CollisionMerge CollisionOutcome = iota
+	// CollisionBounce reflects both bodies off each other elastically
+	CollisionBounce
+	// CollisionDestroy removes both bodies
+	CollisionDestroy
+	// CollisionIgnore lets the bodies pass through each other
+	CollisionIgnore
+)
+
+// Hooks lets server-side rules change what happens to bodies without changing
+// the simulation itself, every hook is called with the simulation lock held.
+// Hooks also run on the forks of trajectory previews so they should only
+// change the state they are given.
+type Hooks interface {
+	// OnSpawn may modify a cleaned body before it is added or veto it by
+	// returning an error, a *SpawnError is passed on to the client as is
+	OnSpawn(simState *SimulationState, body *BodyData) error
+
+	// OnCollision chooses the outcome of two bodies touching, speed is the
+	// magnitude of their relative velocity
+	OnCollision(simState *SimulationState, a *BodyData, b *BodyData, speed float32) CollisionOutcome
+
+	// OnEscape is called for a body that left Bounds and returns whether it
+	// should be removed
+	OnEscape(simState *SimulationState, body *BodyData) bool
+
+	// OnTick is called at the end of every tick, it must not modify the
+	// simulation
+	OnTick(simState *SimulationState, deltaTime float32)
+}
+
+// DefaultHooks is the legacy behaviour: spawns are accepted unchanged,
+// colliding bodies merge and escaped bodies are removed
+type DefaultHooks struct{}
+
+func (DefaultHooks) OnSpawn(simState *SimulationState, body *BodyData) error {
+	return nil
+}
+
+func (DefaultHooks) OnCollision(simState *SimulationState, a *BodyData, b *BodyData, speed float32) CollisionOutcome {
+	return CollisionMerge
+}
+
+func (DefaultHooks) OnEscape(simState *SimulationState, body *BodyData) bool {
+	return true
+}
+
+func (DefaultHooks) OnTick(simState *SimulationState, deltaTime float32) {}
+
+// hooks returns the registered hooks, falling back to the defaults
+func (simState *SimulationState) hooks() Hooks {
+	if simState.Hooks == nil {
+		return DefaultHooks{}
+	}
+	return simState.Hooks
+}
+
+// bounce separates two overlapping bodies and exchanges the momentum along
+// the line between their centres as a perfectly elastic collision. With
+// continuous collision the bodies must be moved to where they touched first.
+func bounce(a *BodyData, b *BodyData) {
+	offset := b.P.Sub(a.P)
+	distance := offset.Len()
+	if distance == 0 {
+		return
+	}
+
+	normal := offset.Mul(1 / distance)
+	inverseA, inverseB := 1/a.M, 1/b.M
+
+	// push the bodies apart in proportion to their inverse masses
+	if overlap := a.R + b.R - distance; overlap > 0 {
+		share := overlap / (inverseA + inverseB)
+		a.P = a.P.Sub(normal.Mul(share * inverseA))
+		b.P = b.P.Add(normal.Mul(share * inverseB))
+	}
+
+	closing := b.V.Sub(a.V).Dot(normal)
+	if closing >= 0 {
+		return
+	}
+
+	impulse := -2 * closing / (inverseA + inverseB)
+	a.V = a.V.Sub(normal.Mul(impulse * inverseA))
+	b.V = b.V.Add(normal.Mul(impulse * inverseB))
+}
@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// testHooks applies a fixed collision outcome and records what it saw
+type testHooks struct {
+	DefaultHooks
+	outcome    CollisionOutcome
+	keepEscape bool
+	collisions int
+	ticks      int
+	bodies     int
+}
+
+func (hooks *testHooks) OnSpawn(simState *SimulationState, body *BodyData) error {
+	if body.T == 9 {
+		return &SpawnError{Code: "no_nines", Reason: "type 9 is not allowed"}
+	}
+	body.T = 7
+	return nil
+}
+
+func (hooks *testHooks) OnCollision(simState *SimulationState, a *BodyData, b *BodyData, speed float32) CollisionOutcome {
+	hooks.collisions++
+	return hooks.outcome
+}
+
+func (hooks *testHooks) OnEscape(simState *SimulationState, body *BodyData) bool {
+	return !hooks.keepEscape
+}
+
+func (hooks *testHooks) OnTick(simState *SimulationState, deltaTime float32) {
+	hooks.ticks++
+	hooks.bodies = len(simState.Bodies)
+}
+
+func createCollidingState(outcome CollisionOutcome) (*SimulationState, *testHooks) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	hooks := &testHooks{outcome: outcome}
+	state.Hooks = hooks
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{0, 0}, V: mgl32.Vec2{1, 0}, R: 1})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{1.5, 0}, V: mgl32.Vec2{-1, 0}, R: 1})
+	state.PublishEvents(0)
+	return state, hooks
+}
+
+func TestHooksSpawn(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	state.Hooks = &testHooks{}
+
+	if _, err := AddSimulationBody(state, BodyData{R: 1, T: 9}); err == nil {
+		t.Errorf("Vetoed spawn was added")
+	}
+
+	if _, err := AddSimulationBody(state, BodyData{R: 1, T: 1}); err != nil {
+		t.Fatalf("Error adding body %v", err)
+	}
+
+	if len(state.Bodies) != 1 || state.Bodies[0].T != 7 {
+		t.Errorf("Bodies are %v, expected one body with type %v", state.Bodies, 7)
+	}
+}
+
+func TestHooksMergeByDefault(t *testing.T) {
+	state, hooks := createCollidingState(CollisionMerge)
+	UpdateSimulationState(state, 0.01)
+
+	if len(state.Bodies) != 1 {
+		t.Errorf("Simulation has %v bodies after merge, expected %v", len(state.Bodies), 1)
+	}
+
+	if hooks.ticks != 1 || hooks.bodies != 1 {
+		t.Errorf("OnTick was called %v times with %v bodies, expected %v with %v", hooks.ticks, hooks.bodies, 1, 1)
+	}
+}
+
+func TestHooksBounce(t *testing.T) {
+	state, hooks := createCollidingState(CollisionBounce)
+	UpdateSimulationState(state, 0.01)
+
+	if len(state.Bodies) != 2 {
+		t.Fatalf("Simulation has %v bodies after bounce, expected %v", len(state.Bodies), 2)
+	}
+
+	if hooks.collisions != 1 {
+		t.Errorf("OnCollision was called %v times, expected %v", hooks.collisions, 1)
+	}
+
+	if state.Bodies[0].V.X() >= 0 || state.Bodies[1].V.X() <= 0 {
+		t.Errorf("Velocities after bounce are %v and %v, expected the bodies to move apart", state.Bodies[0].V, state.Bodies[1].V)
+	}
+
+	if gap := state.Bodies[1].P.Sub(state.Bodies[0].P).Len(); gap < 2-1e-4 {
+		t.Errorf("Bodies are %v apart after bounce, expected at least %v", gap, 2)
+	}
+}
+
+func TestHooksBounceFastBodies(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 1000, 1000, 1)
+	state.Hooks = &testHooks{outcome: CollisionBounce}
+	state.ContinuousCollision = true
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{-5, 0}, V: mgl32.Vec2{500, 0}, R: 1})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{5, 0}, V: mgl32.Vec2{-500, 0}, R: 1})
+
+	// the bodies would be 10 apart on the wrong sides without the bounce
+	UpdateSimulationState(state, 0.02)
+
+	a, b := state.Bodies[0], state.Bodies[1]
+	if a.V.X() >= 0 || b.V.X() <= 0 {
+		t.Errorf("Velocities after bounce are %v and %v, expected the bodies to move apart", a.V, b.V)
+	}
+
+	if a.P.X() >= b.P.X() {
+		t.Errorf("Bodies are at %v and %v after bounce, expected them not to pass each other", a.P, b.P)
+	}
+}
+
+func TestHooksDestroy(t *testing.T) {
+	state, _ := createCollidingState(CollisionDestroy)
+	UpdateSimulationState(state, 0.01)
+
+	if len(state.Bodies) != 0 {
+		t.Errorf("Simulation has %v bodies after destroy, expected %v", len(state.Bodies), 0)
+	}
+
+	events := publishedEvents(state, 1)
+	if len(events) != 2 || events[0].Reason != RemovedByCollision || events[1].Reason != RemovedByCollision {
+		t.Errorf("Published events are %+v, expected both bodies removed by %v", events, RemovedByCollision)
+	}
+}
+
+func TestHooksIgnore(t *testing.T) {
+	state, _ := createCollidingState(CollisionIgnore)
+	UpdateSimulationState(state, 0.01)
+
+	if len(state.Bodies) != 2 || state.Bodies[0].V.X() <= 0 {
+		t.Errorf("Bodies after ignored collision are %v, expected both unchanged", state.Bodies)
+	}
+}
+
+func TestHooksEscape(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 10, 1)
+	state.Hooks = &testHooks{keepEscape: true}
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{9.5, 0}, V: mgl32.Vec2{100, 0}, R: 1})
+
+	UpdateSimulationState(state, 0.1)
+	if len(state.Bodies) != 1 {
+		t.Errorf("Simulation has %v bodies, expected the escaped body to be kept", len(state.Bodies))
+	}
+}
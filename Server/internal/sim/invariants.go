@@ -0,0 +1,182 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// InvariantStats counts the invalid bodies found by the post tick checks
+type InvariantStats struct {
+	Incidents uint64 `json:"incidents"`
+	Repaired  uint64 `json:"repaired"`
+	Removed   uint64 `json:"removed"`
+	Dumps     uint64 `json:"dumps"`
+}
+
+// InvariantDump is the pre tick state written out when a tick produced
+// invalid bodies, bodies are kept packed so NaN and Inf values survive
+type InvariantDump struct {
+	Time            time.Time `json:"time"`
+	DeltaTime       float32   `json:"deltaTime"`
+	GravityConstant float32   `json:"gravityConstant"`
+	TimeScale       float32   `json:"timeScale"`
+	MassScale       float32   `json:"massScale"`
+	MaxVelocity     float32   `json:"maxVelocity"`
+	DampScale       float32   `json:"dampScale"`
+	Bounds          float32   `json:"bounds"`
+	Continuous      bool      `json:"continuous"`
+	Capacity        int       `json:"capacity"`
+	Bodies          [][]byte  `json:"bodies"`
+}
+
+// IsFinite32 reports whether value is neither NaN nor infinite
+func IsFinite32(value float32) bool {
+	return !math.IsNaN(float64(value)) && !math.IsInf(float64(value), 0)
+}
+
+// IsFiniteVec2 reports whether both components of vector are finite
+func IsFiniteVec2(vector mgl32.Vec2) bool {
+	return IsFinite32(vector.X()) && IsFinite32(vector.Y())
+}
+
+// IsFinite reports whether every numeric field of the body is a real number
+func (data *BodyData) IsFinite() bool {
+	return IsFiniteVec2(data.P) && IsFiniteVec2(data.V) && IsFinite32(data.M) && IsFinite32(data.R)
+}
+
+// repairBody fixes what can be fixed in place, returning false if the body
+// has to be removed from the simulation
+func repairBody(data *BodyData, massScale float32) bool {
+	if !IsFiniteVec2(data.P) || !IsFinite32(data.R) || data.R <= 0 {
+		return false
+	}
+
+	if !IsFiniteVec2(data.V) {
+		data.V = mgl32.Vec2{0, 0}
+	}
+
+	if !IsFinite32(data.M) || data.M <= 0 {
+		data.M = calculateMass(data.R, massScale)
+		if !IsFinite32(data.M) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// enforceInvariants repairs or removes invalid bodies after a tick, dumping
+// the pre tick bodies to DebugDumpDir when set so the tick can be replayed
+func enforceInvariants(simState *SimulationState, preTick []BodyData, deltaTime float32) {
+	removed := 0
+	repaired := 0
+	valid := simState.Bodies[:0]
+
+	for _, body := range simState.Bodies {
+		if body.IsFinite() && body.R > 0 && body.M > 0 {
+			valid = append(valid, body)
+			continue
+		}
+
+		if repairBody(&body, simState.MassScale) {
+			repaired++
+			valid = append(valid, body)
+		} else {
+			removed++
+			simState.emit(Event{Kind: EventRemoved, Body: body.I, Reason: RemovedInvalid, P: body.P, Owner: body.Owner})
+		}
+	}
+
+	if removed == 0 && repaired == 0 {
+		return
+	}
+
+	simState.Bodies = valid
+	simState.Invariants.Incidents++
+	simState.Invariants.Repaired += uint64(repaired)
+	simState.Invariants.Removed += uint64(removed)
+	slog.Warn("Invariant check found invalid bodies", "repaired", repaired, "removed", removed, "incidents", simState.Invariants.Incidents)
+
+	if len(simState.DebugDumpDir) == 0 {
+		return
+	}
+
+	path, err := writeInvariantDump(simState, preTick, deltaTime)
+	if err != nil {
+		slog.Error("Error writing invariant dump", "err", err)
+		return
+	}
+
+	simState.Invariants.Dumps++
+	slog.Warn("Wrote invariant dump", "path", path)
+}
+
+func writeInvariantDump(simState *SimulationState, preTick []BodyData, deltaTime float32) (string, error) {
+	dump := InvariantDump{
+		Time:            time.Now().UTC(),
+		DeltaTime:       deltaTime,
+		GravityConstant: simState.GravityConstant,
+		TimeScale:       simState.TimeScale,
+		MassScale:       simState.MassScale,
+		MaxVelocity:     simState.MaxVelocity,
+		DampScale:       simState.DampScale,
+		Bounds:          simState.Bounds,
+		Continuous:      simState.ContinuousCollision,
+		Capacity:        cap(simState.Bodies),
+		Bodies:          make([][]byte, 0, len(preTick)),
+	}
+
+	for _, body := range preTick {
+		packed, err := body.Pack()
+		if err != nil {
+			return "", err
+		}
+		dump.Bodies = append(dump.Bodies, packed)
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(simState.DebugDumpDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("invariant-%v.json", dump.Time.UnixNano())
+	path := filepath.Join(simState.DebugDumpDir, name)
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// ReadInvariantDump restores the pre tick state from a dump written by the
+// invariant checker along with the delta time of the failing tick
+func ReadInvariantDump(path string) (*SimulationState, float32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dump := InvariantDump{}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return nil, 0, err
+	}
+
+	simState := CreateEmptySimulationState(dump.Capacity, dump.GravityConstant, dump.TimeScale, dump.MassScale, dump.MaxVelocity, dump.Bounds, dump.DampScale)
+	simState.ContinuousCollision = dump.Continuous
+	for _, packed := range dump.Bodies {
+		body := BodyData{}
+		if err := UnpackBodyData(packed, &body); err != nil {
+			return nil, 0, err
+		}
+		simState.Bodies = append(simState.Bodies, body)
+	}
+
+	return simState, dump.DeltaTime, nil
+}
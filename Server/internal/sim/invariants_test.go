@@ -0,0 +1,148 @@
+package sim
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/idpool"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func createInvariantSimulationState(bodies []BodyData) *SimulationState {
+	return &SimulationState{
+		GravityConstant: 1,
+		TimeScale:       1,
+		MassScale:       1,
+		MaxVelocity:     10,
+		Bounds:          100,
+		Bodies:          bodies,
+		IdPool:          idpool.NewIDPool(len(bodies), 1),
+	}
+}
+
+func TestInvariantsRemoveNaNPosition(t *testing.T) {
+	nan := float32(math.NaN())
+	bodies := []BodyData{
+		{I: idpool.NewID(0), P: mgl32.Vec2{-10, 0}, M: 1, R: 1},
+		{I: idpool.NewID(1), P: mgl32.Vec2{nan, 0}, M: 1, R: 1},
+		{I: idpool.NewID(2), P: mgl32.Vec2{10, 0}, M: 1, R: 1},
+	}
+
+	simState := createInvariantSimulationState(bodies)
+	UpdateSimulationState(simState, 1)
+
+	if len(simState.Bodies) != 2 {
+		t.Fatalf("len(Bodies) is %v, expected %v", len(simState.Bodies), 2)
+	}
+
+	for _, body := range simState.Bodies {
+		if !body.IsFinite() {
+			t.Errorf("Body %v is not finite after update: %v", body.I, body)
+		}
+	}
+
+	if simState.Invariants.Removed != 1 {
+		t.Errorf("Invariants.Removed is %v, expected %v", simState.Invariants.Removed, 1)
+	}
+
+	if simState.Invariants.Incidents != 1 {
+		t.Errorf("Invariants.Incidents is %v, expected %v", simState.Invariants.Incidents, 1)
+	}
+}
+
+func TestInvariantsRepairInfVelocity(t *testing.T) {
+	inf := float32(math.Inf(1))
+	bodies := []BodyData{
+		{I: idpool.NewID(0), P: mgl32.Vec2{0, 0}, V: mgl32.Vec2{inf, 0}, M: 1, R: 1},
+	}
+
+	simState := createInvariantSimulationState(bodies)
+	UpdateSimulationState(simState, 1)
+
+	if len(simState.Bodies) != 1 {
+		t.Fatalf("len(Bodies) is %v, expected %v", len(simState.Bodies), 1)
+	}
+
+	if !simState.Bodies[0].IsFinite() {
+		t.Errorf("Body 0 is not finite after update: %v", simState.Bodies[0])
+	}
+
+	if simState.Invariants.Repaired != 1 {
+		t.Errorf("Invariants.Repaired is %v, expected %v", simState.Invariants.Repaired, 1)
+	}
+
+	if simState.Invariants.Incidents != 1 {
+		t.Errorf("Invariants.Incidents is %v, expected %v", simState.Invariants.Incidents, 1)
+	}
+}
+
+func TestRepairBody(t *testing.T) {
+	nan := float32(math.NaN())
+
+	body := BodyData{P: mgl32.Vec2{1, 1}, V: mgl32.Vec2{nan, 1}, M: nan, R: 1}
+	if !repairBody(&body, 1) {
+		t.Fatalf("repairBody is %v, expected %v", false, true)
+	}
+
+	if !body.IsFinite() {
+		t.Errorf("Repaired body is not finite: %v", body)
+	}
+
+	if body.V != (mgl32.Vec2{0, 0}) {
+		t.Errorf("Repaired body V is %v, expected %v", body.V, mgl32.Vec2{0, 0})
+	}
+
+	body = BodyData{P: mgl32.Vec2{1, 1}, M: 1, R: nan}
+	if repairBody(&body, 1) {
+		t.Errorf("repairBody with NaN radius is %v, expected %v", true, false)
+	}
+}
+
+func TestInvariantDumpRoundTrip(t *testing.T) {
+	nan := float32(math.NaN())
+	bodies := []BodyData{
+		{I: idpool.NewID(0), P: mgl32.Vec2{-10, 0}, M: 1, R: 1},
+		{I: idpool.NewID(1), P: mgl32.Vec2{10, 0}, V: mgl32.Vec2{nan, nan}, M: 1, R: 1},
+	}
+
+	dir := t.TempDir()
+	simState := createInvariantSimulationState(bodies)
+	simState.DebugDumpDir = dir
+	UpdateSimulationState(simState, 0.5)
+
+	if simState.Invariants.Dumps != 1 {
+		t.Fatalf("Invariants.Dumps is %v, expected %v", simState.Invariants.Dumps, 1)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading dump dir %v", err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("Dump dir has %v files, expected %v", len(files), 1)
+	}
+
+	restored, deltaTime, err := ReadInvariantDump(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("Error reading invariant dump %v", err)
+	}
+
+	if deltaTime != 0.5 {
+		t.Errorf("Dump deltaTime is %v, expected %v", deltaTime, 0.5)
+	}
+
+	if len(restored.Bodies) != 2 {
+		t.Fatalf("Restored len(Bodies) is %v, expected %v", len(restored.Bodies), 2)
+	}
+
+	if restored.Bodies[0].P != (mgl32.Vec2{-10, 0}) {
+		t.Errorf("Restored body 0 P is %v, expected %v", restored.Bodies[0].P, mgl32.Vec2{-10, 0})
+	}
+
+	if !math.IsNaN(float64(restored.Bodies[1].V.X())) {
+		t.Errorf("Restored body 1 V is %v, expected NaN", restored.Bodies[1].V)
+	}
+}
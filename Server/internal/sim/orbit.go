@@ -0,0 +1,107 @@
+package sim
+
+import (
+	"fmt"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// OrbitDominance is the share of the gravity at the spawn point the parent
+// has to exceed for an orbit around it to be stable enough to assign
+const OrbitDominance float32 = 0.5
+
+// OrbitOptions asks for a spawned body to be put in orbit around the body
+// that dominates the gravity where it spawns
+type OrbitOptions struct {
+	// Eccentricity 0 is a circular orbit, larger values up to but excluding
+	// 1 launch the body from the closest point of an ever longer ellipse
+	Eccentricity float32 `json:"eccentricity"`
+
+	// Retrograde orbits against the direction the parent moves around the
+	// centre of the world instead of with it
+	Retrograde bool `json:"retrograde"`
+}
+
+// Validate checks that the orbit can be reached
+func (options *OrbitOptions) Validate() error {
+	if !IsFinite32(options.Eccentricity) || options.Eccentricity < 0 || options.Eccentricity >= 1 {
+		return &SpawnError{Code: SpawnErrorOrbit, Reason: fmt.Sprintf("eccentricity %v must be at least 0 and below 1", options.Eccentricity)}
+	}
+	return nil
+}
+
+// dampFactor is how much of a force moves a body of mass, matching the
+// velocity update in UpdateSimulationState
+func dampFactor(simState *SimulationState, mass float32) float32 {
+	return 1.0 / pow32(1.0+mass, simState.DampScale)
+}
+
+// findOrbitParent returns the index of the body dominating the gravity at the
+// position of body, or -1 when no body is heavier and dominant enough
+func findOrbitParent(simState *SimulationState, body *BodyData) int {
+	parent := -1
+	strongest := float32(0)
+	total := float32(0)
+	for i := range simState.Bodies {
+		other := &simState.Bodies[i]
+		force := calculateForces2(simState.GravityConstant, body.P.X(), body.P.Y(), body.M, other.P.X(), other.P.Y(), other.M).Len()
+		total += force
+		if force > strongest {
+			strongest = force
+			parent = i
+		}
+	}
+
+	if parent < 0 || strongest <= total*OrbitDominance {
+		return -1
+	}
+
+	other := &simState.Bodies[parent]
+	if other.M <= body.M || other.P.Sub(body.P).Len() <= other.R+body.R {
+		return -1
+	}
+	return parent
+}
+
+// AssignOrbit sets the velocity of a validated body so it orbits the body
+// dominating the gravity where it spawns, returning the parent's id or false
+// when there is no suitable parent and the velocity is left as it was.
+//
+// The speed is taken from the same force and damping the simulation applies
+// so circular orbits hold. Gravity here weakens with the distance rather than
+// its square, so eccentric orbits only approximate the requested shape. The
+// caller must hold the simulation lock.
+func AssignOrbit(simState *SimulationState, body *BodyData, options OrbitOptions) (uint16, bool) {
+	index := findOrbitParent(simState, body)
+	if index < 0 {
+		return 0, false
+	}
+
+	parent := &simState.Bodies[index]
+	offset := body.P.Sub(parent.P)
+	distance := offset.Len()
+
+	// both bodies fall towards each other so the orbit is of their separation,
+	// the force is clamped like the simulation clamps it
+	force := calculateForces2(simState.GravityConstant, body.P.X(), body.P.Y(), body.M, parent.P.X(), parent.P.Y(), parent.M).Len()
+	force = min(force, simState.MaxVelocity)
+	acceleration := force * (dampFactor(simState, body.M) + dampFactor(simState, parent.M))
+	speed := sqrt32(acceleration*distance) * sqrt32(1+options.Eccentricity)
+
+	// counter clockwise unless the parent itself moves clockwise around the centre
+	tangent := mgl32.Vec2{-offset.Y(), offset.X()}.Mul(1 / distance)
+	if parent.P.X()*parent.V.Y()-parent.P.Y()*parent.V.X() < 0 {
+		tangent = tangent.Mul(-1)
+	}
+	if options.Retrograde {
+		tangent = tangent.Mul(-1)
+	}
+
+	velocity := parent.V.Add(tangent.Mul(speed))
+	if !IsFiniteVec2(velocity) || velocity.Len() > simState.MaxVelocity {
+		return 0, false
+	}
+
+	body.V = velocity
+	return parent.I, true
+}
@@ -0,0 +1,148 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestOrbitValidate(t *testing.T) {
+	for _, eccentricity := range []float32{-0.1, 1, 2} {
+		options := OrbitOptions{Eccentricity: eccentricity}
+		if err := options.Validate(); err == nil {
+			t.Errorf("Eccentricity %v is valid, expected an error", eccentricity)
+		}
+	}
+
+	options := OrbitOptions{Eccentricity: 0.5}
+	if err := options.Validate(); err != nil {
+		t.Errorf("Eccentricity %v is invalid: %v", options.Eccentricity, err)
+	}
+}
+
+func TestAssignOrbitCircular(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	star, _ := AddSimulationBody(state, BodyData{R: 5})
+
+	body := BodyData{P: mgl32.Vec2{20, 0}, R: 0.5}
+	if err := ValidateSpawn(state, &body); err != nil {
+		t.Fatalf("Error validating spawn %v", err)
+	}
+
+	parent, ok := AssignOrbit(state, &body, OrbitOptions{})
+	if !ok || parent != star {
+		t.Fatalf("Orbit parent is %v %v, expected %v", parent, ok, star)
+	}
+
+	if body.V.Y() <= 0 || body.V.X() != 0 {
+		t.Errorf("Orbit velocity is %v, expected counter clockwise", body.V)
+	}
+
+	if _, err := AddSimulationBody(state, body); err != nil {
+		t.Fatalf("Error adding body %v", err)
+	}
+
+	for i := 0; i < 10*60; i++ {
+		UpdateSimulationState(state, 1.0/60)
+		if len(state.Bodies) != 2 {
+			t.Fatalf("Simulation has %v bodies after %v ticks, expected %v", len(state.Bodies), i, 2)
+		}
+
+		distance := state.Bodies[1].P.Sub(state.Bodies[0].P).Len()
+		if distance < 18 || distance > 22 {
+			t.Fatalf("Orbit distance is %v after %v ticks, expected about %v", distance, i, 20)
+		}
+	}
+}
+
+func TestAssignOrbitClampedForce(t *testing.T) {
+	// the server defaults, where gravity near the parent is above MaxVelocity
+	for _, distance := range []float32{8, 20, 35, 50} {
+		state := CreateEmptySimulationState(8, 5, 3.75, 4, 50, 100, 1.15)
+		AddSimulationBody(state, BodyData{R: 4})
+
+		body := BodyData{P: mgl32.Vec2{distance, 0}, R: 0.5}
+		if err := ValidateSpawn(state, &body); err != nil {
+			t.Fatalf("Error validating spawn %v", err)
+		}
+
+		if _, ok := AssignOrbit(state, &body, OrbitOptions{}); !ok {
+			t.Fatalf("No orbit assigned at distance %v", distance)
+		}
+		AddSimulationBody(state, body)
+
+		for i := 0; i < 10*60; i++ {
+			UpdateSimulationState(state, 1.0/60)
+			if len(state.Bodies) != 2 {
+				t.Fatalf("Simulation has %v bodies after %v ticks at distance %v, expected %v", len(state.Bodies), i, distance, 2)
+			}
+
+			if separation := state.Bodies[1].P.Sub(state.Bodies[0].P).Len(); separation < distance*0.9 || separation > distance*1.1 {
+				t.Fatalf("Orbit distance is %v after %v ticks, expected about %v", separation, i, distance)
+			}
+		}
+	}
+}
+
+func TestAssignOrbitDirection(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	AddSimulationBody(state, BodyData{R: 5})
+
+	body := BodyData{P: mgl32.Vec2{20, 0}, R: 0.5}
+	ValidateSpawn(state, &body)
+
+	prograde := body
+	AssignOrbit(state, &prograde, OrbitOptions{})
+	retrograde := body
+	AssignOrbit(state, &retrograde, OrbitOptions{Retrograde: true})
+	if retrograde.V != prograde.V.Mul(-1) {
+		t.Errorf("Retrograde velocity is %v, expected %v", retrograde.V, prograde.V.Mul(-1))
+	}
+
+	eccentric := body
+	AssignOrbit(state, &eccentric, OrbitOptions{Eccentricity: 0.5})
+	if eccentric.V.Len() <= prograde.V.Len() {
+		t.Errorf("Eccentric orbit speed is %v, expected above %v", eccentric.V.Len(), prograde.V.Len())
+	}
+
+	// the parent moving clockwise around the centre turns prograde around
+	state.Bodies[0].P = mgl32.Vec2{0, 50}
+	state.Bodies[0].V = mgl32.Vec2{1, 0}
+	clockwise := BodyData{P: mgl32.Vec2{20, 50}, R: 0.5}
+	ValidateSpawn(state, &clockwise)
+	AssignOrbit(state, &clockwise, OrbitOptions{})
+	if clockwise.V.Y() >= 0 {
+		t.Errorf("Orbit velocity is %v, expected clockwise", clockwise.V)
+	}
+}
+
+func TestAssignOrbitFallback(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+
+	body := BodyData{P: mgl32.Vec2{20, 0}, V: mgl32.Vec2{1, 2}, R: 0.5}
+	ValidateSpawn(state, &body)
+	if _, ok := AssignOrbit(state, &body, OrbitOptions{}); ok || body.V != (mgl32.Vec2{1, 2}) {
+		t.Errorf("Orbit without bodies is %v velocity %v, expected the supplied %v", ok, body.V, mgl32.Vec2{1, 2})
+	}
+
+	// a lighter body is no parent
+	AddSimulationBody(state, BodyData{R: 0.2})
+	if _, ok := AssignOrbit(state, &body, OrbitOptions{}); ok {
+		t.Errorf("Orbit assigned around a lighter body")
+	}
+
+	// nor are two equal bodies pulling from either side
+	state.Bodies = state.Bodies[:0]
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{10, 0}, R: 5})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{30, 0}, R: 5})
+	if _, ok := AssignOrbit(state, &body, OrbitOptions{}); ok {
+		t.Errorf("Orbit assigned without a dominant body")
+	}
+
+	// nor is a parent the body would be inside of
+	state.Bodies = state.Bodies[:0]
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{17, 0}, R: 5})
+	if _, ok := AssignOrbit(state, &body, OrbitOptions{}); ok {
+		t.Errorf("Orbit assigned around an overlapping body")
+	}
+}
@@ -0,0 +1,240 @@
+package sim
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// PreviewMode decides how much of the simulation a trajectory preview runs
+type PreviewMode string
+
+const (
+	// PreviewFrozen only moves the previewed body, every other body stays
+	// where it is. Cheap and close enough for short previews.
+	PreviewFrozen PreviewMode = "frozen"
+	// PreviewFull runs the whole n-body simulation on the fork
+	PreviewFull PreviewMode = "full"
+)
+
+// ParsePreviewMode checks that value names one of the preview modes
+func ParsePreviewMode(value string) (PreviewMode, error) {
+	switch mode := PreviewMode(value); mode {
+	case PreviewFrozen, PreviewFull:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown preview mode %q", value)
+	}
+}
+
+// Fate is what a preview predicts happens to the previewed body
+type Fate string
+
+const (
+	// FateOrbit is a body still in the simulation when the preview ends
+	FateOrbit Fate = "orbit"
+	// FateMerge is a body absorbed by the body in Prediction.Into
+	FateMerge Fate = "merge"
+	// FateEscape is a body leaving Bounds
+	FateEscape Fate = "escape"
+	// FateRemoved is a body removed any other way, such as by a hook
+	FateRemoved Fate = "removed"
+	// FateUnknown is a preview that ran out of time before it finished
+	FateUnknown Fate = "unknown"
+)
+
+// PreviewOptions control how a trajectory is predicted
+type PreviewOptions struct {
+	Mode PreviewMode
+
+	// Ticks of DeltaTime seconds to run for
+	Ticks     int
+	DeltaTime float32
+
+	// Stride is how many ticks apart the points of the polyline are
+	Stride int
+
+	// Deadline stops the preview early with FateUnknown, zero for none
+	Deadline time.Time
+}
+
+// Prediction is the path of a previewed body and what happens to it, Ticks
+// is how many ticks were simulated before the fate was decided
+type Prediction struct {
+	Points []mgl32.Vec2 `json:"points"`
+	Fate   Fate         `json:"fate"`
+	Into   *uint16      `json:"into,omitempty"`
+	Ticks  int          `json:"ticks"`
+}
+
+// ForkSimulationState returns a copy of the simulation that can be run
+// without affecting it, subscribers, grabs and debug dumps are left out. The
+// fork shares the Hooks and force fields of the simulation. The caller must
+// hold the simulation lock.
+func ForkSimulationState(simState *SimulationState) *SimulationState {
+	return &SimulationState{
+		GravityConstant:     simState.GravityConstant,
+		TimeScale:           simState.TimeScale,
+		MassScale:           simState.MassScale,
+		MaxVelocity:         simState.MaxVelocity,
+		DampScale:           simState.DampScale,
+		Bounds:              simState.Bounds,
+		ContinuousCollision: simState.ContinuousCollision,
+		SpawnRules:          simState.SpawnRules,
+		Fields:              append([]ForceField(nil), simState.Fields...),
+		Hooks:               simState.Hooks,
+		BodyLimit:           simState.BodyLimit,
+		Capacity:            simState.Capacity,
+		Lifetime:            simState.Lifetime,
+		Bodies:              append(make([]BodyData, 0, cap(simState.Bodies)), simState.Bodies...),
+		IdPool:              simState.IdPool.Clone(),
+	}
+}
+
+// PredictTrajectory adds a validated body to a fork of the simulation and
+// runs it for the ticks of options, returning the body's path and fate. The
+// body is given the id its spawn would get. The fork is modified and must not
+// be shared, it is not locked for longer than a tick.
+func PredictTrajectory(fork *SimulationState, body BodyData, options PreviewOptions) Prediction {
+	stride := max(options.Stride, 1)
+	prediction := Prediction{Points: []mgl32.Vec2{body.P}, Fate: FateOrbit}
+
+	body.I = fork.IdPool.DequeueId()
+	body.Age = 0
+	fork.Bodies = append(fork.Bodies, body)
+
+	for tick := 1; tick <= options.Ticks; tick++ {
+		if !options.Deadline.IsZero() && time.Now().After(options.Deadline) {
+			prediction.Fate = FateUnknown
+			return prediction
+		}
+
+		var fate Fate
+		var into *uint16
+		var last mgl32.Vec2
+		if options.Mode == PreviewFull {
+			UpdateSimulationState(fork, options.DeltaTime)
+			fate, into, last = previewFate(fork, body.I)
+		} else {
+			fate, into, last = stepFrozen(fork, body.I, options.DeltaTime)
+		}
+
+		prediction.Ticks = tick
+		if len(fate) > 0 {
+			prediction.Points = append(prediction.Points, last)
+			prediction.Fate = fate
+			prediction.Into = into
+			return prediction
+		}
+
+		if tick%stride == 0 || tick == options.Ticks {
+			prediction.Points = append(prediction.Points, fork.Bodies[findBody(fork, body.I)].P)
+		}
+	}
+	return prediction
+}
+
+// previewFate reads the fate of body from the events of the tick that just
+// ran on a fork and clears them, the fate is empty while the body lives
+func previewFate(fork *SimulationState, body uint16) (Fate, *uint16, mgl32.Vec2) {
+	defer fork.Mu.Unlock()
+	fork.Mu.Lock()
+
+	events := fork.events.pending
+	fork.events.pending = fork.events.pending[:0]
+	for _, event := range events {
+		if event.Body != body {
+			continue
+		}
+
+		switch event.Kind {
+		case EventMerged:
+			return FateMerge, event.Into, event.P
+		case EventEscaped:
+			return FateEscape, nil, event.P
+		case EventRemoved:
+			return FateRemoved, nil, event.P
+		}
+	}
+	return "", nil, mgl32.Vec2{}
+}
+
+// stepFrozen moves body through one tick of a fork the same way
+// UpdateSimulationState would while every other body stays still, returning
+// its fate like previewFate
+func stepFrozen(fork *SimulationState, id uint16, deltaTime float32) (Fate, *uint16, mgl32.Vec2) {
+	defer fork.Mu.Unlock()
+	fork.Mu.Lock()
+
+	hooks := fork.hooks()
+	index := findBody(fork, id)
+	body := &fork.Bodies[index]
+	deltaTime *= fork.TimeScale
+
+	forces := mgl32.Vec2{0, 0}
+	for j := range fork.Bodies {
+		if j == index {
+			continue
+		}
+		forces = forces.Add(calculateForces2(fork.GravityConstant, body.P.X(), body.P.Y(), body.M, fork.Bodies[j].P.X(), fork.Bodies[j].P.Y(), fork.Bodies[j].M))
+	}
+
+	forces = clampVectorMagnitude(forces, fork.MaxVelocity)
+	acceleration := forces.Mul(dampFactor(fork, body.M)).Add(fieldAcceleration(fork.Fields, body))
+	body.V = clampVectorMagnitude(body.V.Add(acceleration.Mul(deltaTime)), fork.MaxVelocity)
+
+	previous := body.P
+	body.P = body.P.Add(body.V.Mul(deltaTime))
+	if body.P.Len() > fork.Bounds && hooks.OnEscape(fork, body) {
+		return FateEscape, nil, body.P
+	}
+
+	absorbed := make(map[int]bool)
+	for j := range fork.Bodies {
+		if j == index {
+			continue
+		}
+
+		// a copy so bounces leave the frozen body where it is
+		other := fork.Bodies[j]
+		var collided bool
+		var impact float32
+		if fork.ContinuousCollision {
+			impact, collided = sweptCircleImpact(previous, body.P, other.P, other.P, body.R+other.R)
+		} else {
+			collided = body.P.Sub(other.P).Len() < body.R+other.R
+		}
+
+		if !collided {
+			continue
+		}
+
+		switch hooks.OnCollision(fork, body, &other, body.V.Sub(other.V).Len()) {
+		case CollisionMerge:
+			if body.R <= other.R {
+				return FateMerge, &other.I, body.P
+			}
+			absorb(body, &other, fork.MassScale)
+			absorbed[j] = true
+		case CollisionBounce:
+			if fork.ContinuousCollision {
+				body.P = impactPosition(previous, body.P, impact)
+			}
+			bounce(body, &other)
+		case CollisionDestroy:
+			return FateRemoved, nil, body.P
+		}
+	}
+
+	if len(absorbed) > 0 {
+		remaining := fork.Bodies[:0]
+		for j, other := range fork.Bodies {
+			if !absorbed[j] {
+				remaining = append(remaining, other)
+			}
+		}
+		fork.Bodies = remaining
+	}
+	return "", nil, mgl32.Vec2{}
+}
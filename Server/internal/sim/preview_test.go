@@ -0,0 +1,110 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestParsePreviewMode(t *testing.T) {
+	for _, mode := range []PreviewMode{PreviewFrozen, PreviewFull} {
+		if parsed, err := ParsePreviewMode(string(mode)); err != nil || parsed != mode {
+			t.Errorf("Parsed preview mode %q is %q %v, expected %q", mode, parsed, err, mode)
+		}
+	}
+
+	if _, err := ParsePreviewMode("fast"); err == nil {
+		t.Errorf("Parsed unknown preview mode, expected an error")
+	}
+}
+
+func TestForkSimulationState(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	AddSimulationBody(state, BodyData{R: 5})
+
+	fork := ForkSimulationState(state)
+	fork.Bodies[0].P = mgl32.Vec2{10, 10}
+	if _, err := AddSimulationBody(fork, BodyData{P: mgl32.Vec2{20, 0}, R: 1}); err != nil {
+		t.Fatalf("Error adding body to fork %v", err)
+	}
+
+	if len(state.Bodies) != 1 || state.Bodies[0].P != (mgl32.Vec2{0, 0}) {
+		t.Errorf("Simulation bodies are %v after changing the fork, expected them unchanged", state.Bodies)
+	}
+
+	// the fork hands out the same ids as the simulation
+	id, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{20, 0}, R: 1})
+	if id != fork.Bodies[1].I {
+		t.Errorf("Simulation spawn id is %v, expected the fork's %v", id, fork.Bodies[1].I)
+	}
+}
+
+func TestPredictTrajectoryOrbit(t *testing.T) {
+	for _, mode := range []PreviewMode{PreviewFrozen, PreviewFull} {
+		state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+		AddSimulationBody(state, BodyData{R: 5})
+
+		body := BodyData{P: mgl32.Vec2{20, 0}, R: 0.5}
+		ValidateSpawn(state, &body)
+		AssignOrbit(state, &body, OrbitOptions{})
+
+		prediction := PredictTrajectory(ForkSimulationState(state), body, PreviewOptions{Mode: mode, Ticks: 120, DeltaTime: 1.0 / 60, Stride: 10})
+		if prediction.Fate != FateOrbit || prediction.Ticks != 120 {
+			t.Errorf("%v prediction is %v after %v ticks, expected %v after %v", mode, prediction.Fate, prediction.Ticks, FateOrbit, 120)
+		}
+
+		if len(prediction.Points) != 13 {
+			t.Errorf("%v prediction has %v points, expected %v", mode, len(prediction.Points), 13)
+		}
+
+		for _, point := range prediction.Points {
+			if distance := point.Len(); distance < 18 || distance > 22 {
+				t.Errorf("%v prediction point %v is %v from the parent, expected about %v", mode, point, distance, 20)
+			}
+		}
+
+		if len(state.Bodies) != 1 || state.Bodies[0].P != (mgl32.Vec2{0, 0}) {
+			t.Errorf("Simulation bodies are %v after a preview, expected them unchanged", state.Bodies)
+		}
+	}
+}
+
+func TestPredictTrajectoryFate(t *testing.T) {
+	for _, mode := range []PreviewMode{PreviewFrozen, PreviewFull} {
+		state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+		star, _ := AddSimulationBody(state, BodyData{R: 5})
+		options := PreviewOptions{Mode: mode, Ticks: 600, DeltaTime: 1.0 / 60, Stride: 10}
+
+		falling := BodyData{P: mgl32.Vec2{20, 0}, R: 0.5}
+		ValidateSpawn(state, &falling)
+		prediction := PredictTrajectory(ForkSimulationState(state), falling, options)
+		if prediction.Fate != FateMerge || prediction.Into == nil || *prediction.Into != star {
+			t.Errorf("%v falling body fate is %v into %v, expected %v into %v", mode, prediction.Fate, prediction.Into, FateMerge, star)
+		}
+
+		state.Bounds = 200
+		escaping := BodyData{P: mgl32.Vec2{20, 0}, V: mgl32.Vec2{100, 0}, R: 0.5}
+		ValidateSpawn(state, &escaping)
+		prediction = PredictTrajectory(ForkSimulationState(state), escaping, options)
+		if prediction.Fate != FateEscape {
+			t.Errorf("%v escaping body fate is %v, expected %v", mode, prediction.Fate, FateEscape)
+		}
+
+		if last := prediction.Points[len(prediction.Points)-1]; last.Len() <= state.Bounds {
+			t.Errorf("%v escaping body ends at %v, expected outside of %v", mode, last, state.Bounds)
+		}
+	}
+}
+
+func TestPredictTrajectoryDeadline(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	AddSimulationBody(state, BodyData{R: 5})
+
+	body := BodyData{P: mgl32.Vec2{20, 0}, R: 0.5}
+	ValidateSpawn(state, &body)
+	prediction := PredictTrajectory(ForkSimulationState(state), body, PreviewOptions{Mode: PreviewFull, Ticks: 600, DeltaTime: 1.0 / 60, Deadline: time.Now().Add(-time.Second)})
+	if prediction.Fate != FateUnknown || prediction.Ticks != 0 {
+		t.Errorf("Prediction past its deadline is %v after %v ticks, expected %v after %v", prediction.Fate, prediction.Ticks, FateUnknown, 0)
+	}
+}
@@ -0,0 +1,252 @@
+package sim
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type SchedulerConfig struct {
+	// Interval is the fixed simulation step
+	Interval time.Duration
+
+	// MaxStepsPerFrame caps how many steps are run to catch up after a late
+	// wake up, time beyond the cap is dropped and counted as an overrun
+	MaxStepsPerFrame int
+
+	// Budget is the fraction of Interval a step may take before the frame is
+	// counted as over budget
+	Budget float64
+
+	// LoadShedding lowers the body limit and send rate after ShedAfter
+	// consecutive frames over budget, and restores them after RecoverAfter
+	// consecutive frames within budget
+	LoadShedding bool
+	ShedAfter    int
+	RecoverAfter int
+	MaxShedLevel int
+
+	// ShedBodyFactor is the fraction of the body capacity removed per level
+	ShedBodyFactor float32
+}
+
+func DefaultSchedulerConfig(interval time.Duration) SchedulerConfig {
+	return SchedulerConfig{
+		Interval:         interval,
+		MaxStepsPerFrame: 4,
+		Budget:           0.8,
+		LoadShedding:     true,
+		ShedAfter:        60,
+		RecoverAfter:     300,
+		MaxShedLevel:     3,
+		ShedBodyFactor:   0.25,
+	}
+}
+
+type SchedulerStats struct {
+	Tick         uint64        `json:"tick"`
+	Frames       uint64        `json:"frames"`
+	Overruns     uint64        `json:"overruns"`
+	DroppedTime  time.Duration `json:"droppedTime"`
+	LastStepCost time.Duration `json:"lastStepCost"`
+	AvgStepCost  time.Duration `json:"avgStepCost"`
+	ShedLevel    int           `json:"shedLevel"`
+	BodyLimit    int           `json:"bodyLimit"`
+	SendEvery    int           `json:"sendEvery"`
+}
+
+// overrunLogInterval is the least time between overrun warnings, overruns in
+// between are summed into the next one
+const overrunLogInterval = 10 * time.Second
+
+// Scheduler runs the simulation at a fixed step against the wall clock,
+// catching up on missed steps instead of silently running slow
+type Scheduler struct {
+	config SchedulerConfig
+	state  *SimulationState
+	clock  func() time.Time
+
+	accumulator time.Duration
+	overBudget  int
+	underBudget int
+
+	// overruns since the last overrun warning, guarded by mu
+	lastOverrunLog   time.Time
+	unloggedOverruns uint64
+	unloggedDropped  time.Duration
+
+	mu    sync.Mutex
+	stats SchedulerStats
+}
+
+func NewScheduler(state *SimulationState, config SchedulerConfig) *Scheduler {
+	if config.MaxStepsPerFrame < 1 {
+		config.MaxStepsPerFrame = 1
+	}
+
+	return &Scheduler{
+		config: config,
+		state:  state,
+		clock:  time.Now,
+		stats:  SchedulerStats{BodyLimit: cap(state.Bodies), SendEvery: 1},
+	}
+}
+
+// Stats returns a copy of the scheduler counters, safe to call from any goroutine
+func (scheduler *Scheduler) Stats() SchedulerStats {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	return scheduler.stats
+}
+
+// Run steps the simulation until quit receives true, sending the latest tick
+// on updated after each frame without waiting for a slow receiver, updated
+// may be nil when frames are sent on their own schedule
+func (scheduler *Scheduler) Run(quit chan bool, updated chan uint64) {
+	timer := time.NewTimer(scheduler.config.Interval)
+	last := scheduler.clock()
+
+	for {
+		select {
+		case <-timer.C:
+			now := scheduler.clock()
+			steps := scheduler.advance(now.Sub(last))
+			last = now
+
+			stats := scheduler.Stats()
+			if steps > 0 && stats.Frames%uint64(stats.SendEvery) == 0 {
+				select {
+				case updated <- stats.Tick:
+				default:
+				}
+			}
+
+			// wake up when the accumulator next holds a full step
+			timer.Reset(scheduler.config.Interval - scheduler.accumulator)
+		case shouldQuit := <-quit:
+			if shouldQuit {
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// advance adds elapsed wall time to the accumulator and runs as many fixed
+// steps as it holds, up to MaxStepsPerFrame, returning the steps run
+func (scheduler *Scheduler) advance(elapsed time.Duration) int {
+	interval := scheduler.config.Interval
+	deltaTime := float32(interval) / float32(time.Second)
+	scheduler.accumulator += elapsed
+
+	steps := 0
+	cost := time.Duration(0)
+	for scheduler.accumulator >= interval && steps < scheduler.config.MaxStepsPerFrame {
+		start := scheduler.clock()
+		UpdateSimulationState(scheduler.state, deltaTime)
+		cost += scheduler.clock().Sub(start)
+
+		scheduler.accumulator -= interval
+		steps++
+
+		scheduler.mu.Lock()
+		scheduler.stats.Tick++
+		tick := scheduler.stats.Tick
+		scheduler.mu.Unlock()
+		// publish first so subscribers have the events before the tick is visible
+		scheduler.state.PublishEvents(tick)
+		scheduler.state.RecordTick(tick, scheduler.clock())
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if scheduler.accumulator >= interval {
+		// drop the backlog rather than spiral trying to catch up
+		dropped := scheduler.accumulator - scheduler.accumulator%interval
+		scheduler.accumulator -= dropped
+		scheduler.stats.Overruns++
+		scheduler.stats.DroppedTime += dropped
+		scheduler.logOverrun(dropped)
+	}
+
+	if steps == 0 {
+		return 0
+	}
+
+	scheduler.stats.Frames++
+	stepCost := cost / time.Duration(steps)
+	scheduler.stats.LastStepCost = stepCost
+	if scheduler.stats.AvgStepCost == 0 {
+		scheduler.stats.AvgStepCost = stepCost
+	} else {
+		scheduler.stats.AvgStepCost += (stepCost - scheduler.stats.AvgStepCost) / 8
+	}
+
+	if scheduler.config.LoadShedding {
+		scheduler.updateShedLevel(stepCost > time.Duration(float64(interval)*scheduler.config.Budget))
+	}
+
+	return steps
+}
+
+// logOverrun warns about dropped simulation time at most once per
+// overrunLogInterval, the caller must hold mu
+func (scheduler *Scheduler) logOverrun(dropped time.Duration) {
+	scheduler.unloggedOverruns++
+	scheduler.unloggedDropped += dropped
+
+	now := scheduler.clock()
+	if !scheduler.lastOverrunLog.IsZero() && now.Sub(scheduler.lastOverrunLog) < overrunLogInterval {
+		return
+	}
+
+	slog.Warn("Simulation overrun dropped time", "overruns", scheduler.unloggedOverruns, "dropped", scheduler.unloggedDropped, "totalOverruns", scheduler.stats.Overruns, "totalDropped", scheduler.stats.DroppedTime)
+	scheduler.lastOverrunLog = now
+	scheduler.unloggedOverruns = 0
+	scheduler.unloggedDropped = 0
+}
+
+// updateShedLevel moves the shed level after enough consecutive frames over
+// or within budget, the caller must hold mu
+func (scheduler *Scheduler) updateShedLevel(over bool) {
+	level := scheduler.stats.ShedLevel
+	if over {
+		scheduler.underBudget = 0
+		scheduler.overBudget++
+		if scheduler.overBudget >= scheduler.config.ShedAfter && level < scheduler.config.MaxShedLevel {
+			scheduler.overBudget = 0
+			level++
+		}
+	} else {
+		scheduler.overBudget = 0
+		scheduler.underBudget++
+		if scheduler.underBudget >= scheduler.config.RecoverAfter && level > 0 {
+			scheduler.underBudget = 0
+			level--
+		}
+	}
+
+	if level == scheduler.stats.ShedLevel {
+		return
+	}
+
+	scheduler.state.Mu.Lock()
+	capacity := cap(scheduler.state.Bodies)
+	limit := int(float32(capacity) * (1 - float32(level)*scheduler.config.ShedBodyFactor))
+	if limit < 1 {
+		limit = 1
+	}
+
+	scheduler.state.BodyLimit = limit
+	if level == 0 {
+		scheduler.state.BodyLimit = 0
+	}
+	scheduler.state.Mu.Unlock()
+
+	scheduler.stats.ShedLevel = level
+	scheduler.stats.BodyLimit = limit
+	scheduler.stats.SendEvery = 1 << level
+
+	slog.Warn("Simulation load shedding changed", "level", level, "bodyLimit", limit, "sendEvery", scheduler.stats.SendEvery, "avgStepCost", scheduler.stats.AvgStepCost)
+}
@@ -0,0 +1,155 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock advances by step every time it is read so step costs are predictable
+type fakeClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (clock *fakeClock) read() time.Time {
+	clock.now = clock.now.Add(clock.step)
+	return clock.now
+}
+
+func TestSchedulerAccumulator(t *testing.T) {
+	state := CreateEmptySimulationState(10, 1, 1, 10, 100, 1000, 1)
+	scheduler := NewScheduler(state, DefaultSchedulerConfig(10*time.Millisecond))
+
+	if steps := scheduler.advance(5 * time.Millisecond); steps != 0 {
+		t.Errorf("Steps after half an interval is %v, expected %v", steps, 0)
+	}
+
+	if steps := scheduler.advance(5 * time.Millisecond); steps != 1 {
+		t.Errorf("Steps after a full interval is %v, expected %v", steps, 1)
+	}
+
+	if steps := scheduler.advance(25 * time.Millisecond); steps != 2 {
+		t.Errorf("Steps after two and a half intervals is %v, expected %v", steps, 2)
+	}
+
+	if scheduler.accumulator != 5*time.Millisecond {
+		t.Errorf("Accumulator is %v, expected %v", scheduler.accumulator, 5*time.Millisecond)
+	}
+
+	stats := scheduler.Stats()
+	if stats.Tick != 3 {
+		t.Errorf("Tick is %v, expected %v", stats.Tick, 3)
+	}
+
+	if tick, _ := state.LastTick(); tick != 3 {
+		t.Errorf("State LastTick is %v, expected %v", tick, 3)
+	}
+
+	if stats.Overruns != 0 {
+		t.Errorf("Overruns is %v, expected %v", stats.Overruns, 0)
+	}
+}
+
+func TestSchedulerOverrun(t *testing.T) {
+	state := CreateEmptySimulationState(10, 1, 1, 10, 100, 1000, 1)
+	config := DefaultSchedulerConfig(10 * time.Millisecond)
+	config.MaxStepsPerFrame = 3
+	scheduler := NewScheduler(state, config)
+
+	if steps := scheduler.advance(105 * time.Millisecond); steps != 3 {
+		t.Errorf("Steps after a long stall is %v, expected %v", steps, 3)
+	}
+
+	stats := scheduler.Stats()
+	if stats.Overruns != 1 {
+		t.Errorf("Overruns is %v, expected %v", stats.Overruns, 1)
+	}
+
+	if stats.DroppedTime != 70*time.Millisecond {
+		t.Errorf("DroppedTime is %v, expected %v", stats.DroppedTime, 70*time.Millisecond)
+	}
+
+	if scheduler.accumulator != 5*time.Millisecond {
+		t.Errorf("Accumulator is %v, expected %v", scheduler.accumulator, 5*time.Millisecond)
+	}
+}
+
+func TestSchedulerLoadShedding(t *testing.T) {
+	state := CreateEmptySimulationState(100, 1, 1, 10, 100, 1000, 1)
+	config := DefaultSchedulerConfig(10 * time.Millisecond)
+	config.ShedAfter = 2
+	config.RecoverAfter = 2
+	scheduler := NewScheduler(state, config)
+
+	// every step costs the full interval, well over the 80% budget
+	clock := &fakeClock{now: time.Now(), step: 10 * time.Millisecond}
+	scheduler.clock = clock.read
+
+	for i := 0; i < 2; i++ {
+		scheduler.advance(10 * time.Millisecond)
+	}
+
+	stats := scheduler.Stats()
+	if stats.ShedLevel != 1 {
+		t.Fatalf("ShedLevel is %v, expected %v", stats.ShedLevel, 1)
+	}
+
+	if state.BodyLimit != 75 {
+		t.Errorf("BodyLimit is %v, expected %v", state.BodyLimit, 75)
+	}
+
+	if stats.SendEvery != 2 {
+		t.Errorf("SendEvery is %v, expected %v", stats.SendEvery, 2)
+	}
+
+	// cheap steps recover the level
+	clock.step = 0
+	for i := 0; i < 2; i++ {
+		scheduler.advance(10 * time.Millisecond)
+	}
+
+	stats = scheduler.Stats()
+	if stats.ShedLevel != 0 {
+		t.Errorf("Recovered ShedLevel is %v, expected %v", stats.ShedLevel, 0)
+	}
+
+	if state.BodyLimit != 0 {
+		t.Errorf("Recovered BodyLimit is %v, expected %v", state.BodyLimit, 0)
+	}
+}
+
+func TestSchedulerBodyLimit(t *testing.T) {
+	state := CreateEmptySimulationState(10, 1, 1, 10, 100, 1000, 1)
+	state.BodyLimit = 3
+
+	for i := 0; i < 5; i++ {
+		AddSimulationBody(state, BodyData{R: 1})
+	}
+
+	if len(state.Bodies) != 3 {
+		t.Errorf("len(Bodies) is %v, expected %v", len(state.Bodies), 3)
+	}
+}
+
+func TestSchedulerOverrunLog(t *testing.T) {
+	state := CreateEmptySimulationState(10, 1, 1, 10, 100, 1000, 1)
+	config := DefaultSchedulerConfig(10 * time.Millisecond)
+	config.MaxStepsPerFrame = 1
+	scheduler := NewScheduler(state, config)
+	now := time.Unix(1000, 0)
+	scheduler.clock = func() time.Time { return now }
+
+	// the first overrun is logged, the next ones wait for the interval
+	scheduler.advance(50 * time.Millisecond)
+	scheduler.advance(50 * time.Millisecond)
+	scheduler.advance(50 * time.Millisecond)
+	if scheduler.unloggedOverruns != 2 {
+		t.Errorf("Unlogged overruns is %v, expected %v", scheduler.unloggedOverruns, 2)
+	}
+
+	now = now.Add(overrunLogInterval)
+	scheduler.advance(50 * time.Millisecond)
+	if scheduler.unloggedOverruns != 0 || scheduler.unloggedDropped != 0 {
+		t.Errorf("Unlogged overruns is %v dropping %v after the interval, expected %v", scheduler.unloggedOverruns, scheduler.unloggedDropped, 0)
+	}
+}
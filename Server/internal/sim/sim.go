@@ -3,9 +3,10 @@ package sim
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"log/slog"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-gl/mathgl/mgl32"
@@ -23,21 +24,78 @@ type SimulationState struct {
 	DampScale       float32
 	Bounds          float32
 
+	// ContinuousCollision sweeps each pair of bodies along their step
+	// displacement instead of only testing end-of-step overlap
+	ContinuousCollision bool
+
+	SpawnRules SpawnRules
+
+	// Fields apply extra forces to every body on top of gravity
+	Fields []ForceField
+
+	// Hooks overrides what happens on spawns, collisions, escapes and ticks,
+	// DefaultHooks is used when nil
+	Hooks Hooks
+
+	// BodyLimit lowers the effective capacity while shedding load, 0 uses cap(Bodies)
+	BodyLimit int
+
+	// Capacity decides what happens to spawns once the simulation is full
+	Capacity CapacityPolicy
+
+	// Lifetime removes bodies after a while and shrinks away small debris
+	Lifetime LifetimeRules
+
+	// DebugDumpDir receives a copy of the pre tick state whenever a tick
+	// produces invalid bodies, dumps are disabled when empty
+	DebugDumpDir string
+	Invariants   InvariantStats
+
 	Bodies []BodyData
 	IdPool idpool.IDPool
+
+	// ids of removed bodies, returned to IdPool once a whole tick has passed
+	// without them so clients never mistake a new body for the old one
+	released  []uint16
+	recycling []uint16
+
+	// events of the tick in progress and their subscribers
+	events eventBus
+
+	// bodies held with the grab tool keyed by the player holding them
+	grabs map[uint64]*grab
+
+	// last completed tick and body counts, readable without holding Mu
+	tick       atomic.Uint64
+	lastTickAt atomic.Int64
+	summary    atomic.Pointer[Summary]
+}
+
+// Summary is the size and health of the simulation as of its last change,
+// readable without holding the simulation lock
+type Summary struct {
+	Bodies     int
+	MaxBodies  int
+	Invariants InvariantStats
 }
 
 func CreateEmptySimulationState(maxBodies int, gravityConstant float32, timeScale float32, massScale float32, maxVelocity float32, bounds float32, dampening float32) *SimulationState {
-	return &SimulationState{
-		GravityConstant: gravityConstant,
-		TimeScale:       timeScale,
-		MassScale:       massScale,
-		MaxVelocity:     maxVelocity,
-		DampScale:       dampening,
-		Bounds:          bounds,
-		Bodies:          make([]BodyData, 0, maxBodies),
-		IdPool:          idpool.NewIDPool(maxBodies, 10),
+	simState := &SimulationState{
+		GravityConstant:     gravityConstant,
+		TimeScale:           timeScale,
+		MassScale:           massScale,
+		MaxVelocity:         maxVelocity,
+		DampScale:           dampening,
+		Bounds:              bounds,
+		ContinuousCollision: true,
+		SpawnRules:          DefaultSpawnRules(bounds),
+		Hooks:               DefaultHooks{},
+		Capacity:            CapacityReject,
+		Bodies:              make([]BodyData, 0, maxBodies),
+		IdPool:              idpool.NewIDPool(maxBodies, 10),
 	}
+	simState.storeSummary()
+	return simState
 }
 
 const BodyPacketBits = 16 + 32 + 32 + 32 + 32 + 32 + 32 + 8
@@ -61,6 +119,12 @@ type BodyData struct {
 	M float32    `json:"m"`
 	R float32    `json:"r"`
 	T uint8      `json:"t"`
+
+	// connection that spawned the body, 0 for none, never sent to clients
+	Owner uint64 `json:"-"`
+
+	// seconds of simulation the body has been alive for
+	Age float32 `json:"-"`
 }
 
 func (data *BodyData) Pack() ([]byte, error) {
@@ -78,7 +142,7 @@ func (data *BodyData) Pack() ([]byte, error) {
 
 	err := binary.Write(buffer, binary.LittleEndian, packet)
 	if err != nil {
-		fmt.Printf("Error packing BodyData %v\n", err)
+		slog.Error("Error packing BodyData", "body", data.I, "err", err)
 		return nil, err
 	}
 
@@ -91,7 +155,7 @@ func UnpackBodyData(packet []byte, data *BodyData) error {
 	var dataOut BodyPacket
 	err := binary.Read(reader, binary.LittleEndian, &dataOut)
 	if err != nil {
-		fmt.Printf("Error binary reading packet %v\n", err)
+		slog.Debug("Error binary reading packet", "bytes", len(packet), "err", err)
 		return err
 	}
 
@@ -128,41 +192,133 @@ func (data *BodyData) CleanBodyData(massScale float32) {
 	}
 }
 
+// StartSimulation runs the simulation on a default scheduler stepping every delay
 func StartSimulation(state *SimulationState, delay time.Duration, quit chan bool, updated chan uint64) {
-	count := uint64(0)
-	deltaTime := float32(delay) / float32(time.Second)
-	tick := time.NewTicker(delay)
-
-	for {
-		select {
-		case <-tick.C:
-			UpdateSimulationState(state, float32(deltaTime))
-			count++
-			updated <- count
-		case shouldQuit := <-quit:
-			if shouldQuit {
-				tick.Stop()
-				break
-			}
-		}
+	NewScheduler(state, DefaultSchedulerConfig(delay)).Run(quit, updated)
+}
+
+// RecordTick stores the number and completion time of the latest tick
+func (state *SimulationState) RecordTick(tick uint64, at time.Time) {
+	state.tick.Store(tick)
+	state.lastTickAt.Store(at.UnixNano())
+}
+
+// storeSummary publishes the body counts for Summary, the caller must hold
+// the simulation lock
+func (state *SimulationState) storeSummary() {
+	state.summary.Store(&Summary{Bodies: len(state.Bodies), MaxBodies: cap(state.Bodies), Invariants: state.Invariants})
+}
+
+// Summary returns the body counts and invariant stats without taking the
+// simulation lock, so it answers even while the simulation is stuck
+func (state *SimulationState) Summary() Summary {
+	if summary := state.summary.Load(); summary != nil {
+		return *summary
 	}
+	return Summary{}
 }
 
-func AddSimulationBody(simState *SimulationState, body BodyData) {
-	if len(simState.Bodies) >= cap(simState.Bodies)-1 {
-		fmt.Println("Ignoring added simulation body due to full capacity")
-		return
+// LastTick returns the latest completed tick and when it finished, the time
+// is zero until the first tick completes
+func (state *SimulationState) LastTick() (uint64, time.Time) {
+	at := state.lastTickAt.Load()
+	if at == 0 {
+		return 0, time.Time{}
 	}
+	return state.tick.Load(), time.Unix(0, at)
+}
 
-	body.I = simState.IdPool.DequeueId()
+// AddSimulationBody assigns the body an id and adds it, returning the id,
+// ErrSimulationFull when there is no room or the error of a vetoing hook
+func AddSimulationBody(simState *SimulationState, body BodyData) (uint16, error) {
+	result, err := SpawnSimulationBody(simState, body)
+	return result.ID, err
+}
+
+// SpawnSimulationBody adds a body like AddSimulationBody, evicting a body to
+// make room for it when the capacity policy allows
+func SpawnSimulationBody(simState *SimulationState, body BodyData) (SpawnResult, error) {
+	result := SpawnResult{}
 	body.CleanBodyData(simState.MassScale)
+	if err := simState.hooks().OnSpawn(simState, &body); err != nil {
+		return result, err
+	}
+
+	if len(simState.Bodies) >= simState.bodyLimit() {
+		evicted, ok := makeRoom(simState, body.Owner)
+		if !ok {
+			slog.Debug("Ignoring added simulation body due to full capacity", "bodies", len(simState.Bodies), "policy", simState.Capacity)
+			return result, ErrSimulationFull
+		}
+		result.Evicted = append(result.Evicted, evicted)
+	}
+
+	body.I = simState.IdPool.DequeueId()
+	body.Age = 0
 	simState.Bodies = append(simState.Bodies, body)
+	simState.storeSummary()
+	simState.emit(Event{Kind: EventSpawned, Body: body.I, P: body.P, Owner: body.Owner})
+	result.ID = body.I
+	return result, nil
+}
+
+// releaseId queues the id of a removed body for reuse, the caller must hold
+// the simulation lock
+func (simState *SimulationState) releaseId(id uint16) {
+	simState.released = append(simState.released, id)
+}
+
+// recycleIds returns the ids released before the previous tick to IdPool, it
+// is called at the start of every tick with the simulation lock held
+func recycleIds(simState *SimulationState) {
+	for _, id := range simState.recycling {
+		simState.IdPool.EnqueueId(id)
+	}
+	simState.recycling, simState.released = simState.released, simState.recycling[:0]
+}
+
+// RemoveSimulationBodies removes every body matched by remove and returns how
+// many were removed, the caller must hold the simulation lock
+func RemoveSimulationBodies(simState *SimulationState, reason RemoveReason, remove func(body *BodyData) bool) int {
+	remaining := simState.Bodies[:0]
+	for i := range simState.Bodies {
+		body := simState.Bodies[i]
+		if remove(&body) {
+			simState.emit(Event{Kind: EventRemoved, Body: body.I, Reason: reason, P: body.P, Owner: body.Owner})
+			continue
+		}
+		remaining = append(remaining, body)
+	}
+
+	removed := len(simState.Bodies) - len(remaining)
+	simState.Bodies = remaining
+	simState.storeSummary()
+	return removed
 }
 
 func UpdateSimulationState(simState *SimulationState, deltaTime float32) {
 	defer simState.Mu.Unlock()
 	simState.Mu.Lock()
+	defer simState.storeSummary()
+
+	recycleIds(simState)
+
+	var preTick []BodyData
+	if len(simState.DebugDumpDir) > 0 {
+		preTick = append(preTick, simState.Bodies...)
+	}
+
+	// quarantine anything invalid that arrived between ticks before it can
+	// poison the other bodies through the force loop, then check the results
+	enforceInvariants(simState, preTick, deltaTime)
+	defer enforceInvariants(simState, preTick, deltaTime)
 
+	hooks := simState.hooks()
+	defer hooks.OnTick(simState, deltaTime)
+
+	applyLifetime(simState, deltaTime)
+
+	tickTime := deltaTime
 	deltaTime *= simState.TimeScale
 	blen := len(simState.Bodies)
 
@@ -180,20 +336,29 @@ func UpdateSimulationState(simState *SimulationState, deltaTime float32) {
 		forces = clampVectorMagnitude(forces, simState.MaxVelocity)
 		m2 := 1.0 / pow32(1.0+simState.Bodies[i].M, simState.DampScale)
 		// m2 := 1.0 / (1.0 + simState.Bodies[i].M*10.0)
-		simState.Bodies[i].V = clampVectorMagnitude(simState.Bodies[i].V.Add(forces.Mul(m2).Mul(deltaTime)), simState.MaxVelocity)
+		acceleration := forces.Mul(m2).Add(fieldAcceleration(simState.Fields, &simState.Bodies[i]))
+		simState.Bodies[i].V = clampVectorMagnitude(simState.Bodies[i].V.Add(acceleration.Mul(deltaTime)), simState.MaxVelocity)
 	}
 
+	applyGrabs(simState, tickTime, deltaTime)
+
+	// keep the start of step positions around for swept collision checks
+	previous := make([]mgl32.Vec2, blen)
+
 	// use an empty struct map as a setsddsd
 	toRemoveMap := make(map[int]bool)
 	for i := 0; i < blen; i++ {
+		previous[i] = simState.Bodies[i].P
 		simState.Bodies[i].P = simState.Bodies[i].P.Add(simState.Bodies[i].V.Mul(deltaTime))
 
 		// add out of bounds bodies to the remove set
-		if simState.Bodies[i].P.Len() > simState.Bounds {
+		if simState.Bodies[i].P.Len() > simState.Bounds && hooks.OnEscape(simState, &simState.Bodies[i]) {
 			toRemoveMap[i] = true
+			simState.emit(Event{Kind: EventEscaped, Body: simState.Bodies[i].I, P: simState.Bodies[i].P, Owner: simState.Bodies[i].Owner})
 		}
 	}
 
+	resolved := make(map[[2]int]bool)
 	for i := 0; i < blen; i++ {
 		// skip entries in the remove set
 		if _, ok := toRemoveMap[i]; ok {
@@ -210,15 +375,56 @@ func UpdateSimulationState(simState *SimulationState, deltaTime float32) {
 				continue
 			}
 
-			diff := simState.Bodies[i].P.Sub(simState.Bodies[j].P).Len()
-			if diff < (simState.Bodies[i].R + simState.Bodies[j].R) {
-				if simState.Bodies[i].R > simState.Bodies[j].R {
+			var collided bool
+			var impact float32
+			if simState.ContinuousCollision {
+				impact, collided = sweptCircleImpact(previous[i], simState.Bodies[i].P, previous[j], simState.Bodies[j].P, simState.Bodies[i].R+simState.Bodies[j].R)
+			} else {
+				diff := simState.Bodies[i].P.Sub(simState.Bodies[j].P).Len()
+				collided = diff < (simState.Bodies[i].R + simState.Bodies[j].R)
+			}
+
+			if !collided {
+				continue
+			}
+
+			// outcomes that keep both bodies would otherwise be applied again
+			// when the pair is visited the other way around
+			pair := [2]int{min(i, j), max(i, j)}
+			if resolved[pair] {
+				continue
+			}
+
+			a, b := &simState.Bodies[i], &simState.Bodies[j]
+			switch hooks.OnCollision(simState, a, b, a.V.Sub(b.V).Len()) {
+			case CollisionMerge:
+				if a.R > b.R {
+					emitMerge(simState, toRemoveMap, j, i)
 					toRemoveMap[j] = true
-					absorb(&simState.Bodies[i], &simState.Bodies[j], simState.MassScale)
+					absorb(a, b, simState.MassScale)
 				} else {
+					emitMerge(simState, toRemoveMap, i, j)
 					toRemoveMap[i] = true
-					absorb(&simState.Bodies[j], &simState.Bodies[i], simState.MassScale)
+					absorb(b, a, simState.MassScale)
+				}
+			case CollisionBounce:
+				resolved[pair] = true
+				// fast bodies may have passed each other by the end of the
+				// step, bounce them where they touched so the normal is right
+				if simState.ContinuousCollision {
+					a.P = impactPosition(previous[i], a.P, impact)
+					b.P = impactPosition(previous[j], b.P, impact)
 				}
+				bounce(a, b)
+			case CollisionDestroy:
+				for _, k := range pair {
+					if !toRemoveMap[k] {
+						toRemoveMap[k] = true
+						simState.emit(Event{Kind: EventRemoved, Body: simState.Bodies[k].I, Reason: RemovedByCollision, P: simState.Bodies[k].P, Owner: simState.Bodies[k].Owner})
+					}
+				}
+			case CollisionIgnore:
+				resolved[pair] = true
 			}
 		}
 	}
@@ -240,6 +446,24 @@ func UpdateSimulationState(simState *SimulationState, deltaTime float32) {
 	}
 }
 
+// emitMerge records body absorbed merging into body into, a body that was
+// already absorbed this tick keeps its first merge
+func emitMerge(simState *SimulationState, removed map[int]bool, absorbed int, into int) {
+	if removed[absorbed] {
+		return
+	}
+
+	other := simState.Bodies[into].I
+	simState.emit(Event{
+		Kind:  EventMerged,
+		Body:  simState.Bodies[absorbed].I,
+		Into:  &other,
+		Speed: simState.Bodies[absorbed].V.Sub(simState.Bodies[into].V).Len(),
+		P:     simState.Bodies[absorbed].P,
+		Owner: simState.Bodies[absorbed].Owner,
+	})
+}
+
 func absorb(self *BodyData, other *BodyData, massScale float32) {
 	self.R += other.R * 0.15
 	self.M += calculateMass(self.R, massScale)
@@ -247,8 +471,14 @@ func absorb(self *BodyData, other *BodyData, massScale float32) {
 }
 
 func clampVectorMagnitude(vector mgl32.Vec2, mag float32) mgl32.Vec2 {
-	if vector.Len() > mag {
-		return vector.Normalize().Mul(mag)
+	// a zero vector has no direction to normalise and would turn into NaN
+	length := vector.Len()
+	if length == 0 {
+		return vector
+	}
+
+	if length > mag {
+		return vector.Mul(mag / length)
 	}
 
 	return vector
@@ -22,6 +22,13 @@ func TestClampMagnitude(t *testing.T) {
 	if float32(float64(v.Len())-50.0) > p {
 		t.Errorf("Vector magnitude is %f, expected %f within %f prescision", v.Len(), 50.0, p)
 	}
+
+	// a zero vector has no direction and must not become NaN
+	for _, mag := range []float32{0, -1} {
+		if v = clampVectorMagnitude(mgl32.Vec2{0, 0}, mag); v != (mgl32.Vec2{0, 0}) {
+			t.Errorf("Clamped zero vector is %v with magnitude %v, expected %v", v, mag, mgl32.Vec2{0, 0})
+		}
+	}
 }
 
 func TestEmptySimulationState(t *testing.T) {
@@ -186,12 +193,16 @@ func TestStartSimulation(t *testing.T) {
 
 	go StartSimulation(state, delay, quit, updated)
 
+	// catch up steps may advance more than one tick per notification
+	last := uint64(0)
 	for i := 0; i < 10; i++ {
 		tick := <-updated
-		if tick != uint64(i+1) {
-			t.Errorf("Tick is %v, expected %v", tick, 1)
+		if tick <= last {
+			t.Errorf("Tick is %v, expected > %v", tick, last)
 		}
+		last = tick
 	}
+	quit <- true
 }
 
 func TestPackBodyData(t *testing.T) {
@@ -339,3 +350,59 @@ func BenchmarkUpdate1000PhysicsBodies(b *testing.B) {
 func BenchmarkUpdate10000PhysicsBodies(b *testing.B) {
 	benchmarkUpdateNPhysicsBodies(10000, b)
 }
+
+func TestRemoveSimulationBodies(t *testing.T) {
+	state := CreateEmptySimulationState(8, 1, 1, 1, 10, 100, 1)
+	for i := 0; i < 4; i++ {
+		AddSimulationBody(state, BodyData{P: mgl32.Vec2{float32(i), 0}, R: 1, Owner: uint64(i % 2)})
+	}
+
+	removed := RemoveSimulationBodies(state, RemovedByAdmin, func(body *BodyData) bool { return body.Owner == 1 })
+	if removed != 2 {
+		t.Errorf("Removed %v bodies, expected %v", removed, 2)
+	}
+
+	if len(state.Bodies) != 2 || state.Bodies[0].P.X() != 0 || state.Bodies[1].P.X() != 2 {
+		t.Errorf("Remaining bodies are %v, expected the bodies at x 0 and 2", state.Bodies)
+	}
+}
+
+func TestRecycleIds(t *testing.T) {
+	state := CreateEmptySimulationState(4, 1, 1, 1, 10, 1000, 1)
+
+	// removed ids are not handed out again before a whole tick has passed
+	first, _ := AddSimulationBody(state, BodyData{R: 1})
+	RemoveSimulationBodies(state, RemovedByOwner, func(body *BodyData) bool { return true })
+	UpdateSimulationState(state, 0.001)
+	for i := 0; i < 4; i++ {
+		id, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{float32(i * 50), 0}, R: 1})
+		if id == first {
+			t.Fatalf("Spawn %v got id %v of a body removed a tick ago", i, id)
+		}
+	}
+
+	// three live bodies churned well past the range of the ids
+	for spawn := 0; spawn < 70000; spawn++ {
+		oldest := state.Bodies[0].I
+		RemoveSimulationBodies(state, RemovedExpired, func(body *BodyData) bool { return body.I == oldest })
+		id, err := AddSimulationBody(state, BodyData{P: mgl32.Vec2{float32(spawn%4) * 50, 100}, R: 1})
+		if err != nil {
+			t.Fatalf("Error adding body %v", err)
+		}
+
+		if id >= 32 {
+			t.Fatalf("Spawn %v got id %v, expected ids to be recycled", spawn, id)
+		}
+
+		seen := map[uint16]bool{}
+		for _, body := range state.Bodies {
+			if seen[body.I] {
+				t.Fatalf("Spawn %v duplicated id %v in %v", spawn, body.I, state.Bodies)
+			}
+			seen[body.I] = true
+		}
+
+		UpdateSimulationState(state, 0.001)
+		state.PublishEvents(uint64(spawn))
+	}
+}
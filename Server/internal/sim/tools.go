@@ -0,0 +1,119 @@
+package sim
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// Spring constants pulling a grabbed body towards its target, the damping is
+// close to critical so bodies settle on the cursor instead of orbiting it
+const (
+	GrabStiffness float32 = 20
+	GrabDamping   float32 = 9
+
+	// GrabTimeout is how many seconds a grab is held without being moved
+	// before it is released, so grabs of disconnected players do not linger
+	GrabTimeout float32 = 2
+)
+
+// RemovedErased is used for bodies removed with the erase tool
+const RemovedErased RemoveReason = "erased"
+
+// grab is a body held by a player and the point it is pulled towards
+type grab struct {
+	body   uint16
+	target mgl32.Vec2
+	idle   float32
+}
+
+// findBody returns the index of the body with id or -1
+func findBody(simState *SimulationState, id uint16) int {
+	for i := range simState.Bodies {
+		if simState.Bodies[i].I == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Grab starts or moves a player's grab of a body, each player holds at most
+// one body. Returns false when the body does not exist, the caller must hold
+// the simulation lock.
+func Grab(simState *SimulationState, owner uint64, body uint16, target mgl32.Vec2) bool {
+	if findBody(simState, body) < 0 {
+		return false
+	}
+
+	if simState.grabs == nil {
+		simState.grabs = make(map[uint64]*grab)
+	}
+	simState.grabs[owner] = &grab{body: body, target: target}
+	return true
+}
+
+// Release lets go of the body a player is holding, the caller must hold the
+// simulation lock
+func Release(simState *SimulationState, owner uint64) {
+	delete(simState.grabs, owner)
+}
+
+// applyGrabs pulls every grabbed body towards its target and drops grabs of
+// bodies that are gone or have not been moved for GrabTimeout
+func applyGrabs(simState *SimulationState, deltaTime float32, scaledDeltaTime float32) {
+	for owner, held := range simState.grabs {
+		held.idle += deltaTime
+		index := findBody(simState, held.body)
+		if index < 0 || held.idle > GrabTimeout {
+			delete(simState.grabs, owner)
+			continue
+		}
+
+		body := &simState.Bodies[index]
+		spring := held.target.Sub(body.P).Mul(GrabStiffness).Sub(body.V.Mul(GrabDamping))
+		body.V = clampVectorMagnitude(body.V.Add(spring.Mul(scaledDeltaTime)), simState.MaxVelocity)
+	}
+}
+
+// ApplyImpulse changes the velocity of a body, returning false when it does
+// not exist. The caller must hold the simulation lock.
+func ApplyImpulse(simState *SimulationState, body uint16, impulse mgl32.Vec2) bool {
+	index := findBody(simState, body)
+	if index < 0 {
+		return false
+	}
+
+	data := &simState.Bodies[index]
+	data.V = clampVectorMagnitude(data.V.Add(impulse), simState.MaxVelocity)
+	return true
+}
+
+// Explode pushes every body within radius of center away from it, the push
+// is strength at the centre and fades to nothing at the edge. Returns the ids
+// of the pushed bodies, the caller must hold the simulation lock.
+func Explode(simState *SimulationState, center mgl32.Vec2, radius float32, strength float32) []uint16 {
+	pushed := []uint16{}
+	for i := range simState.Bodies {
+		body := &simState.Bodies[i]
+		offset := body.P.Sub(center)
+		distance := offset.Len()
+		if distance == 0 || distance > radius {
+			continue
+		}
+
+		impulse := offset.Mul(strength * (1 - distance/radius) / distance)
+		body.V = clampVectorMagnitude(body.V.Add(impulse), simState.MaxVelocity)
+		pushed = append(pushed, body.I)
+	}
+	return pushed
+}
+
+// Erase removes every body within radius of center accepted by match,
+// returning their ids. The caller must hold the simulation lock.
+func Erase(simState *SimulationState, center mgl32.Vec2, radius float32, match func(body *BodyData) bool) []uint16 {
+	erased := []uint16{}
+	RemoveSimulationBodies(simState, RemovedErased, func(body *BodyData) bool {
+		if body.P.Sub(center).Len() > radius || !match(body) {
+			return false
+		}
+		erased = append(erased, body.I)
+		return true
+	})
+	return erased
+}
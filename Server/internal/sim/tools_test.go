@@ -0,0 +1,89 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestGrab(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	id, _ := AddSimulationBody(state, BodyData{R: 1})
+
+	if Grab(state, 1, id+1, mgl32.Vec2{10, 0}) {
+		t.Errorf("Grabbed a body that does not exist")
+	}
+
+	if !Grab(state, 1, id, mgl32.Vec2{10, 0}) {
+		t.Fatalf("Grab of body %v failed", id)
+	}
+
+	for i := 0; i < 60; i++ {
+		UpdateSimulationState(state, 1.0/60)
+	}
+
+	if x := state.Bodies[0].P.X(); x < 5 || x > 15 {
+		t.Errorf("Grabbed body is at x %v, expected it near %v", x, 10)
+	}
+
+	// grabs that are not moved are let go
+	for i := 0; i < 3*60; i++ {
+		UpdateSimulationState(state, 1.0/60)
+	}
+
+	if len(state.grabs) != 0 {
+		t.Errorf("Simulation has %v grabs after the timeout, expected %v", len(state.grabs), 0)
+	}
+
+	Grab(state, 1, id, mgl32.Vec2{10, 0})
+	Release(state, 1)
+	if len(state.grabs) != 0 {
+		t.Errorf("Simulation has %v grabs after release, expected %v", len(state.grabs), 0)
+	}
+}
+
+func TestApplyImpulse(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 10, 100, 1)
+	id, _ := AddSimulationBody(state, BodyData{R: 1})
+
+	if !ApplyImpulse(state, id, mgl32.Vec2{3, 4}) || state.Bodies[0].V != (mgl32.Vec2{3, 4}) {
+		t.Errorf("Body velocity is %v, expected %v", state.Bodies[0].V, mgl32.Vec2{3, 4})
+	}
+
+	ApplyImpulse(state, id, mgl32.Vec2{100, 0})
+	if speed := state.Bodies[0].V.Len(); speed > 10.0001 {
+		t.Errorf("Body speed is %v, expected at most %v", speed, 10)
+	}
+}
+
+func TestExplode(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	near, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{2, 0}, R: 1})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{0, 20}, R: 1})
+
+	pushed := Explode(state, mgl32.Vec2{0, 0}, 4, 10)
+	if len(pushed) != 1 || pushed[0] != near {
+		t.Fatalf("Explode pushed %v, expected [%v]", pushed, near)
+	}
+
+	if state.Bodies[0].V != (mgl32.Vec2{5, 0}) || state.Bodies[1].V != (mgl32.Vec2{0, 0}) {
+		t.Errorf("Velocities are %v and %v, expected %v and none", state.Bodies[0].V, state.Bodies[1].V, mgl32.Vec2{5, 0})
+	}
+}
+
+func TestErase(t *testing.T) {
+	state := CreateEmptySimulationState(8, 0, 1, 1, 100, 100, 1)
+	mine, _ := AddSimulationBody(state, BodyData{P: mgl32.Vec2{1, 0}, R: 1, Owner: 1})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{-1, 0}, R: 1, Owner: 2})
+	AddSimulationBody(state, BodyData{P: mgl32.Vec2{10, 0}, R: 1, Owner: 1})
+	state.PublishEvents(0)
+
+	erased := Erase(state, mgl32.Vec2{0, 0}, 5, func(body *BodyData) bool { return body.Owner == 1 })
+	if len(erased) != 1 || erased[0] != mine || len(state.Bodies) != 2 {
+		t.Errorf("Erased %v leaving %v bodies, expected [%v] leaving %v", erased, len(state.Bodies), mine, 2)
+	}
+
+	if events := publishedEvents(state, 1); len(events) != 1 || events[0].Reason != RemovedErased {
+		t.Errorf("Published events are %+v, expected one %v removal", events, RemovedErased)
+	}
+}
@@ -0,0 +1,104 @@
+package sim
+
+import "fmt"
+
+type SpawnErrorCode string
+
+const (
+	SpawnErrorMalformed   SpawnErrorCode = "malformed"
+	SpawnErrorNonFinite   SpawnErrorCode = "non_finite"
+	SpawnErrorOutOfArea   SpawnErrorCode = "out_of_area"
+	SpawnErrorInvalidType SpawnErrorCode = "invalid_type"
+	SpawnErrorTooClose    SpawnErrorCode = "too_close"
+	SpawnErrorFull        SpawnErrorCode = "full"
+	SpawnErrorQuota       SpawnErrorCode = "quota_exceeded"
+	SpawnErrorOrbit       SpawnErrorCode = "invalid_orbit"
+)
+
+// SpawnError describes why a spawn request was rejected
+type SpawnError struct {
+	Code   SpawnErrorCode
+	Reason string
+}
+
+func (err *SpawnError) Error() string {
+	return fmt.Sprintf("spawn rejected (%v): %v", err.Code, err.Reason)
+}
+
+// ErrSimulationFull is returned by AddSimulationBody when there is no room
+// for another body
+var ErrSimulationFull = &SpawnError{Code: SpawnErrorFull, Reason: "simulation is full"}
+
+// SpawnRules limits what clients are allowed to add to the simulation
+type SpawnRules struct {
+	// Radius of the spawn area around the origin, Bounds is used when <= 0
+	Radius float32
+
+	// MaxType is the highest texture index a body may use
+	MaxType uint8
+
+	// MinDistance is the smallest gap allowed between the surface of a new
+	// body and any existing body, the check is disabled when <= 0
+	MinDistance float32
+}
+
+func DefaultSpawnRules(bounds float32) SpawnRules {
+	return SpawnRules{
+		Radius:      bounds,
+		MaxType:     255,
+		MinDistance: 0,
+	}
+}
+
+// UnpackSpawnRequest reads a client spawn packet and validates it against the
+// simulation's spawn rules, the caller must hold the simulation lock
+func UnpackSpawnRequest(simState *SimulationState, packet []byte) (BodyData, error) {
+	data := BodyData{}
+	if len(packet) != BodyPacketBytes {
+		return data, &SpawnError{Code: SpawnErrorMalformed, Reason: fmt.Sprintf("packet is %v bytes, expected %v", len(packet), BodyPacketBytes)}
+	}
+
+	if err := UnpackBodyData(packet, &data); err != nil {
+		return data, &SpawnError{Code: SpawnErrorMalformed, Reason: err.Error()}
+	}
+
+	return data, ValidateSpawn(simState, &data)
+}
+
+// ValidateSpawn rejects bodies that break the spawn rules and sanitises the
+// fields that can be safely corrected, the caller must hold the simulation lock
+func ValidateSpawn(simState *SimulationState, data *BodyData) error {
+	if !data.IsFinite() {
+		return &SpawnError{Code: SpawnErrorNonFinite, Reason: "body contains NaN or Inf values"}
+	}
+
+	rules := simState.SpawnRules
+	radius := rules.Radius
+	if radius <= 0 {
+		radius = simState.Bounds
+	}
+
+	if data.P.Len() > radius {
+		return &SpawnError{Code: SpawnErrorOutOfArea, Reason: fmt.Sprintf("position %v is outside the spawn radius %v", data.P, radius)}
+	}
+
+	if data.T > rules.MaxType {
+		return &SpawnError{Code: SpawnErrorInvalidType, Reason: fmt.Sprintf("type %v is above the maximum %v", data.T, rules.MaxType)}
+	}
+
+	// ids are always assigned by the server
+	data.I = 0
+	data.V = clampVectorMagnitude(data.V, simState.MaxVelocity)
+	data.CleanBodyData(simState.MassScale)
+
+	if rules.MinDistance > 0 {
+		for _, body := range simState.Bodies {
+			gap := data.P.Sub(body.P).Len() - data.R - body.R
+			if gap < rules.MinDistance {
+				return &SpawnError{Code: SpawnErrorTooClose, Reason: fmt.Sprintf("body %v is %v away, minimum is %v", body.I, gap, rules.MinDistance)}
+			}
+		}
+	}
+
+	return nil
+}
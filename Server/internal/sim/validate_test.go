@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/idpool"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func packSpawnBody(t *testing.T, body BodyData) []byte {
+	packet, err := body.Pack()
+	if err != nil {
+		t.Fatalf("Error packing body data %v", err)
+	}
+	return packet
+}
+
+func TestUnpackSpawnRequest(t *testing.T) {
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(-1))
+	valid := BodyData{P: mgl32.Vec2{1, 1}, V: mgl32.Vec2{1, 0}, M: 1, R: 1, T: 2}
+	validPacket := packSpawnBody(t, valid)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		code   SpawnErrorCode
+	}{
+		{"valid", validPacket, ""},
+		{"empty", []byte{}, SpawnErrorMalformed},
+		{"short", validPacket[:BodyPacketBytes-1], SpawnErrorMalformed},
+		{"long", append(append([]byte{}, validPacket...), 0), SpawnErrorMalformed},
+		{"nan position", packSpawnBody(t, BodyData{P: mgl32.Vec2{nan, 0}, R: 1}), SpawnErrorNonFinite},
+		{"inf velocity", packSpawnBody(t, BodyData{V: mgl32.Vec2{0, inf}, R: 1}), SpawnErrorNonFinite},
+		{"nan radius", packSpawnBody(t, BodyData{R: nan}), SpawnErrorNonFinite},
+		{"outside area", packSpawnBody(t, BodyData{P: mgl32.Vec2{60, 0}, R: 1}), SpawnErrorOutOfArea},
+		{"edge of area", packSpawnBody(t, BodyData{P: mgl32.Vec2{50, 0}, R: 1}), ""},
+		{"invalid type", packSpawnBody(t, BodyData{R: 1, T: 9}), SpawnErrorInvalidType},
+		{"too close", packSpawnBody(t, BodyData{P: mgl32.Vec2{-18, 0}, R: 1}), SpawnErrorTooClose},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			simState := CreateEmptySimulationState(4, 1, 1, 1, 10, 100, 1)
+			simState.SpawnRules = SpawnRules{Radius: 50, MaxType: 8, MinDistance: 1}
+			AddSimulationBody(simState, BodyData{P: mgl32.Vec2{-20, 0}, R: 1})
+
+			_, err := UnpackSpawnRequest(simState, test.packet)
+			if len(test.code) == 0 {
+				if err != nil {
+					t.Errorf("UnpackSpawnRequest error is %v, expected nil", err)
+				}
+				return
+			}
+
+			spawnErr, ok := err.(*SpawnError)
+			if !ok {
+				t.Fatalf("UnpackSpawnRequest error is %v, expected a SpawnError", err)
+			}
+
+			if spawnErr.Code != test.code {
+				t.Errorf("SpawnError code is %v, expected %v", spawnErr.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestValidateSpawnSanitises(t *testing.T) {
+	simState := CreateEmptySimulationState(4, 1, 1, 1, 10, 100, 1)
+	body := BodyData{
+		I: idpool.NewID(1234),
+		P: mgl32.Vec2{0, 0},
+		V: mgl32.Vec2{300, 400},
+		M: 1000,
+		R: 100,
+	}
+
+	if err := ValidateSpawn(simState, &body); err != nil {
+		t.Fatalf("ValidateSpawn error is %v, expected nil", err)
+	}
+
+	if body.I != 0 {
+		t.Errorf("Sanitised body I is %v, expected %v", body.I, 0)
+	}
+
+	if math.Abs(float64(body.V.Len()-simState.MaxVelocity)) > 0.0001 {
+		t.Errorf("Sanitised body speed is %v, expected %v", body.V.Len(), simState.MaxVelocity)
+	}
+
+	if body.R != 4 {
+		t.Errorf("Sanitised body R is %v, expected %v", body.R, 4)
+	}
+
+	if body.M != calculateMass(body.R, simState.MassScale) {
+		t.Errorf("Sanitised body M is %v, expected %v", body.M, calculateMass(body.R, simState.MassScale))
+	}
+}
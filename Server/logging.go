@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const DefaultLogLevel = "info"
+const DefaultLogFormat = "text"
+
+// newLogger builds the process logger, format is either "json" or "text"
+func newLogger(w io.Writer, level string, format string) *slog.Logger {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		logLevel = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	if strings.EqualFold(format, "json") {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+
+	return slog.New(slog.NewTextHandler(w, options))
+}
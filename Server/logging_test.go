@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger := newLogger(buffer, "warn", "json").With("conn", 7)
+
+	logger.Info("hidden")
+	logger.Warn("shown", "remote", "127.0.0.1")
+
+	lines := bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("Logger wrote %v lines, expected %v", len(lines), 1)
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatalf("Error unmarshalling log line %v", err)
+	}
+
+	if entry[slog.MessageKey] != "shown" {
+		t.Errorf("Log message is %v, expected %v", entry[slog.MessageKey], "shown")
+	}
+
+	if entry["conn"] != float64(7) {
+		t.Errorf("Log conn is %v, expected %v", entry["conn"], 7)
+	}
+
+	if entry["remote"] != "127.0.0.1" {
+		t.Errorf("Log remote is %v, expected %v", entry["remote"], "127.0.0.1")
+	}
+}
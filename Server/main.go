@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
 )
 
 const DefaultMaxBodies = int64(512)
@@ -20,135 +22,408 @@ const DefaultGravity = float64(5)
 const DefaultTimescale = float64(3.75)
 const DefaultMassScale = float64(4)
 const DefaultDampening = float64(1.15)
-
-type FrameData struct {
-	P int            `json:"p"`
-	D []sim.BodyData `json:"d"`
-}
+const DefaultContinuousCollision = true
+const DefaultSpawnMaxType = int64(255)
+const DefaultSpawnMinDistance = float64(0)
+const DefaultShutdownTimeout = 10 * time.Second
+const DefaultSimHz = int64(60)
+const DefaultSendHz = int64(60)
+const DefaultSlowClientFrames = int64(30)
+const DefaultMaxSpectators = int64(100)
+const DefaultCapacityPolicy = string(sim.CapacityReject)
+const DefaultDecayRate = float64(0.1)
+const DefaultDecayMinRadius = float64(0.05)
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	body := []byte("OK")
 	_, err := w.Write(body)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("Error writing root response", "err", err)
 		w.WriteHeader(500)
 		return
 	}
 }
 
-func handleFrameIO(simState *sim.SimulationState, hub *Hub, updated chan uint64, input chan []byte, output chan []byte) {
+// eventBuffer is how many ticks of simulation events may wait while the frame
+// goroutine is busy before later ticks are held back and merged together
+const eventBuffer = 64
+
+// handleFrameIO broadcasts a frame every sendInterval independently of the
+// simulation rate and feeds client messages into the simulation
+func handleFrameIO(simState *sim.SimulationState, hub *Hub, scheduler *sim.Scheduler, sendInterval time.Duration, input chan *ClientMessage, output chan *Snapshot) {
+	ticker := time.NewTicker(sendInterval)
+	defer ticker.Stop()
+
+	events, cancel := simState.Subscribe(eventBuffer)
+	defer cancel()
+
+	var pending []sim.Event
+	sends := uint64(0)
 	lastTick := uint64(0)
 	for {
 		select {
-		case tick := <-updated:
-			if tick != lastTick {
-				buildFrameData(simState, hub, output)
+		case batch := <-events:
+			pending = append(pending, batch...)
+		case <-ticker.C:
+			sends++
+			if sendEvery := scheduler.Stats().SendEvery; sends%uint64(sendEvery) != 0 {
+				continue
+			}
+
+			// skip sends when the simulation has not advanced since the last frame
+			if tick, _ := simState.LastTick(); tick != lastTick {
+				lastTick = tick
+				snapshot := takeSnapshot(simState)
+				snapshot.Events = pending
+				pending = nil
+				output <- snapshot
 			}
 		case message := <-input:
-			handleSimulationStateInput(simState, message)
+			handleClientMessage(simState, hub, message)
 		}
 	}
 }
 
-func buildFrameData(simState *sim.SimulationState, hub *Hub, output chan []byte) {
-	defer simState.Mu.Unlock()
-	simState.Mu.Lock()
+func handleClientMessage(simState *sim.SimulationState, hub *Hub, message *ClientMessage) {
+	if message.kind == websocket.TextMessage {
+		handleControlMessage(simState, hub, message)
+		return
+	}
 
-	buffer := new(bytes.Buffer)
-	clients := uint16(len(hub.clients))
-	err := binary.Write(buffer, binary.LittleEndian, clients)
+	if message.client.spectator {
+		ignoreSpectatorInput(message.client)
+		return
+	}
+
+	client := message.client
+	result, quota, err := handleSimulationStateInput(simState, client.owner(), hub.quota.limit(client), message.data)
 	if err != nil {
-		fmt.Println(err)
-		output <- make([]byte, 0)
+		rejectSpawn(hub, client, err)
 		return
 	}
+	recordSpawn(hub, client, result, quota)
+}
 
-	for _, body := range simState.Bodies {
-		bodyBytes, err := body.Pack()
-		if err != nil {
-			fmt.Println(err)
-			output <- make([]byte, 0)
-			return
-		}
+// recordSpawn audits an accepted spawn request and tells the client the id of
+// its body, which bodies were evicted to make room for it and its quota
+func recordSpawn(hub *Hub, client *Client, result sim.SpawnResult, quota QuotaStatus) {
+	hub.audit.record("spawn", client, "body", result.ID, "evicted", result.Evicted)
+	reply := SpawnedMessage{Type: MessageTypeSpawned, Body: result.ID, Evicted: result.Evicted, Parent: result.Parent, Quota: quota}
+	if err := replyToClient(hub, client, reply); err != nil {
+		client.logger.Error("Error replying to client", "err", err)
+	}
+}
 
-		err = binary.Write(buffer, binary.LittleEndian, bodyBytes)
-		if err != nil {
-			fmt.Println(err)
-			output <- make([]byte, 0)
-			return
-		}
+// ignoreSpectatorInput drops a message that would change the simulation from
+// a read-only spectator
+func ignoreSpectatorInput(client *Client) {
+	client.rejectLog.log(client.logger, slog.LevelDebug, "Ignoring spectator input")
+	client.hub.audit.record("input_ignored", client, "reason", "spectator")
+}
+
+// rejectSpawn logs a refused spawn request and tells the client why
+func rejectSpawn(hub *Hub, client *Client, err error) {
+	code := "spawn"
+	reason := err.Error()
+	if spawnErr, ok := err.(*sim.SpawnError); ok {
+		code = string(spawnErr.Code)
+		reason = spawnErr.Reason
 	}
 
-	// bodyList := FrameData{D: simState.Bodies, P: len(hub.clients)}
-	// body, err := json.Marshal(bodyList)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	output <- make([]byte, 0)
-	// 	return
-	// }
+	client.rejectLog.log(client.logger, slog.LevelWarn, "Rejected spawn request", "code", code, "reason", reason)
+	replyError(hub, client, code, reason)
+}
 
-	output <- buffer.Bytes()
+// buildFrameData snapshots the simulation for the hub to encode per client
+func buildFrameData(simState *sim.SimulationState, output chan *Snapshot) {
+	output <- takeSnapshot(simState)
 }
 
-func handleSimulationStateInput(simState *sim.SimulationState, message []byte) {
+// handleSimulationStateInput adds a body owned by owner from a binary spawn
+// packet, quota limits the live bodies owner may have
+func handleSimulationStateInput(simState *sim.SimulationState, owner uint64, quota int, message []byte) (sim.SpawnResult, QuotaStatus, error) {
 	defer simState.Mu.Unlock()
 	simState.Mu.Lock()
 
-	data := sim.BodyData{}
-	err := sim.UnpackBodyData(message, &data)
+	data, err := sim.UnpackSpawnRequest(simState, message)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return sim.SpawnResult{}, QuotaStatus{}, err
+	}
+
+	return spawnOwned(simState, owner, quota, data)
+}
+
+// handleSpawnMessage adds a body decoded from a JSON spawn message, putting it
+// in orbit when orbit is set
+func handleSpawnMessage(simState *sim.SimulationState, owner uint64, quota int, data sim.BodyData, orbit *sim.OrbitOptions) (sim.SpawnResult, QuotaStatus, error) {
+	defer simState.Mu.Unlock()
+	simState.Mu.Lock()
+
+	if err := sim.ValidateSpawn(simState, &data); err != nil {
+		return sim.SpawnResult{}, QuotaStatus{}, err
 	}
 
-	// err := json.Unmarshal(message, &data)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return
-	// }
+	var parent *uint16
+	if orbit != nil {
+		if err := orbit.Validate(); err != nil {
+			return sim.SpawnResult{}, QuotaStatus{}, err
+		}
+		if id, ok := sim.AssignOrbit(simState, &data, *orbit); ok {
+			parent = &id
+		}
+	}
 
-	sim.AddSimulationBody(simState, data)
+	result, status, err := spawnOwned(simState, owner, quota, data)
+	if err == nil {
+		result.Parent = parent
+	}
+	return result, status, err
 }
 
 func main() {
+	logLevel := parseEnvString("LOG_LEVEL", DefaultLogLevel)
+	logFormat := parseEnvString("LOG_FORMAT", DefaultLogFormat)
+	slog.SetDefault(newLogger(os.Stdout, logLevel, logFormat))
+
 	port := parseEnvString("PORT", "8080")
 	maxBodies := parseEnvInt("MAX_BODIES", int(DefaultMaxBodies))
 	maxClients := parseEnvInt("MAX_CLIENTS", int(DefaultMaxClients))
+	maxSpectators := parseEnvInt("MAX_SPECTATORS", int(DefaultMaxSpectators))
 	maxVelocity := parseEnvFloat32("MAX_VELOCITY", float32(DefaultMaxVelocity))
 	maxBounds := parseEnvFloat32("MAX_BOUNDS", float32(DefaultMaxBounds))
 	gravity := parseEnvFloat32("GRAVITY", float32(DefaultGravity))
 	timescale := parseEnvFloat32("TIME_SCALE", float32(DefaultTimescale))
 	massScale := parseEnvFloat32("MASS_SCALE", float32(DefaultMassScale))
 	dampScale := parseEnvFloat32("DAMP_SCALE", float32(DefaultDampening))
+	continuousCollision := parseEnvBool("CONTINUOUS_COLLISION", DefaultContinuousCollision)
+	debugDumpDir := parseEnvString("DEBUG_DUMP_DIR", "")
+	spawnRadius := parseEnvFloat32("SPAWN_RADIUS", maxBounds)
+	spawnMaxType := parseEnvInt("SPAWN_MAX_TYPE", int(DefaultSpawnMaxType))
+	spawnMinDistance := parseEnvFloat32("SPAWN_MIN_DISTANCE", float32(DefaultSpawnMinDistance))
+	bodyTTL := parseEnvDuration("BODY_TTL", 0)
+	decayRadius := parseEnvFloat32("DECAY_RADIUS", 0)
+	decayRate := parseEnvFloat32("DECAY_RATE", float32(DefaultDecayRate))
+	decayMinRadius := parseEnvFloat32("DECAY_MIN_RADIUS", float32(DefaultDecayMinRadius))
+	healthMaxTickAge := parseEnvDuration("HEALTH_MAX_TICK_AGE", DefaultHealthMaxTickAge)
+	shutdownTimeout := parseEnvDuration("SHUTDOWN_TIMEOUT", DefaultShutdownTimeout)
+	shutdownDrain := parseEnvDuration("SHUTDOWN_DRAIN", DefaultShutdownDrain)
+
+	aoi := DefaultAOIConfig()
+	aoi.Margin = parseEnvFloat32("AOI_MARGIN", aoi.Margin)
+	aoi.Cell = parseEnvFloat32("AOI_CELL", aoi.Cell)
+	aoi.AlwaysRadius = parseEnvFloat32("AOI_ALWAYS_RADIUS", aoi.AlwaysRadius)
+	aoi.MinPixelRadius = parseEnvFloat32("AOI_MIN_PIXEL_RADIUS", aoi.MinPixelRadius)
+
+	clientBytesPerSecond := parseEnvInt("CLIENT_BYTES_PER_SECOND", int(DefaultClientBytesPerSecond))
+	slowClientFrames := parseEnvInt("SLOW_CLIENT_FRAMES", int(DefaultSlowClientFrames))
+
+	chat := DefaultChatConfig()
+	chat.MaxLength = parseEnvInt("CHAT_MAX_LENGTH", chat.MaxLength)
+	chat.HistorySize = parseEnvInt("CHAT_HISTORY", chat.HistorySize)
+	if chat.HistorySize < 0 || chat.HistorySize > MaxChatHistory {
+		slog.Warn("Limiting CHAT_HISTORY to the send queue", "history", chat.HistorySize, "max", MaxChatHistory)
+		chat.HistorySize = min(max(chat.HistorySize, 0), MaxChatHistory)
+	}
+	if path := parseEnvString("CHAT_WORDLIST", ""); len(path) > 0 {
+		filter, err := LoadWordListFilter(path)
+		if err != nil {
+			slog.Error("Error loading chat word list", "path", path, "err", err)
+			os.Exit(1)
+		}
+		chat.Filter = filter
+	}
+
+	adminTokens, err := parseAdminTokens(parseEnvString("ADMIN_TOKENS", ""))
+	if err != nil {
+		slog.Error("Error reading ADMIN_TOKENS", "err", err)
+		os.Exit(1)
+	}
+
+	proxies, err := parseTrustedProxies(parseEnvString("TRUSTED_PROXIES", ""))
+	if err != nil {
+		slog.Error("Error reading TRUSTED_PROXIES", "err", err)
+		os.Exit(1)
+	}
+
+	bansFile := parseEnvString("BANS_FILE", DefaultBansFile)
+	bans, err := LoadBanList(bansFile)
+	if err != nil {
+		slog.Error("Error loading bans", "path", bansFile, "err", err)
+		os.Exit(1)
+	}
+
+	auditConfig := AuditConfig{
+		Path:     parseEnvString("AUDIT_LOG", DefaultAuditLog),
+		MaxBytes: int64(parseEnvInt("AUDIT_MAX_BYTES", int(DefaultAuditMaxBytes))),
+		Daily:    parseEnvBool("AUDIT_ROTATE_DAILY", DefaultAuditRotateDaily),
+	}
+
+	var audit *AuditLog
+	if len(auditConfig.Path) > 0 {
+		audit, err = OpenAuditLog(auditConfig)
+		if err != nil {
+			slog.Error("Error opening audit log", "path", auditConfig.Path, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	compression := DefaultCompressionConfig()
+	compression.Enabled = parseEnvBool("COMPRESSION", compression.Enabled)
+	compression.Level = parseEnvInt("COMPRESSION_LEVEL", compression.Level)
+	compression.Threshold = parseEnvInt("COMPRESSION_THRESHOLD", compression.Threshold)
+	if !compression.validLevel() {
+		slog.Warn("Ignoring invalid compression level", "level", compression.Level)
+		compression.Level = int(DefaultCompressionLevel)
+	}
+
+	simHz := parseEnvInt("SIM_HZ", int(DefaultSimHz))
+	sendHz := parseEnvInt("SEND_HZ", int(DefaultSendHz))
+	if simHz <= 0 {
+		slog.Warn("Ignoring invalid simulation rate", "simHz", simHz)
+		simHz = int(DefaultSimHz)
+	}
+	if sendHz <= 0 {
+		slog.Warn("Ignoring invalid send rate", "sendHz", sendHz)
+		sendHz = int(DefaultSendHz)
+	}
+
+	schedulerConfig := sim.DefaultSchedulerConfig(time.Second / time.Duration(simHz))
+	schedulerConfig.MaxStepsPerFrame = parseEnvInt("SIM_MAX_STEPS", schedulerConfig.MaxStepsPerFrame)
+	schedulerConfig.Budget = float64(parseEnvFloat32("SIM_TICK_BUDGET", float32(schedulerConfig.Budget)))
+	schedulerConfig.LoadShedding = parseEnvBool("SIM_LOAD_SHEDDING", schedulerConfig.LoadShedding)
 
 	var quit = make(chan bool)
 	var simState = sim.CreateEmptySimulationState(int(maxBodies), float32(gravity), float32(timescale), float32(massScale), float32(maxVelocity), float32(maxBounds), float32(dampScale))
+	simState.ContinuousCollision = continuousCollision
+	simState.DebugDumpDir = debugDumpDir
+	simState.SpawnRules = sim.SpawnRules{
+		Radius:      float32(spawnRadius),
+		MaxType:     uint8(spawnMaxType),
+		MinDistance: float32(spawnMinDistance),
+	}
+	simState.Lifetime = sim.LifetimeRules{
+		TTL:         float32(bodyTTL.Seconds()),
+		DecayRadius: float32(decayRadius),
+		DecayRate:   float32(decayRate),
+		MinRadius:   float32(decayMinRadius),
+	}
 
-	fmt.Println("Starting server")
+	capacity, err := sim.ParseCapacityPolicy(parseEnvString("CAPACITY_POLICY", DefaultCapacityPolicy))
+	if err != nil {
+		slog.Error("Error reading CAPACITY_POLICY", "err", err)
+		os.Exit(1)
+	}
+	simState.Capacity = capacity
 
-	outgoing := make(chan []byte)
-	incoming := make(chan []byte)
+	if path := parseEnvString("FORCE_FIELDS", ""); len(path) > 0 {
+		fields, err := sim.ReadForceFields(path)
+		if err != nil {
+			slog.Error("Error loading force fields", "path", path, "err", err)
+			os.Exit(1)
+		}
+		simState.Fields = fields
+	}
+
+	slog.Info("Starting server", "maxBodies", maxBodies, "maxClients", maxClients, "maxSpectators", maxSpectators, "capacity", capacity, "simHz", simHz, "sendHz", sendHz, "compression", compression.Enabled, "logLevel", logLevel, "logFormat", logFormat)
+
+	outgoing := make(chan *Snapshot)
+	incoming := make(chan *ClientMessage)
 	hub := newHub(outgoing, incoming)
+	hub.aoi = aoi
+	hub.bandwidth = int64(clientBytesPerSecond)
+	if !validBandwidth(hub.bandwidth) {
+		slog.Warn("Raising CLIENT_BYTES_PER_SECOND to the minimum", "bandwidth", hub.bandwidth, "min", MinClientBytesPerSecond)
+		hub.bandwidth = MinClientBytesPerSecond
+	}
+	hub.slowFrames = int(slowClientFrames)
+	hub.compression = compression
+	hub.chatConfig = chat
+	hub.audit = audit
+	hub.adminTokens = adminTokens
+	hub.proxies = proxies
+	hub.quota = QuotaConfig{
+		Player: parseEnvInt("PLAYER_BODY_QUOTA", DefaultPlayerQuota),
+		Admin:  parseEnvInt("ADMIN_BODY_QUOTA", DefaultAdminQuota),
+	}
+	hub.tools.MaxRadius = parseEnvFloat32("TOOL_MAX_RADIUS", hub.tools.MaxRadius)
+	hub.tools.MaxStrength = parseEnvFloat32("TOOL_MAX_STRENGTH", hub.tools.MaxStrength)
+	hub.tools.MaxCluster = parseEnvInt("TOOL_MAX_CLUSTER", hub.tools.MaxCluster)
+	hub.tools.Permissions, err = parseToolPermissions(parseEnvString("TOOL_PERMISSIONS", ""), hub.tools.Permissions)
+	if err != nil {
+		slog.Error("Error reading TOOL_PERMISSIONS", "err", err)
+		os.Exit(1)
+	}
+
+	hub.preview.Mode, err = sim.ParsePreviewMode(parseEnvString("PREVIEW_MODE", DefaultPreviewMode))
+	if err != nil {
+		slog.Error("Error reading PREVIEW_MODE", "err", err)
+		os.Exit(1)
+	}
+	hub.preview.Ticks = parseEnvInt("PREVIEW_TICKS", hub.preview.Ticks)
+	hub.preview.Stride = parseEnvInt("PREVIEW_STRIDE", hub.preview.Stride)
+	hub.preview.Concurrency = parseEnvInt("PREVIEW_CONCURRENCY", hub.preview.Concurrency)
+	hub.preview.Budget = parseEnvDuration("PREVIEW_BUDGET", hub.preview.Budget)
+	hub.preview.DeltaTime = 1.0 / float32(simHz)
 	go hub.run()
 
-	updated := make(chan uint64)
-	go handleFrameIO(simState, hub, updated, incoming, outgoing)
-	go sim.StartSimulation(simState, 16*time.Millisecond, quit, updated)
+	simState.Mu.Lock()
+	publishFields(simState, hub)
+	simState.Mu.Unlock()
+
+	scheduler := sim.NewScheduler(simState, schedulerConfig)
+	health := newHealth(simState, hub, scheduler, int(maxClients), healthMaxTickAge)
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		if len(hub.clients) > int(maxClients) {
-			w.WriteHeader(404)
+	go handleFrameIO(simState, hub, scheduler, time.Second/time.Duration(sendHz), incoming, outgoing)
+	go scheduler.Run(quit, nil)
+
+	// nothing is restored on startup yet, the simulation is ready once it ticks
+	health.setPhase(phaseReady)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if bans.refuse(w, r, hub.proxies, audit) {
+			return
+		}
+
+		spectate, _ := isSpectateRequest(r)
+		if atCapacity(hub.audience(), spectate, int(maxClients), int(maxSpectators)) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
 
 		serveWs(hub, w, r)
 	})
 
-	http.HandleFunc("/", rootHandler)
+	health.register(mux)
+	mux.HandleFunc("/", rootHandler)
+	newAdminAPI(adminTokens, simState, hub, bans).register(mux)
 
-	fmt.Printf("Listening on port %v\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
-	}
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("Listening", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server stopped", "err", err)
+			os.Exit(1)
+		}
+	}()
 
-	fmt.Println("Closing server")
+	<-ctx.Done()
+	health.setPhase(phaseShuttingDown)
+
+	// fail readiness for a while so load balancers stop routing new clients
+	// here before the listener closes
+	slog.Info("Draining server", "drain", shutdownDrain)
+	time.Sleep(shutdownDrain)
+	slog.Info("Closing server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down server", "err", err)
+	}
+	quit <- true
+	audit.Close()
 }
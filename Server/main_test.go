@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/TylerStein/galaxy-sandbox-online/internal/idpool"
 	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
 	"github.com/go-gl/mathgl/mgl32"
+	"github.com/gorilla/websocket"
 )
 
 func TestSimulationAddBody(t *testing.T) {
@@ -27,7 +31,7 @@ func TestSimulationAddBody(t *testing.T) {
 		t.Fatalf("Error trying to marshal BodyJson: %v", err)
 	}
 
-	handleSimulationStateInput(state, bodyBytes)
+	handleSimulationStateInput(state, 1, 0, bodyBytes)
 
 	if len(state.Bodies) != 1 {
 		t.Fatalf("Simulation BodyData list has %v len, expected %v len", len(state.Bodies), 1)
@@ -50,27 +54,52 @@ func TestSimulationReadUpdate(t *testing.T) {
 		T: 5,
 	}
 	sim.AddSimulationBody(state, body)
-	hub := newHub(make(chan []byte), make(chan []byte))
-	output := make(chan []byte)
-	go buildFrameData(state, hub, output)
+	state.RecordTick(7, time.Now())
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	output := make(chan *Snapshot)
+	go buildFrameData(state, output)
 
 	frameData := FrameData{}
-	data := <-output
+	snapshot := <-output
+	data, err := newFrameCache(snapshot, hub.audience(), hub.aoi).frameFor(nil, formatBinary)
+	if err != nil {
+		t.Fatalf("Error encoding frame %v\n", err)
+	}
 
 	reader := bytes.NewReader(data)
 
-	var count uint16
-	err := binary.Read(reader, binary.LittleEndian, &count)
+	header := FrameHeader{}
+	err = binary.Read(reader, binary.LittleEndian, &header)
 
 	if err != nil {
-		t.Fatalf("Error binary reading count from packet %v\n", err)
+		t.Fatalf("Error binary reading header from packet %v\n", err)
+	}
+
+	if header.Version != ProtocolVersion {
+		t.Fatalf("Packet version is %v, expected %v", header.Version, ProtocolVersion)
 	}
 
-	if count != uint16(len(hub.clients)) {
-		t.Fatalf("Packet player count is %v, expected %v", count, len(hub.clients))
+	if header.Players != uint16(hub.audience().Players) {
+		t.Fatalf("Packet player count is %v, expected %v", header.Players, hub.audience().Players)
+	}
+
+	if header.Tick != 7 {
+		t.Fatalf("Packet tick is %v, expected %v", header.Tick, 7)
+	}
+
+	if header.Time <= 0 {
+		t.Errorf("Packet time is %v, expected > 0", header.Time)
+	}
+
+	if binary.Size(header) != FrameHeaderBytes {
+		t.Fatalf("FrameHeader size is %v, expected %v", binary.Size(header), FrameHeaderBytes)
+	}
+
+	bodyCount := (len(data) - FrameHeaderBytes) / sim.BodyPacketBytes
+	if int(header.Count) != bodyCount {
+		t.Fatalf("Packet body count is %v, expected %v", header.Count, bodyCount)
 	}
 
-	bodyCount := (len(data) - 2) / sim.BodyPacketBytes
 	bodyList := make([]sim.BodyPacket, bodyCount)
 	err = binary.Read(reader, binary.LittleEndian, &bodyList)
 	if err != nil {
@@ -85,3 +114,205 @@ func TestSimulationReadUpdate(t *testing.T) {
 		t.Errorf("Updated BodyData list 0 has ID %v, expected %v", frameData.D[0].I, state.Bodies[0].I)
 	}
 }
+
+func TestSimulationRejectedSpawnReply(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	body := sim.BodyData{P: mgl32.Vec2{1000, 0}, R: 1}
+	bodyBytes, err := body.Pack()
+	if err != nil {
+		t.Fatalf("Error trying to pack BodyData: %v", err)
+	}
+
+	go handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.BinaryMessage, data: bodyBytes}})
+	reply := nextReply(t, client, MessageTypeError)
+
+	if reply.kind != websocket.TextMessage {
+		t.Fatalf("Reply kind is %v, expected %v", reply.kind, websocket.TextMessage)
+	}
+
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(reply.data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Type != MessageTypeError {
+		t.Errorf("Reply type is %v, expected %v", errorMessage.Type, MessageTypeError)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorOutOfArea) {
+		t.Errorf("Reply code is %v, expected %v", errorMessage.Code, sim.SpawnErrorOutOfArea)
+	}
+
+	if len(state.Bodies) != 0 {
+		t.Errorf("Simulation BodyData list has %v len, expected %v len", len(state.Bodies), 0)
+	}
+}
+
+func TestSimulationJSONSpawn(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"spawn","p":[1,2],"v":[0.5,0],"r":1,"t":3}`)}})
+
+	if len(state.Bodies) != 1 {
+		t.Fatalf("Simulation BodyData list has %v len, expected %v len", len(state.Bodies), 1)
+	}
+
+	spawned := SpawnedMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeSpawned).data, &spawned); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if spawned.Body != state.Bodies[0].I {
+		t.Errorf("Spawned reply body is %v, expected %v", spawned.Body, state.Bodies[0].I)
+	}
+
+	body := state.Bodies[0]
+	if body.P != (mgl32.Vec2{1, 2}) || body.V != (mgl32.Vec2{0.5, 0}) || body.T != 3 {
+		t.Errorf("Spawned body is %v, expected position %v velocity %v type %v", body, mgl32.Vec2{1, 2}, mgl32.Vec2{0.5, 0}, 3)
+	}
+
+	if body.M <= 0 {
+		t.Errorf("Spawned body mass is %v, expected > 0", body.M)
+	}
+}
+
+func TestSimulationSpectatorInput(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	client := newClient(hub, nil, "test")
+	client.spectator = true
+
+	body := sim.BodyData{P: mgl32.Vec2{1, 0}, R: 1}
+	bodyBytes, err := body.Pack()
+	if err != nil {
+		t.Fatalf("Error trying to pack BodyData: %v", err)
+	}
+
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.BinaryMessage, data: bodyBytes}})
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"spawn","p":[1,2],"r":1}`)}})
+
+	if len(state.Bodies) != 0 {
+		t.Errorf("Simulation BodyData list has %v len after spectator spawns, expected %v len", len(state.Bodies), 0)
+	}
+
+	// control messages still apply to spectators
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"rate","tier":"low"}`)}})
+	if every := client.sendEvery.Load(); every != sendTiers["low"] {
+		t.Errorf("Spectator sendEvery is %v, expected %v", every, sendTiers["low"])
+	}
+}
+
+// vetoSpawns rejects every spawn with a custom code
+type vetoSpawns struct {
+	sim.DefaultHooks
+}
+
+func (vetoSpawns) OnSpawn(simState *sim.SimulationState, body *sim.BodyData) error {
+	return &sim.SpawnError{Code: "closed", Reason: "spawning is closed"}
+}
+
+func TestSimulationVetoedSpawnReply(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	state.Hooks = vetoSpawns{}
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	go handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"spawn","p":[1,2],"r":1}`)}})
+
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "closed" {
+		t.Errorf("Reply code is %v, expected %v", errorMessage.Code, "closed")
+	}
+}
+
+func TestSimulationCapacityFeedback(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	spawn := func(x int) {
+		handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"spawn","p":[` + strconv.Itoa(x) + `,0],"r":1}`)}})
+	}
+
+	spawn(1)
+	spawn(2)
+	first := state.Bodies[0].I
+	nextReply(t, client, MessageTypeSpawned)
+	nextReply(t, client, MessageTypeSpawned)
+
+	spawn(3)
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorFull) {
+		t.Errorf("Full reply code is %v, expected %v", errorMessage.Code, sim.SpawnErrorFull)
+	}
+
+	state.Capacity = sim.CapacityEvictOldest
+	spawn(4)
+	spawned := SpawnedMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeSpawned).data, &spawned); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if len(spawned.Evicted) != 1 || spawned.Evicted[0] != first {
+		t.Errorf("Spawned reply evicted %v, expected [%v]", spawned.Evicted, first)
+	}
+}
+
+func TestSimulationOrbitSpawn(t *testing.T) {
+	state := sim.CreateEmptySimulationState(4, 1, 1, 3, 100, 1000, 1)
+	star, _ := sim.AddSimulationBody(state, sim.BodyData{R: 5})
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	sendControl(state, hub, client, `{"type":"spawn","p":[20,0],"v":[0,-1],"r":0.5,"orbit":{"eccentricity":0}}`)
+	spawned := SpawnedMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeSpawned).data, &spawned); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if spawned.Parent == nil || *spawned.Parent != star {
+		t.Errorf("Spawned reply parent is %v, expected %v", spawned.Parent, star)
+	}
+
+	if v := state.Bodies[1].V; v.Y() <= 0 {
+		t.Errorf("Orbiting body velocity is %v, expected counter clockwise", v)
+	}
+
+	sendControl(state, hub, client, `{"type":"spawn","p":[20,0],"r":0.5,"orbit":{"eccentricity":1}}`)
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorOrbit) {
+		t.Errorf("Reply code is %v, expected %v", errorMessage.Code, sim.SpawnErrorOrbit)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+// Binary messages carry body frames and spawn packets, everything else is
+// sent as a JSON text message tagged with one of these types
+const (
+	MessageTypeError   = "error"
+	MessageTypeRate    = "rate"
+	MessageTypePing    = "ping"
+	MessageTypePong    = "pong"
+	MessageTypeEvents  = "events"
+	MessageTypeFields  = "fields"
+	MessageTypeSpawned = "spawned"
+	MessageTypeUndo    = "undo"
+	MessageTypeClear   = "clear"
+	MessageTypeRemoved = "removed"
+	MessageTypeQuota   = "quota"
+
+	MessageTypeTool       = "tool"
+	MessageTypeToolResult = "tool_result"
+
+	MessageTypePreview       = "preview"
+	MessageTypePreviewResult = "preview_result"
+
+	MessageTypeViewport  = "viewport"
+	MessageTypeBandwidth = "bandwidth"
+	MessageTypeSpawn     = "spawn"
+	MessageTypeChat      = "chat"
+)
+
+// ControlMessage is decoded first to find the type of a text message
+type ControlMessage struct {
+	Type string `json:"type"`
+}
+
+// RateMessage selects the client's send rate tier
+type RateMessage struct {
+	Type string `json:"type"`
+	Tier string `json:"tier"`
+}
+
+// PingMessage is sent by clients to estimate latency and the server clock offset
+type PingMessage struct {
+	Type       string `json:"type"`
+	ID         uint32 `json:"id"`
+	ClientTime int64  `json:"clientTime"`
+}
+
+// PongMessage echoes a ping with the server time it was received and
+// replied at, both in nanoseconds on the same clock as frame timestamps
+type PongMessage struct {
+	Type         string `json:"type"`
+	ID           uint32 `json:"id"`
+	ClientTime   int64  `json:"clientTime"`
+	ReceivedTime int64  `json:"receivedTime"`
+	ServerTime   int64  `json:"serverTime"`
+	Tick         uint64 `json:"tick"`
+}
+
+// ViewportMessage reports the area the client is looking at, a zero sized
+// viewport clears it so the client receives every body again
+type ViewportMessage struct {
+	Type string `json:"type"`
+	Viewport
+}
+
+// BandwidthMessage sets the client's bandwidth budget, 0 for the server default
+type BandwidthMessage struct {
+	Type           string `json:"type"`
+	BytesPerSecond int64  `json:"bytesPerSecond"`
+}
+
+// SpawnMessage is the JSON form of a binary spawn packet, using the same
+// fields as the bodies in JSON frames. With Orbit set the velocity is
+// replaced by one orbiting the body dominating the gravity at the spawn point,
+// the supplied velocity is kept when there is none
+type SpawnMessage struct {
+	Type string `json:"type"`
+	sim.BodyData
+	Orbit *sim.OrbitOptions `json:"orbit,omitempty"`
+}
+
+// ChatMessage is sent by players with only Text set and relayed by the hub to
+// every client, system messages announce joins and leaves
+type ChatMessage struct {
+	Type   string `json:"type"`
+	From   uint64 `json:"from,omitempty"`
+	Text   string `json:"text"`
+	Time   int64  `json:"time"`
+	System bool   `json:"system,omitempty"`
+}
+
+// EventsMessage carries the simulation events since the previous frame, Tick
+// is the tick of the frame that follows it
+type EventsMessage struct {
+	Type   string      `json:"type"`
+	Tick   uint64      `json:"tick"`
+	Events []sim.Event `json:"events"`
+}
+
+// SpawnedMessage tells a player the id of the body it spawned and the ids of
+// any bodies evicted to make room for it, Parent is set when an orbit was
+// assigned around that body
+type SpawnedMessage struct {
+	Type    string      `json:"type"`
+	Body    uint16      `json:"body"`
+	Evicted []uint16    `json:"evicted,omitempty"`
+	Parent  *uint16     `json:"parent,omitempty"`
+	Quota   QuotaStatus `json:"quota"`
+}
+
+// RemovedMessage answers an undo or clear with the ids of the player's bodies
+// that were removed
+type RemovedMessage struct {
+	Type   string      `json:"type"`
+	Bodies []uint16    `json:"bodies"`
+	Quota  QuotaStatus `json:"quota"`
+}
+
+// QuotaMessage answers a quota request with the player's quota status
+type QuotaMessage struct {
+	Type string `json:"type"`
+	QuotaStatus
+}
+
+// FieldsMessage lists every force field so clients can draw them, it is sent
+// on joining and whenever the fields change
+type FieldsMessage struct {
+	Type   string            `json:"type"`
+	Fields []sim.FieldConfig `json:"fields"`
+}
+
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newTextMessage(value interface{}) (Message, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{kind: websocket.TextMessage, data: data}, nil
+}
+
+// replyToClient queues a JSON text message for a single client through the hub
+func replyToClient(hub *Hub, client *Client, value interface{}) error {
+	message, err := newTextMessage(value)
+	if err != nil {
+		return err
+	}
+
+	hub.direct <- &ClientMessage{client: client, Message: message}
+	return nil
+}
+
+func replyError(hub *Hub, client *Client, code string, message string) {
+	hub.audit.record("rejected", client, "code", code, "reason", message)
+	reply := ErrorMessage{Type: MessageTypeError, Code: code, Message: message}
+	if err := replyToClient(hub, client, reply); err != nil {
+		client.logger.Error("Error replying to client", "err", err)
+	}
+}
+
+// handleControlMessage applies a JSON text message from a client
+func handleControlMessage(simState *sim.SimulationState, hub *Hub, message *ClientMessage) {
+	client := message.client
+	control := ControlMessage{}
+	if err := json.Unmarshal(message.data, &control); err != nil {
+		replyError(hub, client, "malformed", err.Error())
+		return
+	}
+
+	switch control.Type {
+	case MessageTypeRate:
+		rate := RateMessage{}
+		if err := json.Unmarshal(message.data, &rate); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		if !client.setSendTier(rate.Tier) {
+			replyError(hub, client, "invalid_rate", "unknown send rate tier "+rate.Tier)
+		}
+	case MessageTypePing:
+		ping := PingMessage{}
+		if err := json.Unmarshal(message.data, &ping); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		tick, _ := simState.LastTick()
+		pong := PongMessage{
+			Type:         MessageTypePong,
+			ID:           ping.ID,
+			ClientTime:   ping.ClientTime,
+			ReceivedTime: message.at,
+			ServerTime:   serverTime(),
+			Tick:         tick,
+		}
+
+		if err := replyToClient(hub, client, pong); err != nil {
+			client.logger.Error("Error replying to client", "err", err)
+		}
+	case MessageTypeViewport:
+		viewport := ViewportMessage{}
+		if err := json.Unmarshal(message.data, &viewport); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		if !client.setViewport(viewport.Viewport) {
+			replyError(hub, client, "invalid_viewport", "viewport must be finite with a positive size")
+		}
+	case MessageTypeBandwidth:
+		bandwidth := BandwidthMessage{}
+		if err := json.Unmarshal(message.data, &bandwidth); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		if !validBandwidth(bandwidth.BytesPerSecond) {
+			replyError(hub, client, "invalid_bandwidth", fmt.Sprintf("bytesPerSecond must be 0 or at least %v", MinClientBytesPerSecond))
+			return
+		}
+		client.bytesPerSecond.Store(bandwidth.BytesPerSecond)
+	case MessageTypeSpawn:
+		spawn := SpawnMessage{}
+		if err := json.Unmarshal(message.data, &spawn); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		if client.spectator {
+			ignoreSpectatorInput(client)
+			return
+		}
+
+		result, quota, err := handleSpawnMessage(simState, client.owner(), hub.quota.limit(client), spawn.BodyData, spawn.Orbit)
+		if err != nil {
+			rejectSpawn(hub, client, err)
+			return
+		}
+		recordSpawn(hub, client, result, quota)
+	case MessageTypeUndo, MessageTypeClear:
+		if client.spectator {
+			ignoreSpectatorInput(client)
+			return
+		}
+
+		removed, quota := removeOwned(simState, client.owner(), hub.quota.limit(client), control.Type == MessageTypeClear)
+		hub.audit.record(control.Type, client, "bodies", removed)
+		if err := replyToClient(hub, client, RemovedMessage{Type: MessageTypeRemoved, Bodies: removed, Quota: quota}); err != nil {
+			client.logger.Error("Error replying to client", "err", err)
+		}
+	case MessageTypeTool:
+		tool := ToolMessage{}
+		if err := json.Unmarshal(message.data, &tool); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+		handleToolMessage(simState, hub, client, &tool)
+	case MessageTypePreview:
+		preview := PreviewMessage{}
+		if err := json.Unmarshal(message.data, &preview); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+		handlePreviewMessage(simState, hub, client, &preview)
+	case MessageTypeQuota:
+		reply := QuotaMessage{Type: MessageTypeQuota, QuotaStatus: quotaStatus(simState, client.owner(), hub.quota.limit(client))}
+		if err := replyToClient(hub, client, reply); err != nil {
+			client.logger.Error("Error replying to client", "err", err)
+		}
+	case MessageTypeChat:
+		chat := ChatMessage{}
+		if err := json.Unmarshal(message.data, &chat); err != nil {
+			replyError(hub, client, "malformed", err.Error())
+			return
+		}
+
+		if client.spectator {
+			ignoreSpectatorInput(client)
+			return
+		}
+
+		if client.muted(time.Now()) {
+			replyError(hub, client, "muted", "you have been muted by a moderator")
+			return
+		}
+
+		if ok, _ := client.chatLimit.allow(time.Now()); !ok {
+			replyError(hub, client, "chat_rate_limited", "too many chat messages, slow down")
+			return
+		}
+
+		text, code, reason := hub.chatConfig.clean(chat.Text)
+		if len(code) > 0 {
+			replyError(hub, client, code, reason)
+			return
+		}
+
+		if text == chat.Text {
+			hub.audit.record("chat", client, "text", text)
+		} else {
+			hub.audit.record("chat", client, "text", text, "original", chat.Text)
+		}
+		hub.chat <- ChatMessage{Type: MessageTypeChat, From: client.id, Text: text, Time: message.at}
+	default:
+		replyError(hub, client, "unknown_type", "unknown message type "+control.Type)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+func TestPingPong(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	state.RecordTick(12, time.Now())
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	received := serverTime()
+	ping := &ClientMessage{
+		client:  client,
+		Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"ping","id":3,"clientTime":123456}`)},
+		at:      received,
+	}
+
+	go handleControlMessage(state, hub, ping)
+	reply := nextReply(t, client, MessageTypePong)
+
+	pong := PongMessage{}
+	if err := json.Unmarshal(reply.data, &pong); err != nil {
+		t.Fatalf("Error unmarshalling pong %v", err)
+	}
+
+	if pong.Type != MessageTypePong {
+		t.Errorf("Pong type is %v, expected %v", pong.Type, MessageTypePong)
+	}
+
+	if pong.ID != 3 {
+		t.Errorf("Pong id is %v, expected %v", pong.ID, 3)
+	}
+
+	if pong.ClientTime != 123456 {
+		t.Errorf("Pong clientTime is %v, expected %v", pong.ClientTime, 123456)
+	}
+
+	if pong.ReceivedTime != received {
+		t.Errorf("Pong receivedTime is %v, expected %v", pong.ReceivedTime, received)
+	}
+
+	if pong.ServerTime < pong.ReceivedTime {
+		t.Errorf("Pong serverTime is %v, expected >= %v", pong.ServerTime, pong.ReceivedTime)
+	}
+
+	if pong.Tick != 12 {
+		t.Errorf("Pong tick is %v, expected %v", pong.Tick, 12)
+	}
+}
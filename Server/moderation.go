@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+const DefaultBansFile = "bans.json"
+
+// Ban refuses connections from a session or an IP address until it expires,
+// the same record is used for chat mutes
+type Ban struct {
+	Session string    `json:"session,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	Admin   string    `json:"admin"`
+	Created time.Time `json:"created"`
+}
+
+func (ban Ban) matches(ip string, session string) bool {
+	return len(ban.IP) > 0 && ban.IP == ip || len(ban.Session) > 0 && ban.Session == session
+}
+
+// BanList holds the active bans and persists them to a JSON file so they
+// survive restarts, an empty path keeps them in memory only
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	bans []Ban
+}
+
+// LoadBanList reads the bans stored at path, a missing file is an empty list
+func LoadBanList(path string) (*BanList, error) {
+	list := &BanList{path: path, bans: []Ban{}}
+	if len(path) == 0 {
+		return list, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &list.bans); err != nil {
+		return nil, fmt.Errorf("error reading bans from %v: %w", path, err)
+	}
+	return list, nil
+}
+
+// save writes the bans to a temporary file and renames it over the list so
+// a crash never leaves a partial file, the caller must hold the lock
+func (list *BanList) save() error {
+	if len(list.path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(list.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(list.path), filepath.Base(list.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), list.path)
+}
+
+// prune forgets expired bans, the caller must hold the lock
+func (list *BanList) prune(now time.Time) {
+	active := list.bans[:0]
+	for _, ban := range list.bans {
+		if now.Before(ban.Until) {
+			active = append(active, ban)
+		}
+	}
+	list.bans = active
+}
+
+// Add stores a ban and persists the list
+func (list *BanList) Add(ban Ban, now time.Time) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.prune(now)
+	list.bans = append(list.bans, ban)
+	return list.save()
+}
+
+// Lift removes the bans on ip or session, including bans on both, and
+// persists the list, returning how many were removed
+func (list *BanList) Lift(ip string, session string, now time.Time) (int, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.prune(now)
+	remaining := list.bans[:0]
+	for _, ban := range list.bans {
+		if !ban.matches(ip, session) {
+			remaining = append(remaining, ban)
+		}
+	}
+
+	lifted := len(list.bans) - len(remaining)
+	list.bans = remaining
+	if lifted == 0 {
+		return 0, nil
+	}
+	return lifted, list.save()
+}
+
+// Active returns a copy of the bans that have not expired
+func (list *BanList) Active(now time.Time) []Ban {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.prune(now)
+	return append([]Ban{}, list.bans...)
+}
+
+// Check returns the ban on ip or session, if any
+func (list *BanList) Check(ip string, session string, now time.Time) (Ban, bool) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for _, ban := range list.bans {
+		if now.Before(ban.Until) && ban.matches(ip, session) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// refuse answers a /ws request from a banned session or address with 403
+// before it is upgraded, returning false when the request may continue
+func (list *BanList) refuse(w http.ResponseWriter, r *http.Request, proxies TrustedProxies, audit *AuditLog) bool {
+	ip := remoteHost(proxies.remoteAddr(r))
+	ban, banned := list.Check(ip, r.URL.Query().Get("session"), time.Now())
+	if !banned {
+		return false
+	}
+
+	slog.Info("Refusing banned connection", "remote", ip, "until", ban.Until)
+	audit.Record(AuditEvent{Event: "connect_refused", Remote: ip, Session: r.URL.Query().Get("session"), Details: map[string]interface{}{"until": ban.Until, "reason": ban.Reason}})
+	http.Error(w, fmt.Sprintf("banned until %v: %v", ban.Until.UTC().Format(time.RFC3339), ban.Reason), http.StatusForbidden)
+	return true
+}
+
+// remoteHost strips the port from a remote address so bans match every
+// connection from the same host
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// kickRequest asks the hub to disconnect every client matched by match
+type kickRequest struct {
+	match  func(client *Client) bool
+	reason string
+	done   chan []*Client
+}
+
+// findRequest asks the hub for every client matched by match
+type findRequest struct {
+	match func(client *Client) bool
+	done  chan []*Client
+}
+
+// matching returns the registered clients accepted by match, only called
+// from run.
+func (h *Hub) matching(match func(client *Client) bool) []*Client {
+	clients := []*Client{}
+	for client := range h.clients {
+		if match(client) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// kickClients disconnects every matching client with reason from any
+// goroutine and returns them.
+func (h *Hub) kickClients(match func(client *Client) bool, reason string) []*Client {
+	request := &kickRequest{match: match, reason: reason, done: make(chan []*Client, 1)}
+	h.kick <- request
+	return <-request.done
+}
+
+// findClients returns every matching client from any goroutine.
+func (h *Hub) findClients(match func(client *Client) bool) []*Client {
+	request := &findRequest{match: match, done: make(chan []*Client, 1)}
+	h.find <- request
+	return <-request.done
+}
+
+// kickMatching drops the clients of a kick request, only called from run.
+func (h *Hub) kickMatching(request *kickRequest) {
+	clients := h.matching(request.match)
+	for _, client := range clients {
+		h.drop(client, websocket.ClosePolicyViolation, "kicked: "+request.reason)
+	}
+	request.done <- clients
+}
+
+func playerMatch(id uint64) func(client *Client) bool {
+	return func(client *Client) bool { return client.id == id }
+}
+
+// ModerationRequest is the body of every moderation action, the target is
+// a connected player, a session or an IP address depending on the action
+type ModerationRequest struct {
+	Player   uint64 `json:"player"`
+	Session  string `json:"session"`
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// recordAction logs and audits a moderation action with the admin that took it
+func (api *AdminAPI) recordAction(admin string, action string, args ...any) {
+	slog.Info("Moderation action", append([]any{"admin", admin, "action", action}, args...)...)
+	api.hub.audit.Record(AuditEvent{Event: "admin_" + action, Admin: admin, Details: auditDetails(args)})
+}
+
+func decodeModeration(r *http.Request) (ModerationRequest, error) {
+	request := ModerationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return request, &adminError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	return request, nil
+}
+
+func (request ModerationRequest) duration() (time.Duration, error) {
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 {
+		return 0, &adminError{status: http.StatusBadRequest, message: "duration must be a positive duration such as 30m"}
+	}
+	return duration, nil
+}
+
+// findPlayer returns the connected player with the request's id
+func (api *AdminAPI) findPlayer(request ModerationRequest) (*Client, error) {
+	clients := api.hub.findClients(playerMatch(request.Player))
+	if request.Player == 0 || len(clients) == 0 {
+		return nil, &adminError{status: http.StatusNotFound, message: fmt.Sprintf("player %v is not connected", request.Player)}
+	}
+	return clients[0], nil
+}
+
+// target fills in the session and address of the request's player, if any,
+// so mutes and bans follow the player across reconnects. Both are used since
+// a player can drop either one when reconnecting.
+func (api *AdminAPI) target(request *ModerationRequest) error {
+	if request.Player != 0 {
+		client, err := api.findPlayer(*request)
+		if err != nil {
+			return err
+		}
+
+		request.Session = client.session
+		request.IP = remoteHost(client.remote)
+	}
+
+	if len(request.Session) == 0 && len(request.IP) == 0 {
+		return &adminError{status: http.StatusBadRequest, message: "player, session or ip is required"}
+	}
+	return nil
+}
+
+func (api *AdminAPI) kick(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	kicked := api.hub.kickClients(playerMatch(request.Player), request.Reason)
+	if request.Player == 0 || len(kicked) == 0 {
+		return nil, &adminError{status: http.StatusNotFound, message: fmt.Sprintf("player %v is not connected", request.Player)}
+	}
+
+	api.recordAction(admin, "kick", "player", request.Player, "reason", request.Reason)
+	return map[string]int{"kicked": len(kicked)}, nil
+}
+
+func (api *AdminAPI) mute(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := request.duration()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.target(&request); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	mute := Ban{
+		Session: request.Session,
+		IP:      request.IP,
+		Until:   now.Add(duration),
+		Reason:  request.Reason,
+		Admin:   admin,
+		Created: now,
+	}
+
+	if err := api.hub.mutes.Add(mute, now); err != nil {
+		return nil, err
+	}
+
+	api.recordAction(admin, "mute", "player", request.Player, "session", mute.Session, "ip", mute.IP, "until", mute.Until, "reason", mute.Reason)
+	return map[string]time.Time{"mutedUntil": mute.Until}, nil
+}
+
+func (api *AdminAPI) unmute(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.target(&request); err != nil {
+		return nil, err
+	}
+
+	lifted, err := api.hub.mutes.Lift(request.IP, request.Session, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	api.recordAction(admin, "unmute", "player", request.Player, "session", request.Session, "ip", request.IP, "lifted", lifted)
+	return map[string]interface{}{"muted": false, "lifted": lifted}, nil
+}
+
+func (api *AdminAPI) removeBodies(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// bodies outlive their owner's connection so after a kick they are
+	// found through the session, or the player id of a player without one
+	if request.Player != 0 {
+		if client, err := api.findPlayer(request); err == nil {
+			request.Session = client.session
+		}
+	} else if len(request.Session) == 0 {
+		return nil, &adminError{status: http.StatusBadRequest, message: "player or session is required"}
+	}
+
+	owner := ownerOf(request.Session, request.Player)
+	api.simState.Mu.Lock()
+	removed := sim.RemoveSimulationBodies(api.simState, sim.RemovedByAdmin, func(body *sim.BodyData) bool {
+		return body.Owner == owner
+	})
+	api.simState.Mu.Unlock()
+
+	api.recordAction(admin, "remove_bodies", "player", request.Player, "session", request.Session, "removed", removed, "reason", request.Reason)
+	return map[string]int{"removed": removed}, nil
+}
+
+func (api *AdminAPI) ban(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := request.duration()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.target(&request); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ban := Ban{
+		Session: request.Session,
+		IP:      request.IP,
+		Until:   now.Add(duration),
+		Reason:  request.Reason,
+		Admin:   admin,
+		Created: now,
+	}
+
+	if err := api.bans.Add(ban, now); err != nil {
+		return nil, err
+	}
+
+	kicked := api.hub.kickClients(func(client *Client) bool {
+		return ban.matches(remoteHost(client.remote), client.session)
+	}, "banned: "+request.Reason)
+
+	api.recordAction(admin, "ban", "player", request.Player, "session", ban.Session, "ip", ban.IP, "until", ban.Until, "reason", ban.Reason, "kicked", len(kicked))
+	return map[string]interface{}{"ban": ban, "kicked": len(kicked)}, nil
+}
+
+func (api *AdminAPI) unban(admin string, r *http.Request) (interface{}, error) {
+	request, err := decodeModeration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(request.Session) == 0 && len(request.IP) == 0 {
+		return nil, &adminError{status: http.StatusBadRequest, message: "session or ip is required"}
+	}
+
+	lifted, err := api.bans.Lift(request.IP, request.Session, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	api.recordAction(admin, "unban", "session", request.Session, "ip", request.IP, "lifted", lifted)
+	return map[string]int{"lifted": lifted}, nil
+}
+
+func (api *AdminAPI) listBans(admin string, r *http.Request) (interface{}, error) {
+	return map[string][]Ban{"bans": api.bans.Active(time.Now())}, nil
+}
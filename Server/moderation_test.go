@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/gorilla/websocket"
+)
+
+func TestBanList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	list, err := LoadBanList(path)
+	if err != nil {
+		t.Fatalf("Error loading missing ban list %v", err)
+	}
+
+	now := time.Now()
+	list.Add(Ban{IP: "10.0.0.1", Until: now.Add(time.Hour), Admin: "alice"}, now)
+	list.Add(Ban{Session: "abc", Until: now.Add(time.Minute), Admin: "bob"}, now)
+
+	// bans survive a restart
+	list, err = LoadBanList(path)
+	if err != nil {
+		t.Fatalf("Error loading ban list %v", err)
+	}
+
+	if ban, ok := list.Check("10.0.0.1", "", now); !ok || ban.Admin != "alice" {
+		t.Errorf("Check ip is %v, %v, expected alice's ban", ban, ok)
+	}
+
+	if _, ok := list.Check("10.0.0.2", "abc", now); !ok {
+		t.Errorf("Check session is %v, expected %v", ok, true)
+	}
+
+	if _, ok := list.Check("10.0.0.2", "abc", now.Add(2*time.Minute)); ok {
+		t.Errorf("Check expired session is %v, expected %v", ok, false)
+	}
+
+	if _, ok := list.Check("10.0.0.2", "", now); ok {
+		t.Errorf("Check unbanned ip is %v, expected %v", ok, false)
+	}
+
+	lifted, err := list.Lift("10.0.0.1", "", now)
+	if err != nil || lifted != 1 {
+		t.Errorf("Lift is %v, %v, expected %v, nil", lifted, err, 1)
+	}
+
+	list, _ = LoadBanList(path)
+	if bans := list.Active(now); len(bans) != 1 || bans[0].Session != "abc" {
+		t.Errorf("Active bans are %v, expected the session ban", bans)
+	}
+}
+
+func TestBanRefusesUpgrade(t *testing.T) {
+	list, _ := LoadBanList("")
+	now := time.Now()
+	list.Add(Ban{IP: "10.0.0.1", Until: now.Add(time.Hour), Reason: "griefing"}, now)
+
+	tests := []struct {
+		remote, session string
+		refused         bool
+	}{
+		{"10.0.0.1:4000", "", true},
+		{"10.0.0.2:4000", "", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ws?session="+test.session, nil)
+		request.RemoteAddr = test.remote
+		recorder := httptest.NewRecorder()
+
+		if refused := list.refuse(recorder, request, nil, nil); refused != test.refused {
+			t.Errorf("refuse %v is %v, expected %v", test.remote, refused, test.refused)
+		}
+
+		if test.refused && (recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "griefing")) {
+			t.Errorf("Refused response is %v %q, expected %v with the reason", recorder.Code, recorder.Body.String(), http.StatusForbidden)
+		}
+	}
+
+	// proxied requests are matched on the address our proxy forwarded
+	proxies, _ := parseTrustedProxies("192.168.0.0/16")
+	request := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	request.RemoteAddr = "192.168.0.1:4000"
+	request.Header.Set("X-Forwarded-For", "10.0.0.2, 10.0.0.1")
+	if !list.refuse(httptest.NewRecorder(), request, proxies, nil) {
+		t.Errorf("refuse forwarded is %v, expected %v", false, true)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("192.168.0.0/16, 172.16.0.1")
+	if err != nil {
+		t.Fatalf("Error parsing trusted proxies %v", err)
+	}
+
+	tests := []struct {
+		remote, forwarded, expected string
+	}{
+		{"10.0.0.1:4000", "", "10.0.0.1:4000"},
+		// a header sent past our proxies is ignored
+		{"10.0.0.1:4000", "10.0.0.2", "10.0.0.1:4000"},
+		// the client may prepend anything, only the entry our proxy added counts
+		{"192.168.0.1:4000", "10.0.0.9, 10.0.0.2", "10.0.0.2"},
+		// chained proxies are skipped from the right
+		{"192.168.0.1:4000", "10.0.0.9, 10.0.0.2, 172.16.0.1", "10.0.0.2"},
+		{"192.168.0.1:4000", "172.16.0.1", "172.16.0.1"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		request.RemoteAddr = test.remote
+		if len(test.forwarded) > 0 {
+			request.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if addr := proxies.remoteAddr(request); addr != test.expected {
+			t.Errorf("remoteAddr from %v forwarding %q is %v, expected %v", test.remote, test.forwarded, addr, test.expected)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.1, nope"); err == nil {
+		t.Errorf("Parsing an invalid proxy is %v, expected an error", err)
+	}
+}
+
+// adminRequest sends a moderation request as alice and decodes the response
+func adminRequest(t *testing.T, mux *http.ServeMux, path string, body string) (int, map[string]interface{}) {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Error unmarshalling admin response %v", err)
+	}
+	return recorder.Code, result
+}
+
+func TestAdminModeration(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	bans, _ := LoadBanList(filepath.Join(t.TempDir(), "bans.json"))
+	mux := http.NewServeMux()
+	newAdminAPI(map[string]string{"secret": "alice"}, state, hub, bans).register(mux)
+
+	griefer := newClient(hub, nil, "10.0.0.1:4000")
+	griefer.session = "griefer"
+	other := newClient(hub, nil, "10.0.0.2:4000")
+	hub.register <- griefer
+	hub.register <- other
+
+	for i := 0; i < 3; i++ {
+		handleSimulationStateInput(state, griefer.owner(), 0, packBody(t, sim.BodyData{P: mgl32.Vec2{float32(i * 5), 0}, R: 1}))
+	}
+	handleSimulationStateInput(state, other.owner(), 0, packBody(t, sim.BodyData{P: mgl32.Vec2{0, 20}, R: 1}))
+
+	status, result := adminRequest(t, mux, "/admin/mute", `{"player":`+strconv.FormatUint(griefer.id, 10)+`,"duration":"10m"}`)
+	if status != http.StatusOK || !griefer.muted(time.Now()) {
+		t.Errorf("Mute status is %v, muted %v, expected %v, %v", status, griefer.muted(time.Now()), http.StatusOK, true)
+	}
+
+	status, result = adminRequest(t, mux, "/admin/remove-bodies", `{"player":`+strconv.FormatUint(griefer.id, 10)+`}`)
+	if status != http.StatusOK || result["removed"] != float64(3) || len(state.Bodies) != 1 {
+		t.Errorf("Remove bodies status is %v, result %v, bodies %v, expected %v, 3 removed, 1 body", status, result, len(state.Bodies), http.StatusOK)
+	}
+
+	// an address may be shared by many players so it does not own bodies
+	if status, _ = adminRequest(t, mux, "/admin/remove-bodies", `{"ip":"10.0.0.2"}`); status != http.StatusBadRequest || len(state.Bodies) != 1 {
+		t.Errorf("Remove bodies by address status is %v leaving %v bodies, expected %v and 1 body", status, len(state.Bodies), http.StatusBadRequest)
+	}
+
+	// the bodies of a player without a session are found by its id after it leaves
+	departed := newClient(hub, nil, "10.0.0.2:4000")
+	handleSimulationStateInput(state, departed.owner(), 0, packBody(t, sim.BodyData{P: mgl32.Vec2{0, -20}, R: 1}))
+	status, result = adminRequest(t, mux, "/admin/remove-bodies", `{"player":`+strconv.FormatUint(departed.id, 10)+`}`)
+	if status != http.StatusOK || result["removed"] != float64(1) || len(state.Bodies) != 1 {
+		t.Errorf("Remove bodies of a departed player status is %v, result %v, bodies %v, expected %v, 1 removed, 1 body", status, result, len(state.Bodies), http.StatusOK)
+	}
+
+	status, result = adminRequest(t, mux, "/admin/ban", `{"player":`+strconv.FormatUint(griefer.id, 10)+`,"duration":"1h","reason":"griefing"}`)
+	if status != http.StatusOK || result["kicked"] != float64(1) {
+		t.Errorf("Ban status is %v, result %v, expected %v and 1 kicked", status, result, http.StatusOK)
+	}
+
+	if reason := griefer.closeReason.Load(); reason == nil || reason.code != websocket.ClosePolicyViolation {
+		t.Errorf("Banned client close is %v, expected code %v", reason, websocket.ClosePolicyViolation)
+	}
+
+	if ban, ok := bans.Check("10.0.0.9", "griefer", time.Now()); !ok || ban.Admin != "alice" || ban.Reason != "griefing" {
+		t.Errorf("Session ban is %v, %v, expected alice's ban for griefing", ban, ok)
+	}
+
+	// reconnecting without the session does not get around the ban
+	if _, ok := bans.Check("10.0.0.1", "", time.Now()); !ok {
+		t.Errorf("Address ban is %v, expected %v", ok, true)
+	}
+
+	// nor does it get around the mute
+	reconnected := newClient(hub, nil, "10.0.0.1:4001")
+	if !reconnected.muted(time.Now()) {
+		t.Errorf("Reconnected muted is %v, expected %v", false, true)
+	}
+
+	status, _ = adminRequest(t, mux, "/admin/unmute", `{"session":"griefer"}`)
+	if status != http.StatusOK || reconnected.muted(time.Now()) {
+		t.Errorf("Unmute status is %v, muted %v, expected %v, %v", status, reconnected.muted(time.Now()), http.StatusOK, false)
+	}
+
+	status, _ = adminRequest(t, mux, "/admin/kick", `{"player":`+strconv.FormatUint(griefer.id, 10)+`}`)
+	if status != http.StatusNotFound {
+		t.Errorf("Kick disconnected player status is %v, expected %v", status, http.StatusNotFound)
+	}
+
+	status, _ = adminRequest(t, mux, "/admin/kick", `{"player":`+strconv.FormatUint(other.id, 10)+`,"reason":"testing"}`)
+	if reason := other.closeReason.Load(); status != http.StatusOK || reason == nil || reason.text != "kicked: testing" {
+		t.Errorf("Kick status is %v, close %v, expected %v and the kick reason", status, reason, http.StatusOK)
+	}
+
+	status, _ = adminRequest(t, mux, "/admin/ban", `{"ip":"10.0.0.3"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("Ban without duration status is %v, expected %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestMutedChat(t *testing.T) {
+	state := sim.CreateEmptySimulationState(2, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	client.session = "muted"
+	hub.mutes.Add(Ban{Session: "muted", Until: time.Now().Add(time.Minute)}, time.Now())
+	hub.register <- client
+
+	go handleControlMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(`{"type":"chat","text":"hello"}`)}})
+	reply := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &reply); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if reply.Code != "muted" {
+		t.Errorf("Reply code is %v, expected %v", reply.Code, "muted")
+	}
+}
+
+func packBody(t *testing.T, body sim.BodyData) []byte {
+	data, err := body.Pack()
+	if err != nil {
+		t.Fatalf("Error trying to pack BodyData: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+// Limits of trajectory previews, each client may start previewBurst previews
+// per previewInterval
+const (
+	DefaultPreviewMode        = string(sim.PreviewFrozen)
+	DefaultPreviewTicks       = 600
+	DefaultPreviewStride      = 10
+	DefaultPreviewConcurrency = 1
+	DefaultPreviewBudget      = 20 * time.Millisecond
+
+	previewInterval = time.Second
+	previewBurst    = 4
+)
+
+// PreviewConfig limits the trajectory previews clients may ask for
+type PreviewConfig struct {
+	Mode sim.PreviewMode
+
+	// Most ticks a preview may run and the ticks between its points
+	Ticks  int
+	Stride int
+
+	// Previews a client may have running at once
+	Concurrency int
+
+	// Longest a single preview may run before it is cut short
+	Budget time.Duration
+
+	// Seconds of a simulation tick
+	DeltaTime float32
+}
+
+func DefaultPreviewConfig() PreviewConfig {
+	return PreviewConfig{
+		Mode:        sim.PreviewFrozen,
+		Ticks:       DefaultPreviewTicks,
+		Stride:      DefaultPreviewStride,
+		Concurrency: DefaultPreviewConcurrency,
+		Budget:      DefaultPreviewBudget,
+		DeltaTime:   1.0 / float32(DefaultSimHz),
+	}
+}
+
+// PreviewMessage asks where a body spawned with the same fields would go, ID
+// is echoed in the result so clients can match it to the request and Ticks
+// shortens the preview, 0 for the longest allowed
+type PreviewMessage struct {
+	Type string `json:"type"`
+	ID   uint32 `json:"id"`
+	sim.BodyData
+	Orbit *sim.OrbitOptions `json:"orbit,omitempty"`
+	Ticks int               `json:"ticks,omitempty"`
+}
+
+// PreviewResultMessage answers a preview message with the predicted path and
+// fate of the body, Parent is set when an orbit was assigned around that body
+type PreviewResultMessage struct {
+	Type   string  `json:"type"`
+	ID     uint32  `json:"id"`
+	Parent *uint16 `json:"parent,omitempty"`
+	sim.Prediction
+}
+
+// forkForPreview validates the previewed body like a spawn and forks the
+// simulation for it, holding the simulation lock only while copying
+func forkForPreview(simState *sim.SimulationState, preview *PreviewMessage) (*sim.SimulationState, sim.BodyData, *uint16, error) {
+	defer simState.Mu.Unlock()
+	simState.Mu.Lock()
+
+	body := preview.BodyData
+	if err := sim.ValidateSpawn(simState, &body); err != nil {
+		return nil, body, nil, err
+	}
+
+	var parent *uint16
+	if preview.Orbit != nil {
+		if err := preview.Orbit.Validate(); err != nil {
+			return nil, body, nil, err
+		}
+		if id, ok := sim.AssignOrbit(simState, &body, *preview.Orbit); ok {
+			parent = &id
+		}
+	}
+
+	return sim.ForkSimulationState(simState), body, parent, nil
+}
+
+// runPreview predicts the trajectory of a checked preview message and replies
+// with it, it runs on its own goroutine so frames keep flowing meanwhile
+func runPreview(simState *sim.SimulationState, hub *Hub, client *Client, preview *PreviewMessage) {
+	defer client.previews.Add(-1)
+
+	config := hub.preview
+	fork, body, parent, err := forkForPreview(simState, preview)
+	if err != nil {
+		code, reason := "invalid_preview", err.Error()
+		if spawnErr, ok := err.(*sim.SpawnError); ok {
+			code, reason = string(spawnErr.Code), spawnErr.Reason
+		}
+		replyError(hub, client, code, reason)
+		return
+	}
+
+	ticks := config.Ticks
+	if preview.Ticks > 0 {
+		ticks = preview.Ticks
+	}
+
+	prediction := sim.PredictTrajectory(fork, body, sim.PreviewOptions{
+		Mode:      config.Mode,
+		Ticks:     ticks,
+		DeltaTime: config.DeltaTime,
+		Stride:    config.Stride,
+		Deadline:  time.Now().Add(config.Budget),
+	})
+
+	reply := PreviewResultMessage{Type: MessageTypePreviewResult, ID: preview.ID, Parent: parent, Prediction: prediction}
+	if err := replyToClient(hub, client, reply); err != nil {
+		client.logger.Error("Error replying to client", "err", err)
+	}
+}
+
+// handlePreviewMessage checks a preview message against the client's limits
+// and starts it
+func handlePreviewMessage(simState *sim.SimulationState, hub *Hub, client *Client, preview *PreviewMessage) {
+	if client.spectator {
+		ignoreSpectatorInput(client)
+		return
+	}
+
+	config := hub.preview
+	if preview.Ticks < 0 || preview.Ticks > config.Ticks {
+		replyError(hub, client, "invalid_preview", fmt.Sprintf("ticks must be 0 to %v", config.Ticks))
+		return
+	}
+
+	if ok, _ := client.previewLimit.allow(time.Now()); !ok {
+		replyError(hub, client, "preview_rate_limited", "too many preview messages")
+		return
+	}
+
+	if int(client.previews.Add(1)) > config.Concurrency {
+		client.previews.Add(-1)
+		replyError(hub, client, "preview_busy", fmt.Sprintf("at most %v previews may run at once", config.Concurrency))
+		return
+	}
+
+	go runPreview(simState, hub, client, preview)
+}
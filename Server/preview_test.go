@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+func TestPreviewMessage(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	star, _ := sim.AddSimulationBody(state, sim.BodyData{R: 5})
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	sendControl(state, hub, client, `{"type":"preview","id":7,"p":[20,0],"r":0.5,"orbit":{"eccentricity":0},"ticks":120}`)
+	result := PreviewResultMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypePreviewResult).data, &result); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if result.ID != 7 {
+		t.Errorf("Preview result id is %v, expected %v", result.ID, 7)
+	}
+
+	if result.Parent == nil || *result.Parent != star {
+		t.Errorf("Preview result parent is %v, expected %v", result.Parent, star)
+	}
+
+	if result.Fate != sim.FateOrbit || result.Ticks != 120 {
+		t.Errorf("Preview result is %v after %v ticks, expected %v after %v", result.Fate, result.Ticks, sim.FateOrbit, 120)
+	}
+
+	if len(result.Points) != 120/DefaultPreviewStride+1 {
+		t.Errorf("Preview result has %v points, expected %v", len(result.Points), 120/DefaultPreviewStride+1)
+	}
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	if len(state.Bodies) != 1 {
+		t.Errorf("Simulation has %v bodies after a preview, expected %v", len(state.Bodies), 1)
+	}
+}
+
+func TestPreviewLimits(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 3, 100, 1000, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	expectError := func(code string) {
+		t.Helper()
+		errorMessage := ErrorMessage{}
+		if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+			t.Fatalf("Error unmarshalling reply %v", err)
+		}
+
+		if errorMessage.Code != code {
+			t.Errorf("Preview reply code is %v, expected %v", errorMessage.Code, code)
+		}
+	}
+
+	sendControl(state, hub, client, `{"type":"preview","p":[20,0],"r":0.5,"ticks":100000}`)
+	expectError("invalid_preview")
+
+	sendControl(state, hub, client, `{"type":"preview","p":[20,0],"r":0.5,"orbit":{"eccentricity":2}}`)
+	expectError(string(sim.SpawnErrorOrbit))
+
+	// a client may only run one preview at a time by default
+	client.previews.Store(1)
+	sendControl(state, hub, client, `{"type":"preview","p":[20,0],"r":0.5}`)
+	expectError("preview_busy")
+	client.previews.Store(0)
+
+	for i := 0; i < previewBurst-2; i++ {
+		sendControl(state, hub, client, `{"type":"preview","p":[20,0],"r":0.5,"ticks":10}`)
+		nextReply(t, client, MessageTypePreviewResult)
+	}
+
+	sendControl(state, hub, client, `{"type":"preview","p":[20,0],"r":0.5,"ticks":10}`)
+	expectError("preview_rate_limited")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+)
+
+// Live bodies a player or admin may own at once, 0 for no limit
+const DefaultPlayerQuota = 0
+const DefaultAdminQuota = 0
+
+// QuotaConfig limits how many live bodies each player may own
+type QuotaConfig struct {
+	Player int
+	Admin  int
+}
+
+func DefaultQuotaConfig() QuotaConfig {
+	return QuotaConfig{Player: DefaultPlayerQuota, Admin: DefaultAdminQuota}
+}
+
+// limit returns the quota of a client, admins have their own
+func (config QuotaConfig) limit(client *Client) int {
+	if len(client.admin) > 0 {
+		return config.Admin
+	}
+	return config.Player
+}
+
+// QuotaStatus is sent to players with every change to their bodies so the
+// client can show the remaining capacity, Limit is 0 when unlimited
+type QuotaStatus struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+// ownerOf returns the owner id given to the bodies of a player. Bodies are
+// owned by the session so quotas, undo and clear carry over reconnects and
+// extra tabs, or by the connection without one since players behind the same
+// address are not the same player.
+func ownerOf(session string, conn uint64) uint64 {
+	hash := fnv.New64a()
+	if len(session) > 0 {
+		hash.Write([]byte("session:" + session))
+	} else {
+		hash.Write([]byte("conn:" + strconv.FormatUint(conn, 10)))
+	}
+
+	// 0 is left for bodies without an owner
+	return max(hash.Sum64(), 1)
+}
+
+// owner returns the owner id of the bodies the client spawns
+func (c *Client) owner() uint64 {
+	return ownerOf(c.session, c.id)
+}
+
+// countOwned returns the number of live bodies owned by owner, the caller
+// must hold the simulation lock
+func countOwned(simState *sim.SimulationState, owner uint64) int {
+	count := 0
+	for i := range simState.Bodies {
+		if simState.Bodies[i].Owner == owner {
+			count++
+		}
+	}
+	return count
+}
+
+// spawnOwned adds a validated body owned by owner if the owner is within
+// quota, the caller must hold the simulation lock
+func spawnOwned(simState *sim.SimulationState, owner uint64, quota int, data sim.BodyData) (sim.SpawnResult, QuotaStatus, error) {
+	status := QuotaStatus{Used: countOwned(simState, owner), Limit: quota}
+	if quota > 0 && status.Used >= quota {
+		return sim.SpawnResult{}, status, &sim.SpawnError{Code: sim.SpawnErrorQuota, Reason: fmt.Sprintf("%v of %v bodies in use", status.Used, quota)}
+	}
+
+	data.Owner = owner
+	result, err := sim.SpawnSimulationBody(simState, data)
+	if err != nil {
+		return result, status, err
+	}
+
+	// evicting one of the owner's own bodies leaves the count unchanged
+	status.Used = countOwned(simState, owner)
+	return result, status, nil
+}
+
+// removeOwned removes the newest live body of owner, or every one of them
+// when all is set, returning the removed ids and the owner's quota status
+func removeOwned(simState *sim.SimulationState, owner uint64, quota int, all bool) ([]uint16, QuotaStatus) {
+	defer simState.Mu.Unlock()
+	simState.Mu.Lock()
+
+	// bodies are kept in spawn order so the newest is the last one
+	newest := -1
+	for i := range simState.Bodies {
+		if simState.Bodies[i].Owner == owner {
+			newest = i
+		}
+	}
+
+	removed := []uint16{}
+	if newest >= 0 {
+		undo := simState.Bodies[newest].I
+		sim.RemoveSimulationBodies(simState, sim.RemovedByOwner, func(body *sim.BodyData) bool {
+			if body.Owner != owner || (!all && body.I != undo) {
+				return false
+			}
+			removed = append(removed, body.I)
+			return true
+		})
+	}
+
+	return removed, QuotaStatus{Used: countOwned(simState, owner), Limit: quota}
+}
+
+// quotaStatus returns how many bodies owner has alive
+func quotaStatus(simState *sim.SimulationState, owner uint64, quota int) QuotaStatus {
+	defer simState.Mu.Unlock()
+	simState.Mu.Lock()
+	return QuotaStatus{Used: countOwned(simState, owner), Limit: quota}
+}
+
+// deliverQuotas sends a quota update to the players whose bodies the
+// snapshot's events spawned or removed, including merges, escapes, expiry and
+// evictions they did not ask for, only called from run
+func (h *Hub) deliverQuotas(snapshot *Snapshot) {
+	owners := map[uint64]bool{}
+	for _, event := range snapshot.Events {
+		if event.Owner != 0 {
+			owners[event.Owner] = true
+		}
+	}
+	if len(owners) == 0 {
+		return
+	}
+
+	used := map[uint64]int{}
+	for i := range snapshot.Bodies {
+		if owners[snapshot.Bodies[i].Owner] {
+			used[snapshot.Bodies[i].Owner]++
+		}
+	}
+
+	for client := range h.clients {
+		owner := client.owner()
+		if client.spectator || !owners[owner] {
+			continue
+		}
+
+		message, err := newTextMessage(QuotaMessage{Type: MessageTypeQuota, QuotaStatus: QuotaStatus{Used: used[owner], Limit: h.quota.limit(client)}})
+		if err != nil {
+			slog.Error("Error encoding quota message", "err", err)
+			return
+		}
+		h.deliver(client, message)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/gorilla/websocket"
+)
+
+func sendControl(state *sim.SimulationState, hub *Hub, client *Client, data string) {
+	handleClientMessage(state, hub, &ClientMessage{client: client, Message: Message{kind: websocket.TextMessage, data: []byte(data)}})
+}
+
+func TestQuotaLimit(t *testing.T) {
+	config := QuotaConfig{Player: 3, Admin: 10}
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	player := newClient(hub, nil, "player")
+	admin := newClient(hub, nil, "admin")
+	admin.admin = "alice"
+
+	if limit := config.limit(player); limit != 3 {
+		t.Errorf("Player quota is %v, expected %v", limit, 3)
+	}
+
+	if limit := config.limit(admin); limit != 10 {
+		t.Errorf("Admin quota is %v, expected %v", limit, 10)
+	}
+}
+
+func TestQuotaUndoAndClear(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.quota.Player = 2
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	for i := 1; i <= 3; i++ {
+		sendControl(state, hub, client, `{"type":"spawn","p":[`+strconv.Itoa(i*10)+`,0],"r":1}`)
+	}
+
+	spawned := SpawnedMessage{}
+	nextReply(t, client, MessageTypeSpawned)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeSpawned).data, &spawned); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if spawned.Quota != (QuotaStatus{Used: 2, Limit: 2}) {
+		t.Errorf("Spawned quota is %+v, expected %v of %v used", spawned.Quota, 2, 2)
+	}
+
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorQuota) || len(state.Bodies) != 2 {
+		t.Errorf("Over quota reply is %v with %v bodies, expected %v with %v", errorMessage.Code, len(state.Bodies), sim.SpawnErrorQuota, 2)
+	}
+
+	// other players' bodies are never removed
+	sim.AddSimulationBody(state, sim.BodyData{R: 1, Owner: client.owner() + 1})
+	newest := state.Bodies[1].I
+
+	removed := RemovedMessage{}
+	sendControl(state, hub, client, `{"type":"undo"}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeRemoved).data, &removed); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if len(removed.Bodies) != 1 || removed.Bodies[0] != newest || removed.Quota.Used != 1 {
+		t.Errorf("Undo removed %v with quota %+v, expected [%v] with %v used", removed.Bodies, removed.Quota, newest, 1)
+	}
+
+	sendControl(state, hub, client, `{"type":"spawn","p":[50,0],"r":1}`)
+	sendControl(state, hub, client, `{"type":"clear"}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeRemoved).data, &removed); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if len(removed.Bodies) != 2 || removed.Quota.Used != 0 || len(state.Bodies) != 1 {
+		t.Errorf("Clear removed %v with quota %+v leaving %v bodies, expected 2 removed, 0 used and 1 body", removed.Bodies, removed.Quota, len(state.Bodies))
+	}
+
+	quota := QuotaMessage{}
+	sendControl(state, hub, client, `{"type":"quota"}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeQuota).data, &quota); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if quota.QuotaStatus != (QuotaStatus{Used: 0, Limit: 2}) {
+		t.Errorf("Quota reply is %+v, expected %v of %v used", quota.QuotaStatus, 0, 2)
+	}
+}
+
+func TestQuotaFollowsSession(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.quota.Player = 2
+	go hub.run()
+
+	first := newClient(hub, nil, "10.0.0.1:4000")
+	first.session = "abc"
+	hub.register <- first
+
+	sendControl(state, hub, first, `{"type":"spawn","p":[10,0],"r":1}`)
+	sendControl(state, hub, first, `{"type":"spawn","p":[20,0],"r":1}`)
+	nextReply(t, first, MessageTypeSpawned)
+	nextReply(t, first, MessageTypeSpawned)
+
+	// a second tab, or a reconnect from another address, shares the quota
+	second := newClient(hub, nil, "10.0.0.2:4000")
+	second.session = "abc"
+	hub.register <- second
+
+	sendControl(state, hub, second, `{"type":"spawn","p":[30,0],"r":1}`)
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, second, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorQuota) {
+		t.Errorf("Second tab spawn reply is %v, expected %v", errorMessage.Code, sim.SpawnErrorQuota)
+	}
+
+	removed := RemovedMessage{}
+	sendControl(state, hub, second, `{"type":"clear"}`)
+	if err := json.Unmarshal(nextReply(t, second, MessageTypeRemoved).data, &removed); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if len(removed.Bodies) != 2 || len(state.Bodies) != 0 {
+		t.Errorf("Second tab cleared %v leaving %v bodies, expected the 2 bodies of the first", removed.Bodies, len(state.Bodies))
+	}
+
+	// players without a session are told apart by connection, not address
+	third := newClient(hub, nil, "10.0.0.1:4000")
+	fourth := newClient(hub, nil, "10.0.0.1:4000")
+	if third.owner() == fourth.owner() || third.owner() == first.owner() {
+		t.Errorf("Players without a session share owner %v", third.owner())
+	}
+}
+
+func TestQuotaPushedOnRemoval(t *testing.T) {
+	state := sim.CreateEmptySimulationState(8, 0, 1, 10, 100, 15, 1)
+	broadcast := make(chan *Snapshot)
+	hub := newHub(broadcast, make(chan *ClientMessage))
+	hub.quota.Player = 5
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	sendControl(state, hub, client, `{"type":"spawn","p":[0,0],"r":1}`)
+	sendControl(state, hub, client, `{"type":"spawn","p":[10,0],"v":[100,0],"r":1}`)
+	nextReply(t, client, MessageTypeSpawned)
+	nextReply(t, client, MessageTypeSpawned)
+
+	// skip the spawn events so only the escape is broadcast
+	events, cancel := state.Subscribe(1)
+	defer cancel()
+	state.PublishEvents(0)
+	<-events
+
+	sim.UpdateSimulationState(state, 0.1)
+	state.PublishEvents(1)
+	snapshot := takeSnapshot(state)
+	snapshot.Events = <-events
+	broadcast <- snapshot
+
+	quota := QuotaMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeQuota).data, &quota); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if quota.QuotaStatus != (QuotaStatus{Used: 1, Limit: 5}) {
+		t.Errorf("Quota after escape is %+v, expected %v of %v used", quota.QuotaStatus, 1, 5)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to burst tokens that refills at
+// burst tokens per interval. It limits both noisy log lines and client
+// messages, and counts what it refused so the next allowed use can report it.
+type rateLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	burst      int
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{interval: interval, burst: burst, tokens: float64(burst)}
+}
+
+// allow takes a token if there is one, reporting whether the use is allowed
+// and how many uses were refused since the last allowed one
+func (l *rateLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() && l.interval > 0 {
+		refill := float64(l.burst) * float64(now.Sub(l.last)) / float64(l.interval)
+		l.tokens = min(float64(l.burst), l.tokens+refill)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false, 0
+	}
+
+	l.tokens--
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// log writes the line through logger if the limiter allows it
+func (l *rateLimiter) log(logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	ok, suppressed := l.allow(time.Now())
+	if !ok {
+		return
+	}
+
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow(now); !ok {
+			t.Errorf("Limiter allow %v is %v, expected %v", i, ok, true)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(now); ok {
+			t.Errorf("Limiter allow over burst %v is %v, expected %v", i, ok, false)
+		}
+	}
+
+	ok, suppressed := limiter.allow(now.Add(time.Second))
+	if !ok {
+		t.Errorf("Limiter allow after interval is %v, expected %v", ok, true)
+	}
+
+	if suppressed != 3 {
+		t.Errorf("Limiter suppressed is %v, expected %v", suppressed, 3)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 4)
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		limiter.allow(now)
+	}
+
+	// a quarter of the interval earns a quarter of the burst back
+	now = now.Add(time.Second / 4)
+	if ok, _ := limiter.allow(now); !ok {
+		t.Errorf("Limiter allow after a refill is %v, expected %v", ok, true)
+	}
+
+	if ok, _ := limiter.allow(now); ok {
+		t.Errorf("Limiter allow past the refill is %v, expected %v", ok, false)
+	}
+}
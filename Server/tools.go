@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Sandbox tools players can use on the simulation with tool messages
+const (
+	ToolGrab    = "grab"
+	ToolRelease = "release"
+	ToolImpulse = "impulse"
+	ToolExplode = "explode"
+	ToolErase   = "erase"
+	ToolCluster = "cluster"
+)
+
+// ToolPermission is who may use a tool
+type ToolPermission string
+
+const (
+	ToolEveryone ToolPermission = "all"
+	ToolAdmin    ToolPermission = "admin"
+	ToolOff      ToolPermission = "off"
+)
+
+// Limits of the tool messages, tools are rate limited to toolBurst uses per
+// toolInterval except grab and release, which follow the cursor and have
+// their own higher limit of grabBurst per grabInterval
+const (
+	DefaultToolMaxRadius   = 25
+	DefaultToolMaxStrength = 50
+	DefaultToolMaxCluster  = 16
+
+	toolInterval = time.Second
+	toolBurst    = 5
+
+	grabInterval = time.Second
+	grabBurst    = 60
+)
+
+// ToolConfig limits what tool messages may do
+type ToolConfig struct {
+	// Largest radius of explode, erase and cluster
+	MaxRadius float32
+
+	// Largest impulse and explosion strength
+	MaxStrength float32
+
+	// Most bodies spawned by one cluster
+	MaxCluster int
+
+	// Who may use each tool, tools that are missing may be used by everyone
+	Permissions map[string]ToolPermission
+}
+
+func DefaultToolConfig() ToolConfig {
+	return ToolConfig{
+		MaxRadius:   DefaultToolMaxRadius,
+		MaxStrength: DefaultToolMaxStrength,
+		MaxCluster:  DefaultToolMaxCluster,
+		Permissions: map[string]ToolPermission{ToolErase: ToolAdmin},
+	}
+}
+
+// parseToolPermissions reads a comma separated list of tool:permission pairs
+// on top of the default permissions
+func parseToolPermissions(value string, permissions map[string]ToolPermission) (map[string]ToolPermission, error) {
+	parsed := make(map[string]ToolPermission, len(permissions))
+	for tool, permission := range permissions {
+		parsed[tool] = permission
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+
+		tool, permission, ok := strings.Cut(pair, ":")
+		if !ok || !knownTool(tool) {
+			return nil, fmt.Errorf("tool permission %q is not in the form tool:permission", pair)
+		}
+
+		switch ToolPermission(permission) {
+		case ToolEveryone, ToolAdmin, ToolOff:
+			parsed[tool] = ToolPermission(permission)
+		default:
+			return nil, fmt.Errorf("tool permission %q must be all, admin or off", permission)
+		}
+	}
+	return parsed, nil
+}
+
+func knownTool(tool string) bool {
+	switch tool {
+	case ToolGrab, ToolRelease, ToolImpulse, ToolExplode, ToolErase, ToolCluster:
+		return true
+	}
+	return false
+}
+
+// allowed reports whether a client may use a tool, releasing a grab is
+// always allowed
+func (config ToolConfig) allowed(client *Client, tool string) bool {
+	if tool == ToolRelease {
+		return true
+	}
+
+	switch config.Permissions[tool] {
+	case ToolOff:
+		return false
+	case ToolAdmin:
+		return len(client.admin) > 0
+	default:
+		return true
+	}
+}
+
+// ToolMessage uses a tool, the fields used depend on the tool:
+//
+//	grab:    Body, P the point to pull it towards
+//	impulse: Body, V the change in velocity
+//	explode: P, Radius, Strength
+//	erase:   P, Radius
+//	cluster: P, Radius, Count, R the radius and T the type of each body, V
+//	         their velocity and Ring to place them evenly on a circle
+type ToolMessage struct {
+	Type     string     `json:"type"`
+	Tool     string     `json:"tool"`
+	Body     uint16     `json:"body"`
+	P        mgl32.Vec2 `json:"p"`
+	V        mgl32.Vec2 `json:"v"`
+	Radius   float32    `json:"radius"`
+	Strength float32    `json:"strength"`
+	Count    int        `json:"count"`
+	R        float32    `json:"r"`
+	T        uint8      `json:"t"`
+	Ring     bool       `json:"ring"`
+}
+
+// ToolResultMessage answers a tool message with the bodies it affected, and
+// the player's quota for tools that spawn bodies
+type ToolResultMessage struct {
+	Type   string       `json:"type"`
+	Tool   string       `json:"tool"`
+	Bodies []uint16     `json:"bodies"`
+	Quota  *QuotaStatus `json:"quota,omitempty"`
+}
+
+// toolError is a tool message refused with an error code
+type toolError struct {
+	code   string
+	reason string
+}
+
+func (err *toolError) Error() string {
+	return err.reason
+}
+
+// validate checks the tool's parameters against the limits
+func (config ToolConfig) validate(tool *ToolMessage) error {
+	if !sim.IsFiniteVec2(tool.P) || !sim.IsFiniteVec2(tool.V) || !sim.IsFinite32(tool.Radius) || !sim.IsFinite32(tool.Strength) || !sim.IsFinite32(tool.R) {
+		return &toolError{"invalid_tool", "tool values must be finite"}
+	}
+
+	switch tool.Tool {
+	case ToolImpulse:
+		if tool.V.Len() > config.MaxStrength {
+			return &toolError{"invalid_tool", fmt.Sprintf("impulse must be at most %v", config.MaxStrength)}
+		}
+	case ToolExplode, ToolErase, ToolCluster:
+		if tool.Radius <= 0 || tool.Radius > config.MaxRadius {
+			return &toolError{"invalid_tool", fmt.Sprintf("radius must be above 0 and at most %v", config.MaxRadius)}
+		}
+	}
+
+	if tool.Tool == ToolExplode && (tool.Strength <= 0 || tool.Strength > config.MaxStrength) {
+		return &toolError{"invalid_tool", fmt.Sprintf("strength must be above 0 and at most %v", config.MaxStrength)}
+	}
+
+	if tool.Tool == ToolCluster && (tool.Count <= 0 || tool.Count > config.MaxCluster) {
+		return &toolError{"invalid_tool", fmt.Sprintf("count must be 1 to %v", config.MaxCluster)}
+	}
+	return nil
+}
+
+// clusterBodies places count bodies evenly on a ring or at random inside of
+// a circle
+func clusterBodies(tool *ToolMessage, random func() float64) []sim.BodyData {
+	bodies := make([]sim.BodyData, tool.Count)
+	for i := range bodies {
+		angle := 2 * math.Pi * float64(i) / float64(tool.Count)
+		distance := float64(tool.Radius)
+		if !tool.Ring {
+			angle = 2 * math.Pi * random()
+			distance *= math.Sqrt(random())
+		}
+
+		offset := mgl32.Vec2{float32(math.Cos(angle) * distance), float32(math.Sin(angle) * distance)}
+		bodies[i] = sim.BodyData{P: tool.P.Add(offset), V: tool.V, R: tool.R, T: tool.T}
+	}
+	return bodies
+}
+
+// useTool applies a validated tool message for client and returns the ids of
+// the bodies it affected
+func useTool(simState *sim.SimulationState, hub *Hub, client *Client, tool *ToolMessage) (ToolResultMessage, error) {
+	defer simState.Mu.Unlock()
+	simState.Mu.Lock()
+
+	result := ToolResultMessage{Type: MessageTypeToolResult, Tool: tool.Tool, Bodies: []uint16{}}
+	switch tool.Tool {
+	case ToolGrab:
+		if !sim.Grab(simState, client.id, tool.Body, tool.P) {
+			return result, &toolError{"unknown_body", fmt.Sprintf("body %v does not exist", tool.Body)}
+		}
+		result.Bodies = append(result.Bodies, tool.Body)
+	case ToolRelease:
+		sim.Release(simState, client.id)
+	case ToolImpulse:
+		if !sim.ApplyImpulse(simState, tool.Body, tool.V) {
+			return result, &toolError{"unknown_body", fmt.Sprintf("body %v does not exist", tool.Body)}
+		}
+		result.Bodies = append(result.Bodies, tool.Body)
+	case ToolExplode:
+		result.Bodies = sim.Explode(simState, tool.P, tool.Radius, tool.Strength)
+	case ToolErase:
+		result.Bodies = sim.Erase(simState, tool.P, tool.Radius, func(body *sim.BodyData) bool {
+			// players allowed to erase may only erase their own bodies
+			return len(client.admin) > 0 || body.Owner == client.owner()
+		})
+	case ToolCluster:
+		quota := hub.quota.limit(client)
+		status := QuotaStatus{Used: countOwned(simState, client.owner()), Limit: quota}
+		// validate the whole cluster first so an invalid body spawns none of it
+		bodies := clusterBodies(tool, rand.Float64)
+		for i := range bodies {
+			if err := sim.ValidateSpawn(simState, &bodies[i]); err != nil {
+				return result, err
+			}
+		}
+
+		for _, body := range bodies {
+			spawned, spawnStatus, err := spawnOwned(simState, client.owner(), quota, body)
+			if err != nil {
+				// keep the bodies spawned before the cluster ran out of room
+				if len(result.Bodies) > 0 {
+					break
+				}
+				return result, err
+			}
+			status = spawnStatus
+			result.Bodies = append(result.Bodies, spawned.ID)
+		}
+		result.Quota = &status
+	}
+	return result, nil
+}
+
+// handleToolMessage checks and applies a tool message from a client
+func handleToolMessage(simState *sim.SimulationState, hub *Hub, client *Client, tool *ToolMessage) {
+	if client.spectator {
+		ignoreSpectatorInput(client)
+		return
+	}
+
+	if !knownTool(tool.Tool) {
+		replyError(hub, client, "unknown_tool", fmt.Sprintf("unknown tool %q", tool.Tool))
+		return
+	}
+
+	if !hub.tools.allowed(client, tool.Tool) {
+		replyError(hub, client, "tool_forbidden", fmt.Sprintf("%v is not allowed", tool.Tool))
+		return
+	}
+
+	// grabs are moved with every cursor update so they have their own limit
+	limit := client.toolLimit
+	if tool.Tool == ToolGrab || tool.Tool == ToolRelease {
+		limit = client.grabLimit
+	}
+
+	if ok, _ := limit.allow(time.Now()); !ok {
+		replyError(hub, client, "tool_rate_limited", "too many tool messages")
+		return
+	}
+
+	if err := hub.tools.validate(tool); err != nil {
+		replyError(hub, client, "invalid_tool", err.Error())
+		return
+	}
+
+	result, err := useTool(simState, hub, client, tool)
+	if err != nil {
+		if toolErr, ok := err.(*toolError); ok {
+			replyError(hub, client, toolErr.code, toolErr.reason)
+		} else {
+			rejectSpawn(hub, client, err)
+		}
+		return
+	}
+
+	// grabs are only answered when they fail, they are sent far too often
+	if tool.Tool == ToolGrab {
+		return
+	}
+
+	hub.audit.record("tool", client, "tool", tool.Tool, "bodies", result.Bodies)
+	if err := replyToClient(hub, client, result); err != nil {
+		client.logger.Error("Error replying to client", "err", err)
+	}
+}
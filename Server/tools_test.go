@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/TylerStein/galaxy-sandbox-online/internal/sim"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestParseToolPermissions(t *testing.T) {
+	permissions, err := parseToolPermissions("explode:off, erase:all", DefaultToolConfig().Permissions)
+	if err != nil {
+		t.Fatalf("Error parsing tool permissions %v", err)
+	}
+
+	if permissions[ToolExplode] != ToolOff || permissions[ToolErase] != ToolEveryone {
+		t.Errorf("Tool permissions are %v, expected explode off and erase for everyone", permissions)
+	}
+
+	for _, value := range []string{"explode", "nuke:all", "explode:maybe"} {
+		if _, err := parseToolPermissions(value, nil); err == nil {
+			t.Errorf("parseToolPermissions(%q) error is nil, expected an error", value)
+		}
+	}
+}
+
+func TestToolMessages(t *testing.T) {
+	state := sim.CreateEmptySimulationState(16, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	hub.quota.Player = 3
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	// erase is for admins only by default
+	sendControl(state, hub, client, `{"type":"tool","tool":"erase","p":[0,0],"radius":5}`)
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "tool_forbidden" {
+		t.Errorf("Erase reply code is %v, expected %v", errorMessage.Code, "tool_forbidden")
+	}
+
+	sendControl(state, hub, client, `{"type":"tool","tool":"explode","p":[0,0],"radius":500,"strength":1}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "invalid_tool" {
+		t.Errorf("Oversized explode reply code is %v, expected %v", errorMessage.Code, "invalid_tool")
+	}
+
+	// the cluster stops at the player's quota
+	result := ToolResultMessage{}
+	sendControl(state, hub, client, `{"type":"tool","tool":"cluster","p":[0,0],"radius":10,"count":4,"r":1,"ring":true}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeToolResult).data, &result); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if len(result.Bodies) != 3 || result.Quota == nil || result.Quota.Used != 3 || len(state.Bodies) != 3 {
+		t.Fatalf("Cluster result is %+v with %v bodies, expected 3 spawned and used", result, len(state.Bodies))
+	}
+
+	if position := state.Bodies[1].P; !position.ApproxEqualThreshold(mgl32.Vec2{0, 10}, 1e-4) {
+		t.Errorf("Second ring body is at %v, expected %v", position, mgl32.Vec2{0, 10})
+	}
+
+	sendControl(state, hub, client, `{"type":"tool","tool":"impulse","body":9999,"v":[1,0]}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "unknown_body" {
+		t.Errorf("Impulse of a missing body reply code is %v, expected %v", errorMessage.Code, "unknown_body")
+	}
+
+	// the invalid explode, cluster and impulse count towards the burst, the
+	// forbidden erase does not
+	for i := 0; i < toolBurst-3; i++ {
+		sendControl(state, hub, client, `{"type":"tool","tool":"explode","p":[0,0],"radius":1,"strength":1}`)
+		nextReply(t, client, MessageTypeToolResult)
+	}
+
+	sendControl(state, hub, client, `{"type":"tool","tool":"explode","p":[0,0],"radius":1,"strength":1}`)
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "tool_rate_limited" {
+		t.Errorf("Reply code after the burst is %v, expected %v", errorMessage.Code, "tool_rate_limited")
+	}
+}
+
+func TestToolClusterValidatedFirst(t *testing.T) {
+	state := sim.CreateEmptySimulationState(16, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	// the third ring body is outside the spawn area, after two valid bodies
+	sendControl(state, hub, client, `{"type":"tool","tool":"cluster","p":[-90,0],"radius":20,"count":4,"r":1,"ring":true}`)
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != string(sim.SpawnErrorOutOfArea) || len(state.Bodies) != 0 {
+		t.Errorf("Cluster reply code is %v with %v bodies, expected %v and no bodies", errorMessage.Code, len(state.Bodies), sim.SpawnErrorOutOfArea)
+	}
+}
+
+func TestToolGrabRateLimit(t *testing.T) {
+	state := sim.CreateEmptySimulationState(16, 1, 1, 10, 10, 100, 1)
+	hub := newHub(make(chan *Snapshot), make(chan *ClientMessage))
+	go hub.run()
+
+	client := newClient(hub, nil, "test")
+	hub.register <- client
+
+	sendControl(state, hub, client, `{"type":"spawn","p":[0,0],"r":1}`)
+	spawned := SpawnedMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeSpawned).data, &spawned); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	// successful grabs are not answered, so the first error is the limit
+	grab := `{"type":"tool","tool":"grab","body":` + strconv.Itoa(int(spawned.Body)) + `,"p":[1,1]}`
+	for i := 0; i <= grabBurst; i++ {
+		sendControl(state, hub, client, grab)
+	}
+
+	errorMessage := ErrorMessage{}
+	if err := json.Unmarshal(nextReply(t, client, MessageTypeError).data, &errorMessage); err != nil {
+		t.Fatalf("Error unmarshalling reply %v", err)
+	}
+
+	if errorMessage.Code != "tool_rate_limited" {
+		t.Errorf("Reply code after the grab burst is %v, expected %v", errorMessage.Code, "tool_rate_limited")
+	}
+
+	// grabs do not use up the limit of the other tools
+	sendControl(state, hub, client, `{"type":"tool","tool":"explode","p":[0,0],"radius":1,"strength":1}`)
+	nextReply(t, client, MessageTypeToolResult)
+}